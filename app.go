@@ -3,145 +3,636 @@ package main
 import (
 	"crypto/sha256"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
 	imap2 "github.com/emersion/go-imap"
 	"io/ioutil"
-	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
-type MailboxMeta struct {
-	Name   string `json:"name"`
-	Server string `json:"server"`
-	Login  string `json:"login"`
-	Count  int    `json:"count"`
+// MailboxPlan describes what a dry run found for a single mailbox.
+type MailboxPlan struct {
+	Name       string
+	Dir        string
+	DirMissing bool
+	Total      int
+	Filtered   int
+	New        int
+	NewBytes   int64
 }
 
 type App struct {
 	cfg         *Config
 	mailboxes   []*imap2.MailboxStatus
+	delimiters  map[string]string     // hierarchy delimiter of all mailboxes on the server by name
+	namespaces  map[string]*Namespace // namespace of the archived mailboxes outside of the personal namespace
 	totalMails  int
 	failedMails []string
+	plans       []*MailboxPlan
+	report      *AccountReport
+	retries     *RetryQueue
+	checkpoint  *Checkpoint // mailboxes completed by the previous, interrupted run
+	completed   *Checkpoint // mailboxes completed by this run
+	storage     Storage
+	mutex       sync.Mutex // protects failedMails, plans and report while archiving concurrently
 }
 
+// Archive downloads all new mails of the given account. Afterwards, Report returns the outcome of the run.
 func (a *App) Archive(cfg *Config) error {
 	a.cfg = cfg
-	imap := &Imap{}
+	a.storage = storageOf(cfg.Storage)
+	a.report = newAccountReport(cfg)
+	if !cfg.DryRun {
+		// the status belongs to the other process as well, so it is left alone
+		lock, err := acquireLock(archiveLockFile(cfg.Dir), "archive", cfg.LockWait)
+		if err != nil {
+			a.report.finish(err)
+			return err
+		}
+		defer lock.Unlock()
+	}
+	err := a.archiveSafe()
+	a.report.finish(err)
+	if !cfg.DryRun {
+		a.updateStatus()
+		event := &HookEvent{Event: hookRunFinished, Report: a.report}
+		if err != nil {
+			event.Error = err.Error()
+		}
+		a.runHooks(event)
+	}
+	return err
+}
+
+// updateStatus persists the outcome of the run and publishes it as metrics.
+func (a *App) updateStatus() {
+	status, err := loadStatus(a.cfg.Dir)
+	if err != nil {
+		logger.Warn("cannot load account status", "account", a.cfg.Name, "err", err)
+	}
+	status.update(a.report)
+	if err := status.save(a.cfg.Dir); err != nil {
+		logger.Warn("cannot save account status", "account", a.cfg.Name, "err", err)
+	}
+	recordArchiveMetrics(a.report, status)
+}
+
+// Report returns the summary of the last Archive call.
+func (a *App) Report() *AccountReport {
+	return a.report
+}
+
+// archiveSafe turns a panic, e.g. caused by an unexpected server response, into an error of this account.
+func (a *App) archiveSafe() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic while archiving: %v", r)
+		}
+	}()
+	return a.archive()
+}
+
+func (a *App) archive() error {
+	cfg := a.cfg
+	imap, err := a.connect()
+	if err != nil {
+		return err
+	}
+	defer a.logout(imap)
+
+	if err := a.migrateDirs(); err != nil {
+		return err
+	}
+
+	if !cfg.DryRun {
+		a.retries, err = loadRetryQueue(cfg.Dir)
+		if err != nil {
+			logger.Warn("cannot load retry queue", "account", cfg.Name, "err", err)
+		}
+		defer func() {
+			if err := a.retries.save(cfg.Dir); err != nil {
+				logger.Warn("cannot save retry queue", "account", cfg.Name, "err", err)
+			}
+		}()
+		a.checkpoint, err = loadCheckpoint(cfg.Dir)
+		if err != nil {
+			logger.Warn("cannot load checkpoint", "account", cfg.Name, "err", err)
+		}
+		a.completed = &Checkpoint{}
+	}
+
+	if err := a.followRenames(imap); err != nil {
+		return err
+	}
+
+	if cfg.DryRun {
+		a.plans = nil
+		err := a.forEachMailbox(imap, a.planMailbox)
+		if err != nil {
+			return err
+		}
+		a.printPlan()
+		return nil
+	}
+
+	err = a.forEachMailbox(imap, a.saveMailbox)
+	if err == errInterrupted {
+		a.completed.Interrupted = time.Now()
+		if err := a.completed.save(cfg.Dir); err != nil {
+			logger.Warn("cannot save checkpoint", "account", cfg.Name, "err", err)
+		} else {
+			logger.Info("checkpoint saved", "account", cfg.Name, "mailboxes", len(a.completed.Mailboxes),
+				"file", checkpointFile(cfg.Dir))
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err := removeCheckpoint(cfg.Dir); err != nil {
+		logger.Warn("cannot remove checkpoint", "account", cfg.Name, "err", err)
+	}
+
+	if len(a.failedMails) > 0 {
+		logger.Warn("ignored unprocessable mails", "account", cfg.Name, "count", len(a.failedMails))
+		for _, mail := range a.failedMails {
+			logger.Warn("ignored mail", "account", cfg.Name, "mail", mail)
+		}
+	}
+	if len(a.retries.Entries) > 0 {
+		logger.Warn("mails queued for retry", "account", cfg.Name, "count", len(a.retries.Entries),
+			"file", retryFile(cfg.Dir))
+	}
+
+	return nil
+}
+
+// connect logs in and collects the status of all included mailboxes.
+func (a *App) connect() (Source, error) {
+	cfg := a.cfg
+	imap := newSource(cfg)
 	err := imap.Login(cfg)
 	if err != nil {
-		return fmt.Errorf("failed to login: %w", err)
+		return nil, fmt.Errorf("failed to login: %w", err)
 	}
-	defer imap.Logout()
 
-	mailboxes, err := imap.Mailboxes()
+	mailboxes, err := a.listMailboxes(imap)
 	if err != nil {
-		return fmt.Errorf("unable to list mailboxes: %w", err)
+		imap.Logout()
+		return nil, fmt.Errorf("unable to list mailboxes: %w", err)
 	}
 	a.mailboxes = nil
+	a.delimiters = make(map[string]string)
 	a.totalMails = 0
 	for _, mb := range mailboxes {
-		fmt.Println(mb.Name)
+		a.delimiters[mb.Name] = mb.Delimiter
+		if !cfg.IncludesMailbox(mb.Name) {
+			logger.Info("ignoring excluded mailbox", "account", cfg.Name, "mailbox", mb.Name)
+			continue
+		}
 		status, err := imap.Status(mb.Name)
 		if err != nil {
-			return fmt.Errorf("failed to get status: %w", err)
+			imap.Logout()
+			return nil, fmt.Errorf("failed to get status: %w", err)
 		}
-		fmt.Printf(" contains %d mails\n", status.Messages)
+		logger.Info("found mailbox", "account", cfg.Name, "mailbox", mb.Name, "mails", status.Messages)
 		a.totalMails += int(status.Messages)
 		a.mailboxes = append(a.mailboxes, status)
 	}
-	fmt.Printf("total mails %d\n", a.totalMails)
+	logger.Info("mailboxes listed", "account", cfg.Name, "mailboxes", len(a.mailboxes), "mails", a.totalMails)
+	return imap, nil
+}
 
+// logout closes the connection and adds its compression statistics to the report.
+func (a *App) logout(srv Source) {
+	if c, ok := srv.(compressedSource); ok {
+		if stats := c.Compression(); stats != nil {
+			a.mutex.Lock()
+			if a.report.Compression == nil {
+				a.report.Compression = &CompressionReport{}
+			}
+			a.report.Compression.add(stats)
+			a.mutex.Unlock()
+		}
+	}
+	srv.Logout()
+}
+
+// mailboxDir returns the directory of the given mailbox within the account directory. Child mailboxes are
+// nested within the directory of their parent, mailboxes of other namespaces within the directory of the namespace.
+func (a *App) mailboxDir(name string) string {
+	return filepath.Join(a.cfg.Dir, a.namespaces[name].mailboxPath(name, a.delimiters[name]))
+}
+
+// forEachMailbox invokes fn for each mailbox. If the account has a concurrency larger than one, additional
+// connections are opened and the mailboxes are distributed among them. The first error stops the distribution.
+func (a *App) forEachMailbox(srv Source, fn func(srv Source, mailbox *imap2.MailboxStatus) error) error {
+	conns := []Source{srv}
+	for len(conns) < a.cfg.Concurrency && len(conns) < len(a.mailboxes) {
+		other := newSource(a.cfg)
+		if err := other.Login(a.cfg); err != nil {
+			logger.Warn("failed to open additional connection", "account", a.cfg.Name, "err", err)
+			break
+		}
+		defer a.logout(other)
+		conns = append(conns, other)
+	}
+
+	if len(conns) == 1 {
+		for _, mb := range a.mailboxes {
+			if isInterrupted() {
+				return errInterrupted
+			}
+			if err := fn(srv, mb); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	work := make(chan *imap2.MailboxStatus)
+	errs := make(chan error, len(conns))
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(conn Source) {
+			defer wg.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					errs <- fmt.Errorf("panic while archiving: %v", r)
+				}
+			}()
+			for mb := range work {
+				if err := fn(conn, mb); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(conn)
+	}
+
+	var err error
+distribute:
 	for _, mb := range a.mailboxes {
-		err := a.saveMailbox(imap, mb)
+		select {
+		case work <- mb:
+		case err = <-errs:
+			break distribute
+		case <-interrupted:
+			err = errInterrupted
+			break distribute
+		}
+	}
+	close(work)
+	wg.Wait()
+	if err == nil {
+		select {
+		case err = <-errs:
+		default:
+		}
+	}
+	return err
+}
+
+// remoteMail is a message found on the server during the header scan.
+type remoteMail struct {
+	msg      *imap2.Message
+	hash     string
+	emlFile  string
+	archived bool
+	filtered bool   // outside of the configured date range, never downloaded
+	uidl     string // unique id of sources without numeric uids
+}
+
+// scanMailbox fetches the headers of the given mailbox and checks for each mail, whether a file with its header
+// hash exists in targetDir. Mails rejected by includes, usually the date range of the account, are returned as
+// filtered, so that the membership of the mailbox is complete, but they are never pending.
+func (a *App) scanMailbox(srv Source, mailbox *imap2.MailboxStatus, targetDir string, includes func(time.Time) bool) ([]*remoteMail, int, error) {
+	if mailbox.Messages == 0 {
+		return nil, 0, nil
+	}
+	if src, ok := srv.(uidlSource); ok {
+		return a.scanByUIDL(src, mailbox, targetDir, includes)
+	}
+	mails, err := srv.Mails(mailbox.Name, []imap2.FetchItem{imap2.FetchEnvelope, imap2.FetchRFC822Size, imap2.FetchInternalDate, imap2.FetchUid, imap2.FetchRFC822Header}, 1, int(mailbox.Messages))
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to fetch mails from %s: %w", mailbox.Name, err)
+	}
+	archived, err := a.archivedFiles(targetDir)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var res []*remoteMail
+	filtered := 0
+	for _, mail := range mails {
+		remote, err := newRemoteMail(mail, targetDir, archived)
 		if err != nil {
-			return err
+			return nil, 0, err
+		}
+		if !includes(mail.InternalDate) {
+			remote.filtered = true
+			filtered++
 		}
+		res = append(res, remote)
 	}
+	return res, filtered, nil
+}
 
-	if len(a.failedMails) > 0 {
-		fmt.Printf("ignored %d unprocessable mails:\n", len(a.failedMails))
-		for _, mail := range a.failedMails {
-			fmt.Println(mail)
+// scanByUIDL is scanMailbox for sources with unique ids. Mails, which are recorded with their unique id in the
+// meta of targetDir and still exist, are recognized without fetching their headers again.
+func (a *App) scanByUIDL(srv uidlSource, mailbox *imap2.MailboxStatus, targetDir string, includes func(time.Time) bool) ([]*remoteMail, int, error) {
+	meta, err := readStoredMeta(a.storage, targetDir)
+	if err != nil {
+		logger.Warn("cannot read mailbox meta", "account", a.cfg.Name, "mailbox", mailbox.Name, "err", err)
+	}
+	archived, err := a.archivedFiles(targetDir)
+	if err != nil {
+		return nil, 0, err
+	}
+	known := make(map[string]string)
+	for hash, msg := range meta.Messages {
+		if len(msg.UIDL) > 0 {
+			known[msg.UIDL] = hash
 		}
 	}
 
-	return nil
+	mails, err := srv.Mails(mailbox.Name, []imap2.FetchItem{imap2.FetchUid, imap2.FetchRFC822Size}, 1, int(mailbox.Messages))
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list mails of %s: %w", mailbox.Name, err)
+	}
+	var res []*remoteMail
+	filtered := 0
+	for _, mail := range mails {
+		uidl := srv.UIDL(mail)
+		var remote *remoteMail
+		if hash, ok := known[uidl]; ok {
+			emlFile := filepath.Join(targetDir, hash+".eml")
+			if archived[hash+".eml"] {
+				mail.InternalDate = meta.Messages[hash].InternalDate
+				remote = &remoteMail{msg: mail, hash: hash, emlFile: emlFile, archived: true}
+			}
+		}
+		if remote == nil {
+			headers, err := srv.Mails(mailbox.Name, []imap2.FetchItem{imap2.FetchEnvelope, imap2.FetchRFC822Size, imap2.FetchUid, imap2.FetchRFC822Header}, int(mail.SeqNum), int(mail.SeqNum))
+			if err != nil || len(headers) != 1 {
+				return nil, 0, fmt.Errorf("failed to fetch header of mail %d from %s: %v", mail.SeqNum, mailbox.Name, err)
+			}
+			remote, err = newRemoteMail(headers[0], targetDir, archived)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		if !includes(remote.msg.InternalDate) {
+			remote.filtered = true
+			filtered++
+		}
+		remote.uidl = uidl
+		res = append(res, remote)
+	}
+	return res, filtered, nil
 }
 
-func (a *App) writeMeta(dir string, srv *Imap, mailbox *imap2.MailboxStatus) error {
-	meta := &MailboxMeta{
-		Name:   mailbox.Name,
-		Server: srv.cfg.Server,
-		Login:  srv.cfg.Login,
-		Count:  int(mailbox.Messages),
-	}
-	b, err := json.MarshalIndent(meta, " ", " ")
+// archivedFiles returns the names of the files in targetDir. The directory is listed once per scan, instead of
+// checking each mail, which would be a request per mail for remote storages.
+func (a *App) archivedFiles(targetDir string) (map[string]bool, error) {
+	files, err := a.storage.List(targetDir)
 	if err != nil {
-		return fmt.Errorf("failed to marshal: %w", err)
+		return nil, fmt.Errorf("failed to list %s: %w", targetDir, err)
+	}
+	res := make(map[string]bool)
+	for _, f := range files {
+		res[f] = true
 	}
-	fname := filepath.Join(dir, "mailbox.json")
-	err = ioutil.WriteFile(fname, b, os.ModePerm)
+	return res, nil
+}
+
+// newRemoteMail hashes the header of mail and checks, whether it is one of the archived files of targetDir.
+func newRemoteMail(mail *imap2.Message, targetDir string, archived map[string]bool) (*remoteMail, error) {
+	headers, err := bodyFor(mail, imap2.FetchRFC822Header)
 	if err != nil {
-		return fmt.Errorf("failed to write %s: %w", fname, err)
+		return nil, fmt.Errorf("missing rfc header: %w", err)
 	}
-	return err
+	hash := sha256.Sum224(headers)
+	hashStr := hex.EncodeToString(hash[:])
+	emlFile := filepath.Join(targetDir, hashStr+".eml")
+	return &remoteMail{msg: mail, hash: hashStr, emlFile: emlFile, archived: archived[hashStr+".eml"]}, nil
+}
+
+// pending returns the mails within the date range, which are not archived yet.
+func pending(mails []*remoteMail) []*remoteMail {
+	var res []*remoteMail
+	for _, mail := range mails {
+		if !mail.archived && !mail.filtered {
+			res = append(res, mail)
+		}
+	}
+	return res
 }
 
-func (a *App) saveMailbox(srv *Imap, mailbox *imap2.MailboxStatus) error {
-	targetDir := filepath.Join(a.cfg.Dir, sanitize(mailbox.Name))
-	err := os.MkdirAll(targetDir, os.ModePerm)
+// updateMeta writes the mailbox.json of targetDir. Existing message entries are kept and the given mails are added.
+func (a *App) updateMeta(targetDir string, mailbox *imap2.MailboxStatus, mails []*remoteMail) error {
+	meta, err := readStoredMeta(a.storage, targetDir)
 	if err != nil {
-		return fmt.Errorf("failed to mkdir %s: %w", targetDir, err)
+		logger.Warn("replacing unreadable mailbox meta", "dir", targetDir, "err", err)
+		meta = &MailboxMeta{}
+	}
+	meta.Name = mailbox.Name
+	meta.Delimiter = a.delimiters[mailbox.Name]
+	meta.Namespace = a.namespaces[mailbox.Name]
+	meta.UIDValidity = mailbox.UidValidity
+	meta.Server = a.cfg.Server
+	meta.Login = a.cfg.Login
+	meta.Count = int(mailbox.Messages)
+	for _, mail := range mails {
+		if mail.archived {
+			meta.add(mail)
+		}
 	}
+	return writeStoredMeta(a.storage, targetDir, meta)
+}
 
-	err = a.writeMeta(targetDir, srv, mailbox)
+func (a *App) saveMailbox(srv Source, mailbox *imap2.MailboxStatus) error {
+	if a.checkpoint.unchanged(mailbox) {
+		logger.Info("mailbox completed before the interruption and unchanged, skipping", "account", a.cfg.Name,
+			"mailbox", mailbox.Name)
+		a.mutex.Lock()
+		a.report.Mailboxes = append(a.report.Mailboxes, &MailboxReport{Name: mailbox.Name,
+			Total: int(mailbox.Messages), Skipped: int(mailbox.Messages)})
+		a.mutex.Unlock()
+		a.completed.completed(mailbox)
+		return nil
+	}
+
+	targetDir := a.mailboxDir(mailbox.Name)
+	err := a.updateMeta(targetDir, mailbox, nil)
 	if err != nil {
 		return fmt.Errorf("failed to create meta: %w", err)
 	}
 
-	if mailbox.Messages > 0 {
-		mails, err := srv.Mails(mailbox.Name, []imap2.FetchItem{imap2.FetchEnvelope, imap2.FetchRFC822Size, imap2.FetchRFC822Header}, 1, int(mailbox.Messages))
+	all, filtered, err := a.scanMailbox(srv, mailbox, targetDir, a.cfg.IncludesDate)
+	if err != nil {
+		return err
+	}
+	mails := pending(all)
+
+	mbReport := &MailboxReport{
+		Name:     mailbox.Name,
+		Total:    int(mailbox.Messages),
+		Skipped:  int(mailbox.Messages) - len(mails) - filtered,
+		Filtered: filtered,
+	}
+	a.mutex.Lock()
+	a.report.Mailboxes = append(a.report.Mailboxes, mbReport)
+	a.mutex.Unlock()
+	stopped := false
+	for _, pending := range mails {
+		if isInterrupted() {
+			logger.Info("mailbox interrupted", "account", a.cfg.Name, "mailbox", mailbox.Name, "saved", mbReport.New)
+			stopped = true
+			break
+		}
+		mail := pending.msg
+		eml, err := a.download(srv, mailbox.Name, pending)
+		if err != nil {
+			if !isParseError(err) {
+				return err
+			}
+			attempts := a.retries.failed(mailbox.Name, pending, err)
+			logger.Warn("ignoring broken mail", "account", a.cfg.Name, "mailbox", mailbox.Name, "seq", mail.SeqNum, "mail", debugTitle(mail), "attempts", attempts, "err", err)
+			a.mutex.Lock()
+			a.failedMails = append(a.failedMails, debugTitle(mail))
+			a.report.Errors = append(a.report.Errors, fmt.Sprintf("%s/%d: %s: %v", mailbox.Name, mail.SeqNum, debugTitle(mail), err))
+			mbReport.Failed++
+			a.mutex.Unlock()
+			a.runHooks(&HookEvent{Event: hookMailFailed, Mailbox: mailbox.Name, Mail: newHookMail(pending),
+				Error: err.Error()})
+			continue
+		}
+		// the modification time is the date, when the server received the mail
+		err = a.storage.WriteFile(pending.emlFile, eml, mail.InternalDate)
 		if err != nil {
-			return fmt.Errorf("failed to fetch mails from %s: %w", mailbox.Name, err)
+			return fmt.Errorf("failed to write email %s: %w", pending.emlFile, err)
 		}
+		pending.archived = true
+		mbReport.New++
+		mbReport.Bytes += int64(len(eml))
+		logger.Info("saved mail", "account", a.cfg.Name, "mailbox", mailbox.Name, "seq", mail.SeqNum, "mail", debugTitle(mail))
+		hookMail := newHookMail(pending)
+		hookMail.Size = len(eml)
+		a.runHooks(&HookEvent{Event: hookMailSaved, Mailbox: mailbox.Name, File: pending.emlFile, Mail: hookMail})
+	}
 
-		for _, mail := range mails {
-			headers, err := bodyFor(mail, imap2.FetchRFC822Header)
-			if err != nil {
-				return fmt.Errorf("missing rfc header: %w", err)
-			}
-			hash := sha256.Sum224(headers)
-			hashStr := hex.EncodeToString(hash[:])
-			emlFile := filepath.Join(targetDir, hashStr+".eml")
-			if _, err := os.Stat(emlFile); err != nil {
-				fullMail, err := srv.Mail(mailbox.Name, int(mail.SeqNum)) //or uid?
-				if err != nil {
-					if strings.Contains(err.Error(), "Missing type-specific fields") {
-						fmt.Printf("ignoring broken mail %d: %s Reason: %v\n", mail.SeqNum, debugTitle(mail), err)
-						a.failedMails = append(a.failedMails, debugTitle(mail))
-						continue
-					} else {
-						return fmt.Errorf("cannot read full mail: %w", err)
-					}
-				}
-				eml, err := bodyFor(fullMail, imap2.FetchRFC822)
-				if err != nil {
-					return fmt.Errorf("missing rfc content: %w", err)
-				}
-				err = ioutil.WriteFile(emlFile, eml, os.ModePerm)
-				if err != nil {
-					return fmt.Errorf("failed to write email %s: %w", emlFile, err)
-				}
-				fmt.Printf("saved %s/%d: %s\n", mailbox.Name, mail.SeqNum, debugTitle(mail))
-			}
+	a.retries.revisit(mailbox.Name, all)
 
+	err = a.updateMeta(targetDir, mailbox, all)
+	if err != nil {
+		return fmt.Errorf("failed to update meta: %w", err)
+	}
+	if err := a.recordSnapshot(targetDir, all); err != nil {
+		return fmt.Errorf("failed to update snapshots: %w", err)
+	}
+	if stopped {
+		return errInterrupted
+	}
+	a.completed.completed(mailbox)
+	a.runHooks(&HookEvent{Event: hookMailboxCompleted, Mailbox: mailbox.Name, MailboxReport: mbReport})
+	return nil
+}
+
+// recordSnapshot appends the mails found on the server in this run to the history of the mailbox. An unreadable
+// history is kept as it is, so that it can be repaired by hand.
+func (a *App) recordSnapshot(targetDir string, mails []*remoteMail) error {
+	snapshots, err := readSnapshots(a.storage, targetDir)
+	if err != nil {
+		logger.Warn("cannot record snapshot", "account", a.cfg.Name, "dir", targetDir, "err", err)
+		return nil
+	}
+	var hashes []string
+	for _, mail := range mails {
+		hashes = append(hashes, mail.hash)
+	}
+	snapshots.record(a.report.Started, hashes)
+	return snapshots.write(a.storage, targetDir)
+}
+
+// download fetches the complete mail. If the client library cannot parse the response, e.g. due to a broken
+// body structure, the raw content is fetched by uid without any further parsing.
+func (a *App) download(srv Source, mailbox string, mail *remoteMail) ([]byte, error) {
+	fullMail, err := srv.Mail(mailbox, int(mail.msg.SeqNum))
+	if err == nil {
+		eml, err := bodyFor(fullMail, imap2.FetchRFC822)
+		if err != nil {
+			return nil, fmt.Errorf("missing rfc content: %w", err)
 		}
+		return eml, nil
+	}
+	if !isParseError(err) {
+		return nil, fmt.Errorf("cannot read full mail: %w", err)
 	}
+
+	logger.Info("cannot parse mail, fetching raw content", "account", a.cfg.Name, "mailbox", mailbox, "uid", mail.msg.Uid, "mail", debugTitle(mail.msg), "err", err)
+	eml, rawErr := srv.RawMail(mailbox, mail.msg.Uid)
+	if rawErr != nil {
+		// only the raw fetch decides, whether the mail is broken or e.g. the connection has been lost
+		return nil, fmt.Errorf("cannot parse mail (%s), raw fetch failed: %w", err.Error(), rawErr)
+	}
+	return eml, nil
+}
+
+// planMailbox performs the same header scan as saveMailbox but only records what would be downloaded,
+// without creating directories or writing any files.
+func (a *App) planMailbox(srv Source, mailbox *imap2.MailboxStatus) error {
+	targetDir := a.mailboxDir(mailbox.Name)
+	plan := &MailboxPlan{
+		Name:  mailbox.Name,
+		Dir:   targetDir,
+		Total: int(mailbox.Messages),
+	}
+	if exists, err := a.storage.Exists(filepath.Join(targetDir, metaFile)); err != nil || !exists {
+		plan.DirMissing = true
+	}
+
+	all, filtered, err := a.scanMailbox(srv, mailbox, targetDir, a.cfg.IncludesDate)
+	if err != nil {
+		return err
+	}
+	mails := pending(all)
+	plan.Filtered = filtered
+	for _, pending := range mails {
+		plan.New++
+		plan.NewBytes += int64(pending.msg.Size)
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.plans = append(a.plans, plan)
+	a.report.Mailboxes = append(a.report.Mailboxes, &MailboxReport{
+		Name:     mailbox.Name,
+		Total:    plan.Total,
+		New:      plan.New,
+		Skipped:  plan.Total - plan.New - plan.Filtered,
+		Filtered: plan.Filtered,
+		Bytes:    plan.NewBytes,
+	})
 	return nil
 }
 
+func (a *App) printPlan() {
+	logger.Info("dry run, nothing has been written", "account", a.cfg.Name, "login", a.cfg.Login, "server", a.cfg.Server)
+	totalNew := 0
+	var totalBytes int64
+	for _, plan := range a.plans {
+		logger.Info("plan", "mailbox", plan.Name, "dir", plan.Dir, "createDir", plan.DirMissing, "total", plan.Total,
+			"filtered", plan.Filtered, "download", plan.New, "bytes", plan.NewBytes, "size", formatSize(plan.NewBytes))
+		totalNew += plan.New
+		totalBytes += plan.NewBytes
+	}
+	logger.Info("plan total", "account", a.cfg.Name, "total", a.totalMails, "download", totalNew, "bytes", totalBytes,
+		"size", formatSize(totalBytes))
+}
+
 func debugTitle(msg *imap2.Message) string {
 	sb := &strings.Builder{}
 	for _, adr := range msg.Envelope.From {
@@ -172,14 +663,16 @@ func bodyFor(msg *imap2.Message, item imap2.FetchItem) ([]byte, error) {
 	return nil, fmt.Errorf("cannot get body for %s", item)
 }
 
-func sanitize(str string) string {
-	sb := &strings.Builder{}
-	for _, r := range str {
-		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
-			sb.WriteRune(r)
-		} else {
-			sb.WriteByte('_')
-		}
+// formatSize returns a human readable representation of the given amount of bytes.
+func formatSize(sizeNum int64) string {
+	size := strconv.Itoa(int(sizeNum)) + " Byte"
+	if sizeNum > 1024 {
+		size = strconv.Itoa(int(sizeNum/1024)) + " KiB"
+		sizeNum /= 1024
 	}
-	return sb.String()
+	if sizeNum > 1024 {
+		size = strconv.Itoa(int(sizeNum/1024)) + " MiB"
+		sizeNum /= 1024
+	}
+	return size
 }
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+)
+
+// Backfill applies the internal dates of the server to mails, which have been archived before the modification
+// time has been set on download. Each archived mail is written again with its date, which is kept by the storage.
+// The dates are also recorded in the mailbox metadata. Nothing is downloaded.
+func (a *App) Backfill(cfg *Config) error {
+	a.cfg = cfg
+	a.storage = storageOf(cfg.Storage)
+	lock, err := acquireLock(archiveLockFile(cfg.Dir), "backfill", cfg.LockWait)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	imap, err := a.connect()
+	if err != nil {
+		return err
+	}
+	defer imap.Logout()
+	if err := a.migrateDirs(); err != nil {
+		return err
+	}
+
+	for _, mb := range a.mailboxes {
+		targetDir := a.mailboxDir(mb.Name)
+		exists, err := a.storage.Exists(filepath.Join(targetDir, metaFile))
+		if err != nil {
+			return fmt.Errorf("cannot check %s: %w", targetDir, err)
+		}
+		if !exists {
+			logger.Info("mailbox not archived, ignoring", "account", cfg.Name, "mailbox", mb.Name)
+			continue
+		}
+		mails, _, err := a.scanMailbox(imap, mb, targetDir, cfg.IncludesDate)
+		if err != nil {
+			return err
+		}
+		updated := 0
+		for _, mail := range mails {
+			if !mail.archived || mail.msg.InternalDate.IsZero() {
+				continue
+			}
+			b, err := a.storage.ReadFile(mail.emlFile)
+			if err != nil {
+				return fmt.Errorf("cannot read %s: %w", mail.emlFile, err)
+			}
+			if err := a.storage.WriteFile(mail.emlFile, b, mail.msg.InternalDate); err != nil {
+				return fmt.Errorf("cannot set modification time of %s: %w", mail.emlFile, err)
+			}
+			updated++
+		}
+		if err := a.updateMeta(targetDir, mb, mails); err != nil {
+			return fmt.Errorf("failed to update meta: %w", err)
+		}
+		logger.Info("backfilled mailbox", "account", cfg.Name, "mailbox", mb.Name, "updated", updated,
+			"missing", len(mails)-updated)
+	}
+	return nil
+}
+
+// backfillCommand sets the modification times of existing archives: imaparc backfill [account flags|-configFile]
+func backfillCommand(args []string) int {
+	flags := flag.NewFlagSet("backfill", flag.ExitOnError)
+	cfg := &Config{}
+	addAccountFlags(flags, cfg)
+	configFile := flags.String("configFile", "", "filename to a configuration in yaml, json or toml format")
+	flags.DurationVar(&cfg.LockWait, "lockWait", 0, "how long to wait for another run on the same directory, e.g. 10m")
+	flags.Parse(args)
+
+	failed := 0
+	for _, accCfg := range accountConfigs(cfg, *configFile) {
+		accCfg.LockWait = cfg.LockWait
+		app := &App{}
+		if err := app.Backfill(accCfg); err != nil {
+			logger.Error("failed to backfill", "account", accCfg.Name, "err", err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestBackfill applies the internal date of the server to mails archived without it, in the local directories
+// and in a bucket.
+func TestBackfill(t *testing.T) {
+	mails := []string{"Subject: mail 1\r\n\r\nbody\r\n", "Subject: mail 2\r\n\r\nbody\r\n"}
+	internalDate := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	server, s3 := newS3TestServer(t)
+	// the lock is kept locally in the archive directory
+	s3.root = t.TempDir()
+	for _, storage := range []Storage{localStorage{}, s3} {
+		srv := newIMAPTestServer(t, false, mails...)
+		dir := filepath.Join(t.TempDir(), "alice")
+		if storage == s3 {
+			dir = filepath.Join(s3.root, "alice")
+		}
+		cfg := &Config{Account: Account{Name: "alice", Server: "127.0.0.1", Port: srv.port, Login: "alice",
+			Password: "secret", TLS: true, InsecureSkipVerify: true}, Dir: dir, Storage: storage}
+
+		inbox := filepath.Join(dir, "INBOX")
+		meta := &MailboxMeta{Name: "INBOX", Delimiter: "/", Messages: map[string]*MessageMeta{}}
+		var files []string
+		for _, eml := range mails {
+			sum := sha256.Sum224(headerOf([]byte(eml)))
+			hash := hex.EncodeToString(sum[:])
+			files = append(files, filepath.Join(inbox, hash+".eml"))
+			meta.Messages[hash] = &MessageMeta{Size: uint32(len(eml))}
+			if err := storage.WriteFile(files[len(files)-1], []byte(eml), time.Time{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := writeStoredMeta(storage, inbox, meta); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := (&App{}).Backfill(cfg); err != nil {
+			t.Fatalf("%T: %v", storage, err)
+		}
+		for i, file := range files {
+			b, err := storage.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != mails[i] {
+				t.Errorf("%T: %s changed to %q", storage, file, b)
+			}
+			if storage == s3 {
+				key, _ := s3.key(file)
+				if date := server.dates[key]; date != internalDate.Format(time.RFC3339) {
+					t.Errorf("%T: expected internal date of %s, got %q", storage, key, date)
+				}
+			} else if info, err := os.Stat(file); err != nil || !info.ModTime().Equal(internalDate) {
+				t.Errorf("%T: expected modification time %v of %s, got %v, %v", storage, internalDate, file, info, err)
+			}
+		}
+	}
+}
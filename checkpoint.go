@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	imap2 "github.com/emersion/go-imap"
+)
+
+// Checkpoint records the mailboxes, which an interrupted run has completed. The next run skips those, which have
+// not changed on the server since, instead of scanning all of their headers again.
+type Checkpoint struct {
+	Interrupted time.Time                     `json:"interrupted"`
+	Mailboxes   map[string]*CheckpointMailbox `json:"mailboxes"`
+	mutex       sync.Mutex
+}
+
+// CheckpointMailbox is the state of a completed mailbox. A mailbox is unchanged, if none of the values differ.
+type CheckpointMailbox struct {
+	UIDValidity uint32 `json:"uidValidity"`
+	UIDNext     uint32 `json:"uidNext"`
+	Messages    uint32 `json:"messages"`
+}
+
+func checkpointFile(dir string) string {
+	return filepath.Join(dir, stateDir, "checkpoint.json")
+}
+
+// loadCheckpoint reads the checkpoint of the account in dir. A missing file results in an empty checkpoint.
+func loadCheckpoint(dir string) (*Checkpoint, error) {
+	c := &Checkpoint{}
+	b, err := ioutil.ReadFile(checkpointFile(dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, nil
+		}
+		return c, fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+	if err := json.Unmarshal(b, c); err != nil {
+		return c, fmt.Errorf("failed to decode checkpoint: %w", err)
+	}
+	return c, nil
+}
+
+func (c *Checkpoint) save(dir string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	fname := checkpointFile(dir)
+	if err := os.MkdirAll(filepath.Dir(fname), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to mkdir %s: %w", filepath.Dir(fname), err)
+	}
+	b, err := json.MarshalIndent(c, " ", " ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal: %w", err)
+	}
+	if err := ioutil.WriteFile(fname, b, os.ModePerm); err != nil {
+		return fmt.Errorf("failed to write %s: %w", fname, err)
+	}
+	return nil
+}
+
+// removeCheckpoint deletes the checkpoint of the account in dir after a completed run.
+func removeCheckpoint(dir string) error {
+	fname := checkpointFile(dir)
+	if err := os.Remove(fname); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove %s: %w", fname, err)
+	}
+	return nil
+}
+
+// completed records the state of a mailbox, which has been archived completely.
+func (c *Checkpoint) completed(mailbox *imap2.MailboxStatus) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.Mailboxes == nil {
+		c.Mailboxes = make(map[string]*CheckpointMailbox)
+	}
+	c.Mailboxes[mailbox.Name] = &CheckpointMailbox{
+		UIDValidity: mailbox.UidValidity,
+		UIDNext:     mailbox.UidNext,
+		Messages:    mailbox.Messages,
+	}
+}
+
+// unchanged returns true, if the mailbox has been completed and the server reports the same state. Without a
+// UIDNEXT, e.g. for POP3, new mails cannot be detected and the mailbox is never skipped.
+func (c *Checkpoint) unchanged(mailbox *imap2.MailboxStatus) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	done := c.Mailboxes[mailbox.Name]
+	return done != nil && done.UIDNext != 0 && done.UIDNext == mailbox.UidNext &&
+		done.UIDValidity == mailbox.UidValidity && done.Messages == mailbox.Messages
+}
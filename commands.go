@@ -0,0 +1,103 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// commands are invoked by their name as the first argument. Each command parses its own flags and returns the
+// exit code. Without a command, the flags of the single and batch mode apply.
+var commands = map[string]func(args []string) int{
+	"backfill": backfillCommand,
+	"config":   configCommand,
+	"daemon":   daemonCommand,
+	"fsck":     fsckCommand,
+	"import":   importCommand,
+	"probe":    probeCommand,
+	"search":   searchCommand,
+	"snapshot": snapshotCommand,
+	"verify":   verifyCommand,
+}
+
+// configCommand validates a configuration file: imaparc config check <file>
+func configCommand(args []string) int {
+	if len(args) != 2 || args[0] != "check" {
+		fmt.Println("usage: imaparc config check <file>")
+		return 2
+	}
+	cfg, err := LoadConfig(args[1])
+	if err != nil {
+		if errs, ok := err.(ConfigErrors); ok {
+			for _, e := range errs {
+				fmt.Println(e)
+			}
+			return 3
+		}
+		fmt.Println(err)
+		return 2
+	}
+	fmt.Printf("%s: ok, %d accounts\n", args[1], len(cfg.Accounts))
+	for _, acc := range cfg.Accounts {
+		fmt.Printf(" %s: %s@%s -> %s\n", acc.Name, acc.Login, acc.Server, cfg.configFor(acc).Dir)
+	}
+	if cfg.Storage != nil && cfg.Storage.Type == storageS3 {
+		fmt.Printf(" storage: s3 bucket %s/%s at %s\n", cfg.Storage.Bucket, cfg.Storage.Prefix, cfg.Storage.Endpoint)
+	}
+	if cfg.Notify != nil && cfg.Notify.SMTP != nil {
+		fmt.Printf(" notify: mail to %s via %s\n", strings.Join(cfg.Notify.SMTP.To, ", "), cfg.Notify.SMTP.Host)
+	}
+	if cfg.Notify != nil && cfg.Notify.Webhook != nil {
+		fmt.Printf(" notify: webhook %s\n", cfg.Notify.Webhook.URL)
+	}
+	for _, hook := range cfg.Hooks {
+		fmt.Printf(" hook: %s runs %s\n", hook.Event, strings.Join(hook.Command, " "))
+	}
+	if cfg.Search != nil {
+		fmt.Printf(" search: %s at %s:%d\n", cfg.Search.Dir, cfg.Search.Host, cfg.Search.Port)
+	}
+	return 0
+}
+
+// searchCommand starts the search server with the search section of a configuration file. Flags override the
+// configured values.
+func searchCommand(args []string) int {
+	flags := flag.NewFlagSet("search", flag.ExitOnError)
+	configFile := flags.String("configFile", "", "filename to a configuration in yaml, json or toml format")
+	dir := flags.String("dir", "", "directory to index")
+	host := flags.String("host", "", "the ip or hostname to bind the search http server")
+	port := flags.Int("port", 0, "the port to bind the search http server")
+	flags.Parse(args)
+
+	cfg := &SearchConfig{Host: "localhost", Port: 8080}
+	if len(*configFile) > 0 {
+		fileCfg := loadConfigOrExit(*configFile)
+		if fileCfg.Search != nil {
+			applySearchConfig(cfg, fileCfg.Search)
+		}
+	}
+	applySearchConfig(cfg, &SearchConfig{Dir: *dir, Host: *host, Port: *port})
+	if len(cfg.Dir) == 0 {
+		fmt.Println("no search directory configured")
+		return 2
+	}
+	handleSignals()
+	searchMode(cfg)
+	return 0
+}
+
+// applySearchConfig copies all set fields from src into dst.
+func applySearchConfig(dst, src *SearchConfig) {
+	if len(src.Dir) > 0 {
+		dst.Dir = src.Dir
+	}
+	if len(src.Host) > 0 {
+		dst.Host = src.Host
+	}
+	if src.Port > 0 {
+		dst.Port = src.Port
+	}
+	if src.Storage != nil {
+		dst.Storage = src.Storage
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// CompressionReport counts the bytes of the connections of an account, which used COMPRESS=DEFLATE (RFC 4978).
+// Received and Sent are the bytes of the imap protocol, the wire counters the bytes after compression.
+type CompressionReport struct {
+	Received     int64 `json:"received"`
+	ReceivedWire int64 `json:"receivedWire"`
+	Sent         int64 `json:"sent"`
+	SentWire     int64 `json:"sentWire"`
+}
+
+// Ratio returns the factor, by which the received data has been compressed.
+func (r *CompressionReport) Ratio() float64 {
+	if r.ReceivedWire == 0 {
+		return 1
+	}
+	return float64(r.Received) / float64(r.ReceivedWire)
+}
+
+func (r *CompressionReport) add(o *CompressionReport) {
+	r.Received += o.Received
+	r.ReceivedWire += o.ReceivedWire
+	r.Sent += o.Sent
+	r.SentWire += o.SentWire
+}
+
+// holdDialer dials the plain connection of the imap client and keeps it for compress.
+type holdDialer struct {
+	timeout time.Duration
+	conn    *holdConn
+}
+
+func (d *holdDialer) Dial(network, addr string) (net.Conn, error) {
+	conn, err := net.DialTimeout(network, addr, d.timeout)
+	if err != nil {
+		return nil, err
+	}
+	// the client only applies the timeout of a net.Dialer to the greeting, so it is done here
+	if err := conn.SetDeadline(time.Now().Add(d.timeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	d.conn = &holdConn{Conn: conn}
+	return d.conn, nil
+}
+
+// holdConn is the plain connection below TLS. The client only pauses its reader for the upgrades it starts itself
+// (STARTTLS), so holdConn can pause it for compress: the first data read after the next write waits until it is
+// released. The mutex orders the write, the read and the upgrade in between.
+type holdConn struct {
+	net.Conn
+	mutex   sync.Mutex
+	armed   bool
+	waiting bool
+	held    chan struct{}
+	resume  chan struct{}
+}
+
+// hold arms the connection. The returned channel is closed once the reader waits with the response to the next
+// command.
+func (c *holdConn) hold() <-chan struct{} {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.armed = true
+	c.held = make(chan struct{})
+	c.resume = make(chan struct{})
+	return c.held
+}
+
+// release lets the reader continue and disarms the connection.
+func (c *holdConn) release() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.armed, c.waiting = false, false
+	if c.resume != nil {
+		close(c.resume)
+		c.resume = nil
+	}
+}
+
+func (c *holdConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.mutex.Lock()
+	if c.armed {
+		c.armed, c.waiting = false, true
+	}
+	c.mutex.Unlock()
+	return n, err
+}
+
+func (c *holdConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.mutex.Lock()
+	hold := c.waiting && n > 0
+	held, resume := c.held, c.resume
+	if hold {
+		c.waiting = false
+	}
+	c.mutex.Unlock()
+	if hold {
+		close(held)
+		<-resume
+	}
+	return n, err
+}
+
+// compressConn is placed above the connection of the imap client before COMPRESS is sent. It passes everything
+// through until the tagged OK of COMPRESS has been read and deflates from there on. The wire counters are below
+// the deflate streams, the others above.
+type compressConn struct {
+	net.Conn
+	mutex    sync.Mutex // protects everything but the counters of received data
+	awaiting bool       // the response to COMPRESS
+	line     []byte     // the start of the current line of that response
+	reader   io.ReadCloser
+	writer   *flate.Writer
+	in       *countingReader
+	wire     *countingWriter
+	stats    CompressionReport
+}
+
+type countingReader struct {
+	r     io.Reader
+	count int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	atomic.AddInt64(&r.count, int64(n))
+	return n, err
+}
+
+type countingWriter struct {
+	w     io.Writer
+	count int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.count += int64(n)
+	return n, err
+}
+
+// await is called before COMPRESS is sent, the first tagged response is the one to COMPRESS.
+func (c *compressConn) await(awaiting bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.awaiting = awaiting
+	c.line = nil
+}
+
+func (c *compressConn) Read(p []byte) (int, error) {
+	if c.reader != nil {
+		n, err := c.reader.Read(p)
+		atomic.AddInt64(&c.stats.Received, int64(n))
+		return n, err
+	}
+	n, err := c.Conn.Read(p)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for i := 0; c.awaiting && i < n; i++ {
+		if p[i] != '\n' {
+			if len(c.line) < 64 {
+				c.line = append(c.line, p[i])
+			}
+			continue
+		}
+		line := string(c.line)
+		c.line = nil
+		if strings.HasPrefix(line, "* ") {
+			continue
+		}
+		c.awaiting = false
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !strings.EqualFold(fields[1], "OK") {
+			break
+		}
+		if err := c.enable(p[i+1 : n]); err != nil {
+			return i + 1, err
+		}
+		return i + 1, nil
+	}
+	return n, err
+}
+
+// enable starts deflating. rest has been read after the OK of COMPRESS.
+func (c *compressConn) enable(rest []byte) error {
+	c.in = &countingReader{r: io.MultiReader(bytes.NewReader(append([]byte(nil), rest...)), c.Conn)}
+	c.wire = &countingWriter{w: c.Conn}
+	w, err := flate.NewWriter(c.wire, flate.DefaultCompression)
+	if err != nil {
+		return err
+	}
+	c.writer = w
+	c.reader = flate.NewReader(c.in)
+	return nil
+}
+
+func (c *compressConn) Write(p []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.writer == nil {
+		return c.Conn.Write(p)
+	}
+	n, err := c.writer.Write(p)
+	if err != nil {
+		return n, err
+	}
+	// the server must see each command without waiting for more data
+	if err := c.writer.Flush(); err != nil {
+		return n, err
+	}
+	c.stats.Sent += int64(n)
+	return n, nil
+}
+
+// Stats returns the counters or nil, if compression has not been enabled.
+func (c *compressConn) Stats() *CompressionReport {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.writer == nil {
+		return nil
+	}
+	return &CompressionReport{
+		Received:     atomic.LoadInt64(&c.stats.Received),
+		ReceivedWire: atomic.LoadInt64(&c.in.count),
+		Sent:         c.stats.Sent,
+		SentWire:     c.wire.count,
+	}
+}
+
+type compressCmd struct{}
+
+func (compressCmd) Command() *imap.Command {
+	return &imap.Command{Name: "COMPRESS", Arguments: []interface{}{imap.RawString("DEFLATE")}}
+}
+
+// compress negotiates COMPRESS=DEFLATE, if the server advertises it.
+func (i *Imap) compress() error {
+	ok, err := i.client.Support("COMPRESS=DEFLATE")
+	if err != nil || !ok {
+		return err
+	}
+	if err := i.upgrade(); err != nil {
+		return fmt.Errorf("failed to upgrade connection: %w", err)
+	}
+	i.conn.await(true)
+	status, err := i.client.Execute(compressCmd{}, nil)
+	if err != nil {
+		i.conn.await(false)
+		return err
+	}
+	return status.Err()
+}
+
+// upgrade places a compressConn above the connection of the client. The reader of the client must not read while
+// its connection is replaced, so it is held with the response to a NOOP. The NOOP is written directly, the client
+// ignores the response to the unknown tag.
+func (i *Imap) upgrade() error {
+	held := i.raw.hold()
+	defer i.raw.release()
+	w := i.client.Writer()
+	cmd := &imap.Command{Tag: "upgrade", Name: "NOOP"}
+	if err := cmd.WriteTo(w); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	select {
+	case <-held:
+	case <-time.After(time.Minute):
+		return fmt.Errorf("no response to NOOP")
+	}
+	return i.client.Upgrade(func(conn net.Conn) (net.Conn, error) {
+		i.conn = &compressConn{Conn: conn}
+		return i.conn, nil
+	})
+}
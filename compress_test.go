@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// imapTestServer is an imap server with an INBOX of the given mails, which offers COMPRESS=DEFLATE.
+type imapTestServer struct {
+	port      int
+	tlsConfig *tls.Config
+	startTLS  bool // STARTTLS is offered instead of implicit TLS
+	mails     []string
+}
+
+func newIMAPTestServer(t *testing.T, startTLS bool, mails ...string) *imapTestServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	s := &imapTestServer{port: l.Addr().(*net.TCPAddr).Port, tlsConfig: testTLSConfig(t), startTLS: startTLS,
+		mails: mails}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *imapTestServer) serve(conn net.Conn) {
+	defer conn.Close()
+	if !s.startTLS {
+		conn = tls.Server(conn, s.tlsConfig)
+	}
+	r := bufio.NewReader(conn)
+	var w io.Writer = conn
+	var deflater *flate.Writer
+	reply := func(format string, args ...interface{}) {
+		fmt.Fprintf(w, format+"\r\n", args...)
+	}
+	fmt.Fprint(w, "* OK test server ready\r\n")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return
+		}
+		tag, cmd := fields[0], strings.ToUpper(fields[1])
+		if cmd == "UID" && len(fields) > 2 {
+			cmd = strings.ToUpper(fields[2])
+			fields = fields[1:]
+		}
+		switch cmd {
+		case "CAPABILITY":
+			caps := "IMAP4rev1 COMPRESS=DEFLATE"
+			if _, secure := conn.(*tls.Conn); !secure {
+				caps = "IMAP4rev1 STARTTLS"
+			}
+			reply("* CAPABILITY %s", caps)
+			reply("%s OK done", tag)
+		case "STARTTLS":
+			reply("%s OK begin tls", tag)
+			conn = tls.Server(conn, s.tlsConfig)
+			r = bufio.NewReader(conn)
+			w = conn
+			continue
+		case "COMPRESS":
+			reply("%s OK DEFLATE active", tag)
+			r = bufio.NewReader(flate.NewReader(r))
+			deflater, _ = flate.NewWriter(conn, flate.BestCompression)
+			w = deflater
+			continue
+		case "LOGIN", "NOOP":
+			reply("%s OK done", tag)
+		case "LIST":
+			reply(`* LIST () "/" INBOX`)
+			reply("%s OK done", tag)
+		case "SELECT", "EXAMINE":
+			reply("* %d EXISTS", len(s.mails))
+			reply("* OK [UIDVALIDITY 1] uids valid")
+			reply("%s OK [READ-ONLY] done", tag)
+		case "FETCH":
+			s.fetch(w, fields[2], strings.Join(fields[3:], " "))
+			reply("%s OK done", tag)
+		case "LOGOUT":
+			reply("* BYE logging out")
+			reply("%s OK done", tag)
+			if deflater != nil {
+				deflater.Flush()
+			}
+			return
+		default:
+			reply("%s BAD unknown command", tag)
+		}
+		if deflater != nil {
+			deflater.Flush()
+		}
+	}
+}
+
+// fetch writes the requested items of the mails. Sequence numbers and uids are the same.
+func (s *imapTestServer) fetch(w io.Writer, set, items string) {
+	from, to := set, set
+	if i := strings.Index(set, ":"); i > 0 {
+		from, to = set[:i], set[i+1:]
+	}
+	first, _ := strconv.Atoi(from)
+	last, _ := strconv.Atoi(to)
+	for seq := first; seq <= last && seq <= len(s.mails); seq++ {
+		mail := s.mails[seq-1]
+		header := mail[:strings.Index(mail, "\r\n\r\n")+4]
+		var res []string
+		for _, item := range strings.Fields(strings.Trim(items, "()")) {
+			switch strings.ToUpper(item) {
+			case "UID":
+				res = append(res, fmt.Sprint("UID ", seq))
+			case "RFC822.SIZE":
+				res = append(res, fmt.Sprint("RFC822.SIZE ", len(mail)))
+			case "INTERNALDATE":
+				res = append(res, `INTERNALDATE "01-Mar-2021 10:00:00 +0000"`)
+			case "ENVELOPE":
+				res = append(res, fmt.Sprintf(`ENVELOPE ("Mon, 1 Mar 2021 10:00:00 +0000" "mail %d" NIL NIL NIL NIL NIL NIL NIL "<%d@example.com>")`, seq, seq))
+			case "RFC822.HEADER":
+				res = append(res, fmt.Sprintf("RFC822.HEADER {%d}\r\n%s", len(header), header))
+			case "RFC822":
+				res = append(res, fmt.Sprintf("RFC822 {%d}\r\n%s", len(mail), mail))
+			case "BODY.PEEK[]":
+				res = append(res, fmt.Sprintf("BODY[] {%d}\r\n%s", len(mail), mail))
+			}
+		}
+		fmt.Fprintf(w, "* %d FETCH (%s)\r\n", seq, strings.Join(res, " "))
+	}
+}
+
+func TestCompression(t *testing.T) {
+	body := strings.Repeat("All work and no play makes Jack a dull boy.\r\n", 200)
+	mails := []string{"Subject: mail 1\r\n\r\n" + body, "Subject: mail 2\r\n\r\n" + body}
+	for _, startTLS := range []bool{false, true} {
+		srv := newIMAPTestServer(t, startTLS, mails...)
+		cfg := &Config{Account: Account{Name: "alice", Server: "127.0.0.1", Port: srv.port, Login: "alice",
+			Password: "secret", TLS: !startTLS, StartTLS: startTLS, InsecureSkipVerify: true}, Dir: t.TempDir()}
+		a := &App{cfg: cfg, storage: localStorage{}, report: &AccountReport{Name: "alice", Started: time.Now()}}
+
+		imap := &Imap{}
+		if err := imap.Login(cfg); err != nil {
+			t.Fatal(err)
+		}
+		status, err := imap.Status("INBOX")
+		if err != nil {
+			t.Fatal(err)
+		}
+		all, _, err := a.scanMailbox(imap, status, filepath.Join(cfg.Dir, "INBOX"), cfg.IncludesDate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(all) != 2 || all[1].msg.Envelope.Subject != "mail 2" {
+			t.Fatalf("unexpected header scan %v", all)
+		}
+		eml, err := imap.RawMail("INBOX", all[1].msg.Uid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(eml) != mails[1] {
+			t.Fatalf("unexpected body of %d bytes", len(eml))
+		}
+		a.logout(imap)
+
+		c := a.report.Compression
+		if c == nil || c.Received < int64(len(body)) || c.Ratio() < 2 {
+			t.Fatalf("starttls %t: expected compressed traffic, got %+v", startTLS, c)
+		}
+		var buf bytes.Buffer
+		(&RunReport{Accounts: []*AccountReport{a.report}}).writeSummary(&buf)
+		if want := fmt.Sprintf("ratio %.1f", c.Ratio()); !strings.Contains(buf.String(), want) {
+			t.Fatalf("expected %q in summary:\n%s", want, buf.String())
+		}
+	}
+}
@@ -1,20 +1,253 @@
 package main
 
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// dateLayout is used for the since and before dates of an account.
+const dateLayout = "2006-01-02"
+
+// The protocols of an account.
+const (
+	protocolIMAP = "imap"
+	protocolPOP3 = "pop3"
+)
+
 type Config struct {
 	Account
 	Dir string
+	// DryRun only computes and prints what would be archived, without writing anything.
+	DryRun bool
+	// Storage keeps the archived files. If nil, the local directories are used.
+	Storage Storage
+	// LockWait is how long to wait for another process to release the lock of Dir.
+	LockWait time.Duration
+	// Hooks are invoked on the events of an archive run.
+	Hooks []*Hook
 }
 
 type Account struct {
-	Name     string `json:"name"`
-	Server   string `json:"server"`
+	Name   string `json:"name"`
+	Server string `json:"server"`
+	// Protocol is either imap (the default) or pop3. POP3 only provides the INBOX.
+	Protocol string `json:"protocol"`
 	Port     int    `json:"port"`
 	Login    string `json:"login"`
 	Password string `json:"password"`
 	TLS      bool   `json:"tls"`
+	// StartTLS upgrades a plain connection using the STARTTLS command.
+	StartTLS bool `json:"starttls"`
+	// InsecureSkipVerify disables the certificate verification, e.g. for self signed certificates.
+	InsecureSkipVerify bool `json:"insecureSkipVerify"`
+	// NoCompress disables COMPRESS=DEFLATE, which is used if the server supports it.
+	NoCompress bool `json:"noCompress"`
+	// TLSServerName overrides the server name used to verify the certificate.
+	TLSServerName string `json:"tlsServerName"`
+	// TargetDir overrides the directory of the account. A relative path is resolved against the batch directory.
+	TargetDir string `json:"dir"`
+	// Include contains mailbox name patterns (see path.Match). If not empty, only matching mailboxes are archived.
+	Include []string `json:"include"`
+	// Exclude contains mailbox name patterns (see path.Match) which are never archived.
+	Exclude []string `json:"exclude"`
+	// Namespaces lists the namespaces archived in addition to the personal one: other for the mailboxes of other
+	// users shared with the account and shared for public folders.
+	Namespaces []string `json:"namespaces"`
+	// Since only archives mails received at or after the given date (yyyy-mm-dd).
+	Since string `json:"since"`
+	// Before only archives mails received before the given date (yyyy-mm-dd).
+	Before string `json:"before"`
+	// Concurrency is the number of parallel connections used to archive the mailboxes of the account.
+	Concurrency int `json:"concurrency"`
+	// Schedule defines when the daemon archives the account, either as cron expression or as "@every <duration>".
+	Schedule string `json:"schedule"`
+	// Template refers to an entry in the templates of the batch configuration.
+	Template string `json:"template"`
+}
+
+// Validate checks the account for obviously invalid settings.
+func (a *Account) Validate() error {
+	if len(a.Server) == 0 {
+		return fmt.Errorf("server is required")
+	}
+	if len(a.Protocol) > 0 && a.Protocol != protocolIMAP && a.Protocol != protocolPOP3 {
+		return fmt.Errorf("unknown protocol '%s', expected imap or pop3", a.Protocol)
+	}
+	if a.Port < 0 || a.Port > 65535 {
+		return fmt.Errorf("invalid port %d", a.Port)
+	}
+	if a.TLS && a.StartTLS {
+		return fmt.Errorf("tls and starttls are mutually exclusive")
+	}
+	if a.Concurrency < 0 {
+		return fmt.Errorf("invalid concurrency %d", a.Concurrency)
+	}
+	for _, pattern := range append(append([]string{}, a.Include...), a.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid mailbox pattern '%s': %w", pattern, err)
+		}
+	}
+	for _, kind := range a.Namespaces {
+		if !validNamespaceKind(kind) {
+			return fmt.Errorf("unknown namespace '%s', expected %s or %s", kind, namespaceOther, namespaceShared)
+		}
+	}
+	if _, _, err := a.DateRange(); err != nil {
+		return err
+	}
+	if len(a.Schedule) > 0 {
+		if _, err := ParseSchedule(a.Schedule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DateRange returns the parsed since and before dates. Unset dates are returned as zero times.
+func (a *Account) DateRange() (since, before time.Time, err error) {
+	if len(a.Since) > 0 {
+		since, err = time.ParseInLocation(dateLayout, a.Since, time.Local)
+		if err != nil {
+			return since, before, fmt.Errorf("invalid since date '%s': %w", a.Since, err)
+		}
+	}
+	if len(a.Before) > 0 {
+		before, err = time.ParseInLocation(dateLayout, a.Before, time.Local)
+		if err != nil {
+			return since, before, fmt.Errorf("invalid before date '%s': %w", a.Before, err)
+		}
+	}
+	return since, before, nil
+}
+
+// IncludesMailbox applies the include and exclude patterns to the given mailbox name.
+func (a *Account) IncludesMailbox(name string) bool {
+	for _, pattern := range a.Exclude {
+		if ok, _ := path.Match(pattern, name); ok {
+			return false
+		}
+	}
+	if len(a.Include) == 0 {
+		return true
+	}
+	for _, pattern := range a.Include {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// IncludesDate applies the since and before dates to the given date.
+func (a *Account) IncludesDate(date time.Time) bool {
+	since, before, _ := a.DateRange()
+	if !since.IsZero() && date.Before(since) {
+		return false
+	}
+	if !before.IsZero() && !date.Before(before) {
+		return false
+	}
+	return true
 }
 
+// AccountList is the batch configuration. Each account is resolved by applying the defaults first, then the
+// referenced template and finally the fields of the account itself, so that only fields which are present override
+// the previous ones.
 type AccountList struct {
 	Accounts []*Account `json:"accounts"`
 	Dir      string     `json:"dir"`
 }
+
+func (l *AccountList) UnmarshalJSON(b []byte) error {
+	var raw struct {
+		Accounts  []json.RawMessage          `json:"accounts"`
+		Dir       string                     `json:"dir"`
+		Defaults  json.RawMessage            `json:"defaults"`
+		Templates map[string]json.RawMessage `json:"templates"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	l.Dir = raw.Dir
+	l.Accounts = nil
+	for i, accRaw := range raw.Accounts {
+		var ref struct {
+			Template string `json:"template"`
+		}
+		if err := json.Unmarshal(accRaw, &ref); err != nil {
+			return fmt.Errorf("accounts[%d]: %w", i, err)
+		}
+
+		acc := &Account{}
+		if len(raw.Defaults) > 0 {
+			if err := json.Unmarshal(raw.Defaults, acc); err != nil {
+				return fmt.Errorf("defaults: %w", err)
+			}
+		}
+		if len(ref.Template) > 0 {
+			tpl, ok := raw.Templates[ref.Template]
+			if !ok {
+				return fmt.Errorf("accounts[%d]: unknown template '%s'", i, ref.Template)
+			}
+			if err := json.Unmarshal(tpl, acc); err != nil {
+				return fmt.Errorf("templates.%s: %w", ref.Template, err)
+			}
+		}
+		if err := json.Unmarshal(accRaw, acc); err != nil {
+			return fmt.Errorf("accounts[%d]: %w", i, err)
+		}
+		l.Accounts = append(l.Accounts, acc)
+	}
+	return nil
+}
+
+// Validate checks all accounts and ensures unique names and directories, because a directory may be inherited from
+// the defaults or a template.
+func (l *AccountList) Validate() error {
+	names := make(map[string]bool)
+	dirs := make(map[string]string)
+	for i := range l.Accounts {
+		if err := l.validateAccount(i, names, dirs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateAccount checks the account at index i. names collects the names of the accounts checked so far and dirs
+// their directories with the name of the account.
+func (l *AccountList) validateAccount(i int, names map[string]bool, dirs map[string]string) error {
+	acc := l.Accounts[i]
+	if len(acc.Name) == 0 {
+		return fmt.Errorf("accounts[%d]: name is required", i)
+	}
+	if names[acc.Name] {
+		return fmt.Errorf("accounts[%d]: duplicate name '%s'", i, acc.Name)
+	}
+	names[acc.Name] = true
+	dir := l.accountDir(acc)
+	if other, ok := dirs[dir]; ok {
+		return fmt.Errorf("accounts[%d]: directory '%s' is already used by account '%s'", i, dir, other)
+	}
+	dirs[dir] = acc.Name
+	if err := acc.Validate(); err != nil {
+		return fmt.Errorf("accounts[%d] (%s): %w", i, acc.Name, err)
+	}
+	return nil
+}
+
+// accountDir returns the directory of the given account. It defaults to the name of the account within the batch
+// directory, a relative directory of the account is resolved against the batch directory as well.
+func (l *AccountList) accountDir(acc *Account) string {
+	if len(acc.TargetDir) == 0 {
+		return filepath.Join(l.Dir, acc.Name)
+	}
+	if filepath.IsAbs(acc.TargetDir) {
+		return filepath.Clean(acc.TargetDir)
+	}
+	return filepath.Join(l.Dir, acc.TargetDir)
+}
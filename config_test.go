@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAccountListDuplicateDirs(t *testing.T) {
+	for content, want := range map[string]string{
+		`{"dir": "/srv", "defaults": {"dir": "shared"}, "accounts": [{"name": "a"}, {"name": "b"}]}`:                                             "accounts[1]: directory '/srv/shared' is already used by account 'a'",
+		`{"dir": "/srv", "templates": {"t": {"dir": "/mails/t"}}, "accounts": [{"name": "a", "template": "t"}, {"name": "b", "template": "t"}]}`: "accounts[1]: directory '/mails/t' is already used by account 'a'",
+		`{"dir": "/srv", "accounts": [{"name": "a"}, {"name": "b", "dir": "a"}]}`:                                                                "accounts[1]: directory '/srv/a' is already used by account 'a'",
+		`{"dir": "/srv", "defaults": {"dir": "shared"}, "accounts": [{"name": "a"}, {"name": "b", "dir": "b"}]}`:                                 "",
+	} {
+		list := &AccountList{}
+		if err := json.Unmarshal([]byte(content), list); err != nil {
+			t.Fatal(err)
+		}
+		for _, acc := range list.Accounts {
+			acc.Server, acc.Login = "imap.example.com", acc.Name
+		}
+		err := list.Validate()
+		if (want == "" && err != nil) || (want != "" && (err == nil || err.Error() != want)) {
+			t.Fatalf("%s: expected %q, got %v", content, want, err)
+		}
+	}
+
+	fname := filepath.Join(t.TempDir(), "config.yaml")
+	yaml := "dir: /srv\ndefaults:\n  server: imap.example.com\n  dir: shared\naccounts:\n  - name: a\n    login: a\n  - name: b\n    login: b\n"
+	if err := ioutil.WriteFile(fname, []byte(yaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(fname); err == nil || !strings.Contains(err.Error(), "config.yaml:8:5: accounts[1]: directory") {
+		t.Fatalf("expected the position of the second account, got %v", err)
+	}
+}
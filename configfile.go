@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FileConfig is a configuration file, covering the archive accounts, the storage, the search server and the
+// notifications. A file ending with .toml is parsed as TOML, any other as yaml, so existing json batch files are
+// valid configuration files as well.
+type FileConfig struct {
+	AccountList
+	Search  *SearchConfig
+	Storage *StorageConfig
+	Notify  *NotifyConfig
+	Hooks   []*Hook
+	storage Storage
+}
+
+// configSchema describes the structure of a configuration file. Field names are taken from the json tags.
+type configSchema struct {
+	Accounts  []Account          `json:"accounts"`
+	Dir       string             `json:"dir"`
+	Defaults  Account            `json:"defaults"`
+	Templates map[string]Account `json:"templates"`
+	Search    SearchConfig       `json:"search"`
+	Storage   StorageConfig      `json:"storage"`
+	Notify    NotifyConfig       `json:"notify"`
+	Hooks     []Hook             `json:"hooks"`
+}
+
+// ConfigErrors contains all problems found in a configuration file, each prefixed by file, line and column.
+type ConfigErrors []string
+
+func (e ConfigErrors) Error() string {
+	return strings.Join(e, "\n")
+}
+
+var envPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// LoadConfig reads, interpolates and validates the given configuration file. Values may refer to environment
+// variables using ${NAME} or ${NAME:-default}. All found problems are returned as ConfigErrors.
+func LoadConfig(fname string) (*FileConfig, error) {
+	b, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read config: %w", err)
+	}
+
+	doc := &yaml.Node{}
+	if strings.EqualFold(filepath.Ext(fname), ".toml") {
+		if doc, err = parseTOML(b); err != nil {
+			return nil, ConfigErrors{fmt.Sprintf("%s:%v", fname, err)}
+		}
+	} else if err := yaml.Unmarshal(b, doc); err != nil {
+		return nil, ConfigErrors{fmt.Sprintf("%s: %v", fname, err)}
+	}
+	if doc.Kind == 0 {
+		return nil, ConfigErrors{fmt.Sprintf("%s: empty configuration", fname)}
+	}
+
+	var errs ConfigErrors
+	errorf := func(node *yaml.Node, format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf("%s:%d:%d: %s", fname, node.Line, node.Column, fmt.Sprintf(format, args...)))
+	}
+
+	interpolate(doc, errorf)
+	checkNode(doc.Content[0], reflect.TypeOf(configSchema{}), "", errorf)
+	checkTemplates(doc.Content[0], errorf)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	// the yaml tree has been normalized to match the schema, so the json decoding applies defaults and templates
+	var generic interface{}
+	if err := doc.Decode(&generic); err != nil {
+		return nil, ConfigErrors{fmt.Sprintf("%s: %v", fname, err)}
+	}
+	js, err := json.Marshal(generic)
+	if err != nil {
+		return nil, ConfigErrors{fmt.Sprintf("%s: %v", fname, err)}
+	}
+	cfg := &FileConfig{}
+	if err := json.Unmarshal(js, &cfg.AccountList); err != nil {
+		return nil, ConfigErrors{fmt.Sprintf("%s: %v", fname, err)}
+	}
+	var sections struct {
+		Search  *SearchConfig  `json:"search"`
+		Storage *StorageConfig `json:"storage"`
+		Notify  *NotifyConfig  `json:"notify"`
+		Hooks   []*Hook        `json:"hooks"`
+	}
+	if err := json.Unmarshal(js, &sections); err != nil {
+		return nil, ConfigErrors{fmt.Sprintf("%s: %v", fname, err)}
+	}
+	cfg.Search = sections.Search
+	cfg.Storage = sections.Storage
+	cfg.Notify = sections.Notify
+	cfg.Hooks = sections.Hooks
+
+	accountNodes := valueOf(doc.Content[0], "accounts")
+	names := make(map[string]bool)
+	dirs := make(map[string]string)
+	for i := range cfg.Accounts {
+		if err := cfg.validateAccount(i, names, dirs); err != nil {
+			node := doc.Content[0]
+			if accountNodes != nil && i < len(accountNodes.Content) {
+				node = accountNodes.Content[i]
+			}
+			errorf(node, "%v", err)
+		}
+	}
+	if cfg.Search != nil && (cfg.Search.Port < 0 || cfg.Search.Port > 65535) {
+		errorf(valueOf(doc.Content[0], "search"), "search: invalid port %d", cfg.Search.Port)
+	}
+	if cfg.Storage != nil {
+		if err := cfg.Storage.Validate(); err != nil {
+			errorf(valueOf(doc.Content[0], "storage"), "storage: %v", err)
+		}
+	}
+	if cfg.Notify != nil {
+		if err := cfg.Notify.Validate(); err != nil {
+			errorf(valueOf(doc.Content[0], "notify"), "notify: %v", err)
+		}
+	}
+	hookNodes := valueOf(doc.Content[0], "hooks")
+	for i, hook := range cfg.Hooks {
+		if err := hook.Validate(); err != nil {
+			node := doc.Content[0]
+			if hookNodes != nil && i < len(hookNodes.Content) {
+				node = hookNodes.Content[i]
+			}
+			errorf(node, "hook: %v", err)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	if cfg.Dir == "." {
+		cfg.Dir = filepath.Dir(fname)
+	}
+	if cfg.Search != nil && cfg.Search.Dir == "." {
+		cfg.Search.Dir = filepath.Dir(fname)
+	}
+	cfg.storage = cfg.Storage.open(cfg.Dir)
+	if cfg.Search != nil {
+		cfg.Search.Storage = cfg.storage
+	}
+	return cfg, nil
+}
+
+// checkTemplates ensures that each account refers to an existing template.
+func checkTemplates(root *yaml.Node, errorf func(node *yaml.Node, format string, args ...interface{})) {
+	accounts := valueOf(root, "accounts")
+	if accounts == nil || accounts.Kind != yaml.SequenceNode {
+		return
+	}
+	templates := valueOf(root, "templates")
+	for i, acc := range accounts.Content {
+		tpl := valueOf(acc, "template")
+		if tpl == nil || tpl.Kind != yaml.ScalarNode || len(tpl.Value) == 0 {
+			continue
+		}
+		if valueOf(templates, tpl.Value) == nil {
+			errorf(tpl, "accounts[%d].template: unknown template '%s'", i, tpl.Value)
+		}
+	}
+}
+
+// configFor creates the configuration to archive the given account. The account directory defaults to its name
+// within the configured directory.
+func (c *FileConfig) configFor(acc *Account) *Config {
+	return &Config{Account: *acc, Dir: c.accountDir(acc), Storage: c.storage, Hooks: c.Hooks}
+}
+
+// valueOf returns the value node of the given key in a mapping node or nil.
+func valueOf(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// interpolate replaces environment variable references in all scalar values. Plain scalars are resolved again
+// afterwards, so that e.g. port: ${PORT} becomes an integer.
+func interpolate(node *yaml.Node, errorf func(node *yaml.Node, format string, args ...interface{})) {
+	if node.Kind == yaml.ScalarNode {
+		if !strings.Contains(node.Value, "${") {
+			return
+		}
+		node.Value = envPattern.ReplaceAllStringFunc(node.Value, func(ref string) string {
+			m := envPattern.FindStringSubmatch(ref)
+			if val, ok := os.LookupEnv(m[1]); ok {
+				return val
+			}
+			if len(m[2]) > 0 {
+				return m[3]
+			}
+			errorf(node, "environment variable %s is not set", m[1])
+			return ""
+		})
+		if node.Style == 0 {
+			node.Tag = ""
+		}
+		return
+	}
+	for _, child := range node.Content {
+		interpolate(child, errorf)
+	}
+}
+
+// checkNode validates the node against the given type and normalizes scalars, which are declared as strings but
+// have been resolved to another yaml type, e.g. dates.
+func checkNode(node *yaml.Node, t reflect.Type, path string, errorf func(node *yaml.Node, format string, args ...interface{})) {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if node.Kind == yaml.ScalarNode && node.ShortTag() == "!!null" {
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			errorf(node, "%s: expected a mapping", displayPath(path))
+			return
+		}
+		fields := make(map[string]reflect.StructField)
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := strings.Split(f.Tag.Get("json"), ",")[0]
+			if len(name) > 0 && name != "-" {
+				fields[name] = f
+			}
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, val := node.Content[i], node.Content[i+1]
+			if key.Value == "<<" {
+				// a yaml merge key, its mappings must match the same structure
+				if val.Kind == yaml.SequenceNode {
+					for _, merged := range val.Content {
+						checkNode(merged, t, path, errorf)
+					}
+				} else {
+					checkNode(val, t, path, errorf)
+				}
+				continue
+			}
+			f, ok := fields[key.Value]
+			if !ok {
+				errorf(key, "%s: unknown field '%s'", displayPath(path), key.Value)
+				continue
+			}
+			checkNode(val, f.Type, joinPath(path, key.Value), errorf)
+		}
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			errorf(node, "%s: expected a mapping", displayPath(path))
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			checkNode(node.Content[i+1], t.Elem(), joinPath(path, node.Content[i].Value), errorf)
+		}
+	case reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			errorf(node, "%s: expected a list", displayPath(path))
+			return
+		}
+		for i, child := range node.Content {
+			checkNode(child, t.Elem(), fmt.Sprintf("%s[%d]", path, i), errorf)
+		}
+	case reflect.String:
+		if node.Kind != yaml.ScalarNode {
+			errorf(node, "%s: expected a string", displayPath(path))
+			return
+		}
+		node.Tag = "!!str"
+	case reflect.Int:
+		if node.Kind != yaml.ScalarNode || node.ShortTag() != "!!int" {
+			errorf(node, "%s: expected an integer but got '%s'", displayPath(path), node.Value)
+		}
+	case reflect.Bool:
+		if node.Kind != yaml.ScalarNode || node.ShortTag() != "!!bool" {
+			errorf(node, "%s: expected true or false but got '%s'", displayPath(path), node.Value)
+		}
+	default:
+		errorf(node, "%s: unsupported type %s", displayPath(path), t)
+	}
+}
+
+func joinPath(path, key string) string {
+	if len(path) == 0 {
+		return key
+	}
+	return path + "." + key
+}
+
+func displayPath(path string) string {
+	if len(path) == 0 {
+		return "configuration"
+	}
+	return path
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Scheduler archives each account of a configuration according to its schedule. A run of an account is never
+// started while its previous run is still active.
+type Scheduler struct {
+	jobs []*job
+	// AfterRun is invoked after each finished run, if not nil.
+	AfterRun func(report *AccountReport)
+	active   sync.WaitGroup
+}
+
+type job struct {
+	cfg      *Config
+	schedule Schedule
+	mutex    sync.Mutex
+	running  bool
+	next     time.Time
+}
+
+// NewScheduler creates a job for each account with a schedule. Accounts without schedule are ignored.
+func NewScheduler(fileCfg *FileConfig) (*Scheduler, error) {
+	s := &Scheduler{}
+	now := time.Now()
+	for _, acc := range fileCfg.Accounts {
+		if len(acc.Schedule) == 0 {
+			logger.Warn("account has no schedule, ignoring", "account", acc.Name)
+			continue
+		}
+		schedule, err := ParseSchedule(acc.Schedule)
+		if err != nil {
+			return nil, err
+		}
+		j := &job{cfg: fileCfg.configFor(acc), schedule: schedule}
+		status, err := loadStatus(j.cfg.Dir)
+		if err != nil {
+			logger.Warn("cannot load account status", "account", acc.Name, "err", err)
+		}
+		j.next = schedule.Next(now, status.LastRun)
+		logger.Info("scheduled account", "account", acc.Name, "schedule", acc.Schedule, "next", j.next.Format(time.RFC3339))
+		s.jobs = append(s.jobs, j)
+	}
+	return s, nil
+}
+
+// Run blocks and starts the jobs when they are due, until stop is closed. Afterwards, it waits for active runs.
+func (s *Scheduler) Run(stop <-chan struct{}) {
+	if len(s.jobs) == 0 {
+		logger.Warn("no scheduled accounts")
+	}
+	for {
+		var earliest time.Time
+		for _, j := range s.jobs {
+			if !j.next.IsZero() && (earliest.IsZero() || j.next.Before(earliest)) {
+				earliest = j.next
+			}
+		}
+		wait := time.Hour
+		if !earliest.IsZero() {
+			wait = time.Until(earliest)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-stop:
+			timer.Stop()
+			// runs observe the shutdown themselves and stop after their current mail
+			s.active.Wait()
+			return
+		case <-timer.C:
+		}
+
+		now := time.Now()
+		for _, j := range s.jobs {
+			if j.next.IsZero() || j.next.After(now) {
+				continue
+			}
+			j.next = j.schedule.Next(now, now)
+			logger.Debug("next scheduled run", "account", j.cfg.Name, "next", j.next.Format(time.RFC3339))
+			s.active.Add(1)
+			go s.run(j)
+		}
+	}
+}
+
+func (s *Scheduler) run(j *job) {
+	defer s.active.Done()
+	j.mutex.Lock()
+	if j.running {
+		j.mutex.Unlock()
+		logger.Warn("previous run still active, skipping", "account", j.cfg.Name)
+		return
+	}
+	j.running = true
+	j.mutex.Unlock()
+	defer func() {
+		j.mutex.Lock()
+		j.running = false
+		j.mutex.Unlock()
+	}()
+
+	logger.Info("starting scheduled run", "account", j.cfg.Name)
+	app := &App{}
+	err := app.Archive(j.cfg)
+	report := app.Report()
+	if err != nil {
+		logger.Error("scheduled run failed", "account", j.cfg.Name, "err", err)
+	} else {
+		logger.Info("scheduled run completed", "account", j.cfg.Name, "new", report.New, "skipped", report.Skipped,
+			"failed", report.Failed, "bytes", report.Bytes, "duration", report.DurationSeconds)
+	}
+	if s.AfterRun != nil {
+		s.AfterRun(report)
+	}
+}
+
+// daemonCommand runs the scheduler and, if configured, the search server within a single process.
+func daemonCommand(args []string) int {
+	flags := flag.NewFlagSet("daemon", flag.ExitOnError)
+	configFile := flags.String("configFile", "", "filename to a configuration in yaml, json or toml format")
+	metricsAddr := flags.String("metricsAddr", "", "host:port to serve /metrics, if no search server is configured")
+	noSearch := flags.Bool("noSearch", false, "do not start the configured search server")
+	flags.Parse(args)
+
+	if len(*configFile) == 0 {
+		logger.Error("missing -configFile")
+		return 2
+	}
+	fileCfg := loadConfigOrExit(*configFile)
+	handleSignals()
+	scheduler, err := NewScheduler(fileCfg)
+	if err != nil {
+		logger.Error("cannot create scheduler", "err", err)
+		return 3
+	}
+
+	// notify about each run and index its new mails
+	var search *Search
+	scheduler.AfterRun = func(report *AccountReport) {
+		if search != nil && report.New > 0 {
+			search.Refresh()
+		}
+		fileCfg.Notify.Notify(&RunReport{Started: report.Started, Finished: report.Finished,
+			DurationSeconds: report.DurationSeconds, Accounts: []*AccountReport{report}})
+	}
+
+	if fileCfg.Search != nil && len(fileCfg.Search.Dir) > 0 && !*noSearch {
+		searchCfg := &SearchConfig{Host: "localhost", Port: 8080}
+		applySearchConfig(searchCfg, fileCfg.Search)
+		search, err = NewSearch(searchCfg)
+		if err != nil {
+			logger.Error("failed to init search", "err", err)
+			return 5
+		}
+		stopped := make(chan struct{})
+		go func() {
+			NewServer(search).Start(searchCfg.Host, searchCfg.Port)
+			close(stopped)
+		}()
+		defer func() {
+			<-stopped
+			if err := search.Close(); err != nil {
+				logger.Error("failed to close search index", "err", err)
+			}
+		}()
+	} else if len(*metricsAddr) > 0 {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", metrics)
+			logger.Info("serving metrics", "addr", *metricsAddr)
+			if err := http.ListenAndServe(*metricsAddr, mux); err != nil {
+				logger.Error("cannot serve metrics", "addr", *metricsAddr, "err", err)
+			}
+		}()
+	}
+
+	scheduler.Run(interrupted)
+	logger.Info("daemon stopped")
+	return 0
+}
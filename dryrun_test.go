@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestDryRun plans an archive run, of which one mail is archived already, and checks that nothing is written.
+func TestDryRun(t *testing.T) {
+	mails := []string{"Subject: mail 1\r\n\r\nbody\r\n", "Subject: mail 2\r\n\r\nlonger body\r\n"}
+	srv := newIMAPTestServer(t, false, mails...)
+	for _, archived := range []bool{false, true} {
+		dir := filepath.Join(t.TempDir(), "alice")
+		cfg := &Config{Account: Account{Name: "alice", Server: "127.0.0.1", Port: srv.port, Login: "alice",
+			Password: "secret", TLS: true, InsecureSkipVerify: true}, Dir: dir, DryRun: true}
+		if archived {
+			sum := sha256.Sum224(headerOf([]byte(mails[0])))
+			hash := hex.EncodeToString(sum[:])
+			inbox := filepath.Join(dir, "INBOX")
+			if err := (localStorage{}).WriteFile(filepath.Join(inbox, hash+".eml"), []byte(mails[0]), time.Time{}); err != nil {
+				t.Fatal(err)
+			}
+			meta := &MailboxMeta{Name: "INBOX", Delimiter: "/", Messages: map[string]*MessageMeta{
+				hash: {Size: uint32(len(mails[0]))}}}
+			if err := writeStoredMeta(localStorage{}, inbox, meta); err != nil {
+				t.Fatal(err)
+			}
+		}
+		before := listFiles(t, dir)
+
+		a := &App{}
+		if err := a.Archive(cfg); err != nil {
+			t.Fatal(err)
+		}
+		expected := []*MailboxReport{{Name: "INBOX", Total: 2, New: 2, Bytes: int64(len(mails[0]) + len(mails[1]))}}
+		if archived {
+			expected = []*MailboxReport{{Name: "INBOX", Total: 2, New: 1, Skipped: 1, Bytes: int64(len(mails[1]))}}
+		}
+		if !reflect.DeepEqual(a.Report().Mailboxes, expected) {
+			t.Errorf("archived %t: expected plan %+v, got %+v", archived, expected[0], a.Report().Mailboxes)
+		}
+		if len(a.plans) != 1 || a.plans[0].DirMissing == archived {
+			t.Errorf("archived %t: unexpected plans %+v", archived, a.plans)
+		}
+		if after := listFiles(t, dir); !reflect.DeepEqual(before, after) {
+			t.Errorf("archived %t: expected the files %v to be kept, got %v", archived, before, after)
+		}
+	}
+}
+
+// listFiles returns all files below dir, which does not need to exist.
+func listFiles(t *testing.T, dir string) []string {
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		files = append(files, path)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/jhillyerd/enmime"
+)
+
+// FsckProblem is a single inconsistency found in an archive.
+type FsckProblem struct {
+	Kind   string `json:"kind"`
+	Path   string `json:"path"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// FsckReport is the result of checking an archive directory offline.
+type FsckReport struct {
+	Dir       string          `json:"dir"`
+	Index     string          `json:"index,omitempty"`
+	Checked   time.Time       `json:"checked"`
+	Mailboxes int             `json:"mailboxes"`
+	Mails     int             `json:"mails"`
+	Indexed   int             `json:"indexed"`
+	Problems  []*FsckProblem  `json:"problems,omitempty"`
+	mails     map[string]bool // ids of all archived mails, as used by the search index
+	storage   Storage
+}
+
+func (r *FsckReport) problem(kind, path, format string, args ...interface{}) {
+	r.Problems = append(r.Problems, &FsckProblem{Kind: kind, Path: path, Detail: fmt.Sprintf(format, args...)})
+}
+
+// Fsck checks all mailbox directories below dir in the given storage without connecting to a server. Each mail
+// must parse, its file name must match its header hash and its size must match the meta. The metas must be valid
+// and complete and there must be no stray files. If index is not empty, the search index at that path is
+// cross-checked for missing or dangling documents.
+func Fsck(storage Storage, dir, index string) (*FsckReport, error) {
+	r := &FsckReport{Dir: dir, Index: index, Checked: time.Now(), mails: make(map[string]bool), storage: storageOf(storage)}
+	// the storage has files only, so the directories are those containing files
+	dirs := make(map[string][]string)
+	err := r.storage.Walk(dir, func(name string) error {
+		rel, err := filepath.Rel(dir, filepath.Dir(name))
+		if err != nil {
+			return err
+		}
+		for _, level := range strings.Split(filepath.ToSlash(rel), "/") {
+			if level != "." && (strings.HasPrefix(level, ".") || level == "index.bleve") {
+				return nil
+			}
+		}
+		dirs[filepath.Dir(name)] = append(dirs[filepath.Dir(name)], filepath.Base(name))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot check archive: %w", err)
+	}
+	var sorted []string
+	for d := range dirs {
+		sorted = append(sorted, d)
+	}
+	sort.Strings(sorted)
+	for _, d := range sorted {
+		sort.Strings(dirs[d])
+		r.checkDir(d, dirs[d])
+	}
+	if len(index) > 0 {
+		if err := r.checkIndex(index); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// checkDir checks the files of a single directory. Directories without mails and meta are only parents of
+// nested mailboxes.
+func (r *FsckReport) checkDir(dir string, files []string) {
+	var meta *MailboxMeta
+	hasMeta := false
+	for _, f := range files {
+		if f == metaFile {
+			hasMeta = true
+		}
+	}
+	if hasMeta {
+		r.Mailboxes++
+		meta = r.checkMeta(dir)
+	}
+
+	found := make(map[string]bool)
+	for _, f := range files {
+		path := filepath.Join(dir, f)
+		switch {
+		case f == metaFile:
+		case f == snapshotFile:
+			if _, err := readSnapshots(r.storage, dir); err != nil {
+				r.problem("snapshots", path, "%v", err)
+			}
+		case strings.HasSuffix(f, ".eml"):
+			if !hasMeta {
+				r.problem("meta", path, "mail outside of a mailbox directory, missing %s", metaFile)
+			}
+			hash := strings.TrimSuffix(f, ".eml")
+			found[hash] = true
+			r.Mails++
+			r.mails[f] = true
+			var expected *MessageMeta
+			if meta != nil {
+				expected = meta.Messages[hash]
+			}
+			r.checkMail(path, hash, expected)
+		case strings.Contains(f, ".tmp"):
+			r.problem("stray", path, "left over temporary file")
+		case hasMeta:
+			r.problem("stray", path, "unknown file in mailbox directory")
+		}
+	}
+
+	if meta != nil {
+		for hash := range meta.Messages {
+			if !found[hash] {
+				r.problem("missing", filepath.Join(dir, hash+".eml"), "recorded in %s but not archived", metaFile)
+			}
+		}
+	}
+}
+
+// checkMeta validates the mailbox.json of dir and returns it, if it is readable.
+func (r *FsckReport) checkMeta(dir string) *MailboxMeta {
+	path := filepath.Join(dir, metaFile)
+	meta, err := readStoredMeta(r.storage, dir)
+	if err != nil {
+		r.problem("meta", path, "%v", err)
+		return nil
+	}
+	if len(meta.Name) == 0 {
+		r.problem("meta", path, "missing mailbox name")
+		return meta
+	}
+	expected := meta.Namespace.mailboxPath(meta.Name, meta.Delimiter)
+	if !strings.HasSuffix(filepath.ToSlash(dir), "/"+filepath.ToSlash(expected)) {
+		r.problem("meta", path, "directory does not match mailbox '%s', expected %s", meta.Name, expected)
+	}
+	for hash := range meta.Messages {
+		if len(hash) != sha256.Size224*2 {
+			r.problem("meta", path, "invalid message hash '%s'", hash)
+		}
+	}
+	return meta
+}
+
+// checkMail verifies a single archived mail.
+func (r *FsckReport) checkMail(path, hash string, expected *MessageMeta) {
+	b, err := r.storage.ReadFile(path)
+	if err != nil {
+		r.problem("unreadable", path, "%v", err)
+		return
+	}
+	if len(b) == 0 {
+		r.problem("empty", path, "zero bytes")
+		return
+	}
+	if expected != nil && expected.Size > 0 && len(b) < int(expected.Size) {
+		r.problem("truncated", path, "%d of %d bytes", len(b), expected.Size)
+	}
+
+	end := bytes.Index(b, []byte("\r\n\r\n"))
+	if end < 0 {
+		r.problem("truncated", path, "no end of header found")
+	} else {
+		sum := sha256.Sum224(b[:end+4])
+		if actual := hex.EncodeToString(sum[:]); actual != hash {
+			r.problem("hash", path, "header hash is %s", actual)
+		}
+	}
+
+	email, err := enmime.ReadEnvelope(bytes.NewReader(b))
+	if err != nil {
+		r.problem("parse", path, "%v", err)
+		return
+	}
+	for _, e := range email.Errors {
+		if e.Severe {
+			r.problem("parse", path, "%v", e)
+		}
+	}
+}
+
+// checkIndex compares the documents of the search index with the archived mails. Documents are identified by
+// the file name of the mail.
+func (r *FsckReport) checkIndex(path string) error {
+	type opened struct {
+		index bleve.Index
+		err   error
+	}
+	// the index is locked while a search server is running, which would block forever
+	res := make(chan opened, 1)
+	go func() {
+		index, err := bleve.OpenUsing(path, map[string]interface{}{"read_only": true})
+		res <- opened{index, err}
+	}()
+	var index bleve.Index
+	select {
+	case o := <-res:
+		if o.err != nil {
+			return fmt.Errorf("cannot open index %s: %w", path, o.err)
+		}
+		index = o.index
+	case <-time.After(5 * time.Second):
+		// the open continues until the search server releases the index, which must be closed again then
+		go func() {
+			if o := <-res; o.err == nil {
+				o.index.Close()
+			}
+		}()
+		return fmt.Errorf("cannot open index %s: in use by a search server", path)
+	}
+	defer index.Close()
+
+	indexed := make(map[string]bool)
+	const pageSize = 1000
+	for from := 0; ; from += pageSize {
+		req := bleve.NewSearchRequestOptions(bleve.NewMatchAllQuery(), pageSize, from, false)
+		req.Fields = []string{"File"}
+		hits, err := index.Search(req)
+		if err != nil {
+			return fmt.Errorf("cannot read index %s: %w", path, err)
+		}
+		for _, hit := range hits.Hits {
+			indexed[hit.ID] = true
+			file, _ := hit.Fields["File"].(string)
+			if exists, err := r.storage.Exists(file); err != nil {
+				r.problem("unreadable", file, "%v", err)
+			} else if !exists {
+				r.problem("dangling", file, "indexed as %s but the file does not exist", hit.ID)
+			}
+		}
+		if len(hits.Hits) < pageSize {
+			break
+		}
+	}
+	r.Indexed = len(indexed)
+	for id := range r.mails {
+		if !indexed[id] {
+			r.problem("unindexed", id, "archived but not in the search index")
+		}
+	}
+	return nil
+}
+
+// fsckCommand checks an archive offline:
+// imaparc fsck -dir <archive> [-configFile file] [-searchDir dir|-index path] [-report file]
+func fsckCommand(args []string) int {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	dir := flags.String("dir", "", "the archive directory to check")
+	searchDir := flags.String("searchDir", "", "cross-check the search index of this search directory")
+	indexPath := flags.String("index", "", "cross-check the search index at this path")
+	report := flags.String("report", "", "filename to write the result as json")
+	configFile := flags.String("configFile", "", "filename to a configuration, which selects the storage")
+	flags.Parse(args)
+
+	if len(*dir) == 0 {
+		fmt.Println("usage: imaparc fsck -dir <archive> [-configFile file] [-searchDir dir|-index path] [-report file]")
+		return 2
+	}
+	if len(*searchDir) > 0 && len(*indexPath) == 0 {
+		*indexPath = filepath.Join(*searchDir, "index.bleve")
+	}
+
+	var storage Storage = localStorage{}
+	if len(*configFile) > 0 {
+		storage = loadConfigOrExit(*configFile).storage
+	}
+	r, err := Fsck(storage, *dir, *indexPath)
+	if err != nil {
+		logger.Error("fsck failed", "dir", *dir, "err", err)
+		return 1
+	}
+	for _, p := range r.Problems {
+		if logger.JSON() {
+			logger.Warn("problem", "kind", p.Kind, "path", p.Path, "detail", p.Detail)
+		} else {
+			fmt.Printf("%s: %s: %s\n", p.Kind, p.Path, p.Detail)
+		}
+	}
+	if len(*report) > 0 {
+		b, err := json.MarshalIndent(r, "", " ")
+		if err == nil {
+			err = ioutil.WriteFile(*report, b, os.ModePerm)
+		}
+		if err != nil {
+			logger.Error("cannot write fsck report", "file", *report, "err", err)
+			return 2
+		}
+	}
+	logger.Info("fsck completed", "dir", *dir, "mailboxes", r.Mailboxes, "mails", r.Mails, "indexed", r.Indexed,
+		"problems", len(r.Problems))
+	if len(r.Problems) > 0 {
+		return 7
+	}
+	return 0
+}
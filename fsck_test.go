@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve"
+)
+
+// TestFsck checks a small archive with one problem of each kind in the local directories and in a bucket.
+func TestFsck(t *testing.T) {
+	_, s3 := newS3TestServer(t)
+	for _, storage := range []Storage{localStorage{}, s3} {
+		dir := filepath.Join(t.TempDir(), "alice")
+		if storage == s3 {
+			dir = "/mails/alice"
+		}
+		inbox := filepath.Join(dir, "INBOX")
+		hashOf := func(eml string) string {
+			sum := sha256.Sum224(headerOf([]byte(eml)))
+			return hex.EncodeToString(sum[:])
+		}
+		write := func(name, content string) {
+			if err := storage.WriteFile(filepath.Join(inbox, name), []byte(content), time.Time{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		good := "Subject: good\r\n\r\nbody\r\n"
+		truncated := "Subject: truncated\r\n\r\nbo"
+		// a mail, whose name is not the hash of its header
+		renamed := "Subject: renamed\r\n\r\nbody\r\n"
+		renamedHash := hashOf("Subject: other\r\n\r\n")
+		missing := hashOf("Subject: missing\r\n\r\n")
+		write(hashOf(good)+".eml", good)
+		write(hashOf(truncated)+".eml", truncated)
+		write(renamedHash+".eml", renamed)
+		write("notes.txt", "stray")
+		meta := &MailboxMeta{Name: "INBOX", Messages: map[string]*MessageMeta{
+			hashOf(good):      {Size: uint32(len(good))},
+			hashOf(truncated): {Size: uint32(len(truncated) + 4)},
+			missing:           {Size: 10},
+		}}
+		if err := writeStoredMeta(storage, inbox, meta); err != nil {
+			t.Fatal(err)
+		}
+
+		// the index knows the good mail and a mail, which has been deleted since
+		indexPath := filepath.Join(t.TempDir(), "index.bleve")
+		index, err := bleve.New(indexPath, bleve.NewIndexMapping())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, file := range []string{hashOf(good) + ".eml", "deleted.eml"} {
+			if err := index.Index(file, &IndexModel{Id: file, File: filepath.Join(inbox, file)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		index.Close()
+
+		r, err := Fsck(storage, dir, indexPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var problems []string
+		for _, p := range r.Problems {
+			problems = append(problems, p.Kind+" "+strings.TrimPrefix(filepath.ToSlash(p.Path), filepath.ToSlash(inbox)+"/"))
+		}
+		sort.Strings(problems)
+		expected := []string{
+			"dangling deleted.eml",
+			"hash " + renamedHash + ".eml",
+			"missing " + missing + ".eml",
+			"stray notes.txt",
+			"truncated " + hashOf(truncated) + ".eml",
+			"unindexed " + renamedHash + ".eml",
+			"unindexed " + hashOf(truncated) + ".eml",
+		}
+		sort.Strings(expected)
+		if strings.Join(problems, "\n") != strings.Join(expected, "\n") {
+			t.Errorf("%T: expected problems\n%s\ngot\n%s", storage, strings.Join(expected, "\n"), strings.Join(problems, "\n"))
+		}
+		if r.Mailboxes != 1 || r.Mails != 3 || r.Indexed != 2 {
+			t.Errorf("%T: unexpected counts %+v", storage, r)
+		}
+	}
+}
@@ -25,4 +25,6 @@ require (
 	github.com/syndtr/goleveldb v1.0.0 // indirect
 	github.com/tecbot/gorocksdb v0.0.0-20191217155057-f0fad39f321c // indirect
 	go.etcd.io/bbolt v1.3.4 // indirect
+	golang.org/x/text v0.3.2
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The events, on which hooks are invoked.
+const (
+	hookMailSaved        = "mailSaved"
+	hookMailFailed       = "mailFailed"
+	hookMailboxCompleted = "mailboxCompleted"
+	hookRunFinished      = "runFinished"
+)
+
+const defaultHookTimeout = time.Minute
+
+// Hook is an external command, which is invoked on an event of an archive run. The event is passed as json on
+// stdin and as IMAPARC_* environment variables.
+type Hook struct {
+	// Event is one of mailSaved, mailFailed, mailboxCompleted or runFinished.
+	Event string `json:"event"`
+	// Command is the program and its arguments. It is not interpreted by a shell.
+	Command []string `json:"command"`
+	// Timeout limits the runtime of the command, e.g. 30s. The default is one minute.
+	Timeout string `json:"timeout"`
+}
+
+// HookEvent is passed to the command of a hook.
+type HookEvent struct {
+	Event   string `json:"event"`
+	Account string `json:"account"`
+	Dir     string `json:"dir"`
+	Mailbox string `json:"mailbox,omitempty"`
+	// File is the path of the eml file of a saved mail. With object storage, it is the path mapped to the key.
+	File  string    `json:"file,omitempty"`
+	Mail  *HookMail `json:"mail,omitempty"`
+	Error string    `json:"error,omitempty"`
+	// MailboxReport is the outcome of a completed mailbox, Report the outcome of a finished run.
+	MailboxReport *MailboxReport `json:"mailboxReport,omitempty"`
+	Report        *AccountReport `json:"report,omitempty"`
+}
+
+// HookMail describes the mail of a mailSaved or mailFailed event.
+type HookMail struct {
+	Hash         string    `json:"hash"`
+	UID          uint32    `json:"uid,omitempty"`
+	MessageID    string    `json:"messageId"`
+	Subject      string    `json:"subject"`
+	From         []string  `json:"from"`
+	Date         time.Time `json:"date"`
+	InternalDate time.Time `json:"internalDate"`
+	Size         int       `json:"size,omitempty"`
+}
+
+// Validate checks the hook for an unknown event, a missing command or an invalid timeout.
+func (h *Hook) Validate() error {
+	switch h.Event {
+	case hookMailSaved, hookMailFailed, hookMailboxCompleted, hookRunFinished:
+	default:
+		return fmt.Errorf("unknown event '%s', expected %s, %s, %s or %s", h.Event, hookMailSaved, hookMailFailed,
+			hookMailboxCompleted, hookRunFinished)
+	}
+	if len(h.Command) == 0 || len(h.Command[0]) == 0 {
+		return fmt.Errorf("command is required")
+	}
+	if _, err := h.timeout(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (h *Hook) timeout() (time.Duration, error) {
+	if len(h.Timeout) == 0 {
+		return defaultHookTimeout, nil
+	}
+	d, err := time.ParseDuration(h.Timeout)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid timeout '%s'", h.Timeout)
+	}
+	return d, nil
+}
+
+func newHookMail(mail *remoteMail) *HookMail {
+	msg := mail.msg
+	m := &HookMail{Hash: mail.hash, UID: msg.Uid, InternalDate: msg.InternalDate, Size: int(msg.Size)}
+	if env := msg.Envelope; env != nil {
+		m.MessageID = env.MessageId
+		m.Subject = env.Subject
+		m.Date = env.Date
+		for _, adr := range env.From {
+			m.From = append(m.From, adr.Address())
+		}
+	}
+	return m
+}
+
+// runHooks invokes the hooks of the event one after another. A failing hook is logged and does not affect the run.
+func (a *App) runHooks(event *HookEvent) {
+	event.Account = a.cfg.Name
+	event.Dir = a.cfg.Dir
+	for _, hook := range a.cfg.Hooks {
+		if hook.Event != event.Event {
+			continue
+		}
+		if err := hook.run(event); err != nil {
+			logger.Warn("hook failed", "account", a.cfg.Name, "event", event.Event, "command", hook.Command[0],
+				"err", err)
+		}
+	}
+}
+
+func (h *Hook) run(event *HookEvent) error {
+	stdin, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+	timeout, err := h.timeout()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Env = append(os.Environ(),
+		"IMAPARC_EVENT="+event.Event,
+		"IMAPARC_ACCOUNT="+event.Account,
+		"IMAPARC_DIR="+event.Dir,
+		"IMAPARC_MAILBOX="+event.Mailbox,
+		"IMAPARC_FILE="+event.File,
+		"IMAPARC_ERROR="+event.Error,
+	)
+	if m := event.Mail; m != nil {
+		cmd.Env = append(cmd.Env,
+			"IMAPARC_HASH="+m.Hash,
+			"IMAPARC_MESSAGE_ID="+m.MessageID,
+			"IMAPARC_SUBJECT="+m.Subject,
+			"IMAPARC_FROM="+strings.Join(m.From, ", "),
+			"IMAPARC_SIZE="+strconv.Itoa(m.Size),
+		)
+	}
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+	if err != nil {
+		if output := strings.TrimSpace(string(out)); len(output) > 0 {
+			return fmt.Errorf("%w: %s", err, output)
+		}
+		return err
+	}
+	logger.Debug("hook invoked", "account", event.Account, "event", event.Event, "command", h.Command[0],
+		"output", strings.TrimSpace(string(out)))
+	return nil
+}
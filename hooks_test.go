@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestHooks runs a script on mailSaved and runFinished, which records its environment and stdin. A failing or
+// hanging hook is logged and does not stop the following ones.
+func TestHooks(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "hook.sh")
+	// the environment is appended to env and the json event to stdin, one line per invocation
+	err := ioutil.WriteFile(script, []byte(`#!/bin/sh
+env | grep ^IMAPARC_ | sort | tr '\n' ' ' >> "$0.env"
+echo >> "$0.env"
+cat >> "$0.stdin"
+echo >> "$0.stdin"
+`), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	defer func(l *Logger) { logger = l }(logger)
+	logger = NewLogger(&buf)
+	a := &App{cfg: &Config{Account: Account{Name: "alice"}, Dir: "/mails/alice", Hooks: []*Hook{
+		{Event: hookMailSaved, Command: []string{script}},
+		{Event: hookRunFinished, Command: []string{"sh", "-c", "echo boom; exit 3"}},
+		{Event: hookRunFinished, Command: []string{"sleep", "5"}, Timeout: "100ms"},
+		{Event: hookRunFinished, Command: []string{script}},
+	}}}
+
+	a.runHooks(&HookEvent{Event: hookMailSaved, Mailbox: "INBOX", File: "/mails/alice/INBOX/abc.eml",
+		Mail: &HookMail{Hash: "abc", MessageID: "<1@example.com>", Subject: "hello", From: []string{"bob@example.com",
+			"carol@example.com"}, Size: 42}})
+	started := time.Now()
+	a.runHooks(&HookEvent{Event: hookRunFinished, Error: "login failed"})
+	if elapsed := time.Since(started); elapsed > 3*time.Second {
+		t.Errorf("expected the hanging hook to be stopped, took %s", elapsed)
+	}
+
+	b, err := ioutil.ReadFile(script + ".env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := strings.Split(strings.TrimSpace(string(b)), "\n")
+	expected := []string{
+		"IMAPARC_ACCOUNT=alice IMAPARC_DIR=/mails/alice IMAPARC_ERROR= IMAPARC_EVENT=mailSaved " +
+			"IMAPARC_FILE=/mails/alice/INBOX/abc.eml IMAPARC_FROM=bob@example.com, carol@example.com IMAPARC_HASH=abc " +
+			"IMAPARC_MAILBOX=INBOX IMAPARC_MESSAGE_ID=<1@example.com> IMAPARC_SIZE=42 IMAPARC_SUBJECT=hello",
+		"IMAPARC_ACCOUNT=alice IMAPARC_DIR=/mails/alice IMAPARC_ERROR=login failed IMAPARC_EVENT=runFinished " +
+			"IMAPARC_FILE= IMAPARC_MAILBOX=",
+	}
+	if len(env) != len(expected) {
+		t.Fatalf("expected %d invocations, got %q", len(expected), env)
+	}
+	for i := range expected {
+		if strings.TrimSpace(env[i]) != expected[i] {
+			t.Errorf("invocation %d: expected environment\n%s\ngot\n%s", i, expected[i], strings.TrimSpace(env[i]))
+		}
+	}
+
+	b, err = ioutil.ReadFile(script + ".stdin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved HookEvent
+	if err := json.Unmarshal([]byte(strings.Split(string(b), "\n")[0]), &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.Event != hookMailSaved || saved.Account != "alice" || saved.Mail == nil || saved.Mail.Subject != "hello" {
+		t.Errorf("unexpected event on stdin %+v", saved)
+	}
+
+	log := buf.String()
+	for _, s := range []string{"exit status 3: boom", "timed out after 100ms"} {
+		if !strings.Contains(log, s) {
+			t.Errorf("expected a warning with %q, got:\n%s", s, log)
+		}
+	}
+	if n := strings.Count(log, "hook failed"); n != 2 {
+		t.Errorf("expected 2 failed hooks, got %d:\n%s", n, log)
+	}
+}
@@ -4,42 +4,94 @@ import (
 	"fmt"
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
+	"io/ioutil"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type Imap struct {
 	cfg         *Config
+	raw         *holdConn
+	conn        *compressConn
 	client      *client.Client
 	currentMbox string
 }
 
 func (i *Imap) Login(cfg *Config) error {
+	if err := i.dial(cfg); err != nil {
+		return err
+	}
+
+	// Login
+	if err := i.client.Login(cfg.Login, cfg.Password); err != nil {
+		i.client.Logout()
+		return fmt.Errorf("username or password invalid: %w", err)
+	}
+
+	if !cfg.NoCompress {
+		if err := i.compress(); err != nil {
+			logger.Warn("cannot enable compression", "server", cfg.Server, "err", err)
+		} else if i.Compression() != nil {
+			logger.Debug("compression enabled", "server", cfg.Server)
+		}
+	}
+	return nil
+}
+
+// imapPort returns the configured port or the default port of the protocol.
+func imapPort(cfg *Config) int {
+	if cfg.Port != 0 {
+		return cfg.Port
+	}
+	if cfg.TLS {
+		return 993
+	}
+	return 143
+}
+
+// dial connects to the server without logging in.
+func (i *Imap) dial(cfg *Config) error {
 	i.cfg = cfg
-	fmt.Printf("Connecting to server %s...\n", cfg.Server)
+	port := imapPort(cfg)
+	addr := cfg.Server + ":" + strconv.Itoa(port)
+	logger.Info("connecting", "server", cfg.Server, "port", port, "tls", cfg.TLS, "starttls", cfg.StartTLS)
+
+	tlsConfig := tlsConfigFor(cfg)
 
 	// Connect to server
+	dialer := &holdDialer{timeout: time.Minute}
 	if cfg.TLS {
-		c, err := client.DialTLS(cfg.Server+":"+strconv.Itoa(cfg.Port), nil)
+		c, err := client.DialWithDialerTLS(dialer, addr, tlsConfig)
 		if err != nil {
 			return fmt.Errorf("failed to connect to tls server %s: %w", cfg.Server, err)
 		}
 		i.client = c
 	} else {
-		c, err := client.Dial(cfg.Server + ":" + strconv.Itoa(cfg.Port))
+		c, err := client.DialWithDialer(dialer, addr)
 		if err != nil {
 			return fmt.Errorf("failed to connect to server %s: %w", cfg.Server, err)
 		}
 		i.client = c
+		if cfg.StartTLS {
+			if err := c.StartTLS(tlsConfig); err != nil {
+				c.Terminate()
+				return fmt.Errorf("failed to starttls with server %s: %w", cfg.Server, err)
+			}
+		}
 	}
+	i.raw = dialer.conn
 
-	fmt.Println("Connected")
+	logger.Info("connected", "server", cfg.Server)
+	return nil
+}
 
-	// Login
-	if err := i.client.Login(cfg.Login, cfg.Password); err != nil {
-		return fmt.Errorf("username or password invalid: %w", err)
+// Compression returns the statistics of the connection or nil, if it is not compressed.
+func (i *Imap) Compression() *CompressionReport {
+	if i.conn == nil {
+		return nil
 	}
-
-	return nil
+	return i.conn.Stats()
 }
 
 func (i *Imap) Logout() error {
@@ -47,10 +99,15 @@ func (i *Imap) Logout() error {
 }
 
 func (i *Imap) Mailboxes() ([]*imap.MailboxInfo, error) {
+	return i.list("*")
+}
+
+// list returns the mailboxes matching the given LIST pattern.
+func (i *Imap) list(pattern string) ([]*imap.MailboxInfo, error) {
 	mailboxes := make(chan *imap.MailboxInfo, 10)
 	done := make(chan error, 1)
 	go func() {
-		done <- i.client.List("", "*", mailboxes)
+		done <- i.client.List("", pattern, mailboxes)
 	}()
 
 	var res []*imap.MailboxInfo
@@ -68,6 +125,7 @@ func (i *Imap) Status(mailbox string) (*imap.MailboxStatus, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to select mailbox '%s': %w", mailbox, err)
 	}
+	i.currentMbox = mailbox
 	return mbox, nil
 }
 
@@ -94,16 +152,61 @@ func (i *Imap) Mail(mailbox string, num int) (*imap.Message, error) {
 	return res[0], nil
 }
 
-func (i *Imap) Mails(mailbox string, fetchItem []imap.FetchItem, from, to int) ([]*imap.Message, error) {
+// RawMail fetches only the content of the mail with the given uid. Neither BODYSTRUCTURE nor ENVELOPE is requested,
+// so that mails which the parser rejects can still be archived.
+func (i *Imap) RawMail(mailbox string, uid uint32) ([]byte, error) {
+	if err := i.selectMailbox(mailbox); err != nil {
+		return nil, err
+	}
+
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uid)
+	section := &imap.BodySectionName{Peek: true}
+
+	messages := make(chan *imap.Message, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- i.client.UidFetch(seqset, []imap.FetchItem{section.FetchItem()}, messages)
+	}()
+
+	var res []*imap.Message
+	for msg := range messages {
+		res = append(res, msg)
+	}
+	if err := <-done; err != nil {
+		return nil, err
+	}
+	if len(res) != 1 {
+		return nil, fmt.Errorf("expected mail with uid %d but got %d mails", uid, len(res))
+	}
+	body := res[0].GetBody(section)
+	if body == nil {
+		return nil, fmt.Errorf("missing body of mail with uid %d", uid)
+	}
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body: %w", err)
+	}
+	return b, nil
+}
+
+func (i *Imap) selectMailbox(mailbox string) error {
 	if i.currentMbox != mailbox {
 		// Select INBOX
 		_, err := i.client.Select(mailbox, true)
 		if err != nil {
-			return nil, fmt.Errorf("failed to select mailbox '%s': %w", mailbox, err)
+			return fmt.Errorf("failed to select mailbox '%s': %w", mailbox, err)
 		}
 		//fmt.Printf("Flags for %s: %s\n", mbox.Name, mbox.Flags)
 		i.currentMbox = mailbox
 	}
+	return nil
+}
+
+func (i *Imap) Mails(mailbox string, fetchItem []imap.FetchItem, from, to int) ([]*imap.Message, error) {
+	if err := i.selectMailbox(mailbox); err != nil {
+		return nil, err
+	}
 
 	seqset := new(imap.SeqSet)
 	seqset.AddRange(uint32(from), uint32(to))
@@ -120,6 +223,10 @@ func (i *Imap) Mails(mailbox string, fetchItem []imap.FetchItem, from, to int) (
 	}
 
 	if err := <-done; err != nil {
+		// the library reports a broken body structure only by its message
+		if strings.Contains(err.Error(), "Missing type-specific fields") {
+			return res, &MailParseError{Err: err}
+		}
 		return res, err
 	}
 	expected := (to - from) + 1
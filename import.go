@@ -0,0 +1,518 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	imap2 "github.com/emersion/go-imap"
+)
+
+// importDelimiter separates the levels of imported mailbox names.
+const importDelimiter = "/"
+
+// localHeaders are added to the mails of mbox files by the client keeping them: X-Mozilla-* by Thunderbird, the flags
+// Status and X-Status by mutt, Pine and others and the keywords X-Keywords by Dovecot. They are dropped on import,
+// so that the header hash matches the mail as archived from the server.
+var localHeaders = regexp.MustCompile(`(?im)^(X-Mozilla-(Status|Status2|Keys)|Status|X-Status|X-Keywords):.*\r\n(?:[ \t].*\r\n)*`)
+
+var mboxEscapedFrom = regexp.MustCompile(`(?m)^>(>*From )`)
+
+// Importer copies mails from mbox files, Maildirs, eml files and Outlook pst files into the mailbox directories of an account, using
+// the same layout as an archive run. Mails, which are already archived in any mailbox of the account, are skipped.
+type Importer struct {
+	dir     string
+	dryRun  bool
+	storage Storage
+	metas   map[string]*MailboxMeta
+	reports map[string]*MailboxReport
+	hashes  map[string]bool // header hashes of all mails of the account
+}
+
+// NewImporter creates an importer into the given account directory of the storage.
+func NewImporter(dir string, storage Storage, dryRun bool) *Importer {
+	return &Importer{
+		dir:     dir,
+		dryRun:  dryRun,
+		storage: storageOf(storage),
+		metas:   make(map[string]*MailboxMeta),
+		reports: make(map[string]*MailboxReport),
+	}
+}
+
+// Import detects the format of src and imports it. A Maildir or eml file is imported into mailbox, an mbox file
+// into mailbox or a mailbox named like the file. The folders of a pst or ost file become mailboxes below mailbox.
+// Other directories are imported as a tree: mbox files, pst files and Maildirs become mailboxes named by their
+// relative path below mailbox, Thunderbird .sbd directories contain the children of a mailbox and eml files
+// belong to the mailbox of their directory.
+func (im *Importer) Import(src, mailbox string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return fmt.Errorf("cannot import: %w", err)
+	}
+	switch {
+	case info.IsDir() && isMaildir(src):
+		if len(mailbox) == 0 {
+			mailbox = "INBOX"
+		}
+		return im.importMaildir(src, mailbox)
+	case info.IsDir():
+		return im.importTree(src, mailbox)
+	case strings.HasSuffix(info.Name(), ".eml"):
+		if len(mailbox) == 0 {
+			mailbox = "Imported"
+		}
+		return im.importEml(src, mailbox)
+	case isPst(src):
+		return im.importPst(src, mailbox)
+	default:
+		if len(mailbox) == 0 {
+			mailbox = strings.TrimSuffix(info.Name(), ".mbox")
+		}
+		return im.importMbox(src, mailbox)
+	}
+}
+
+func (im *Importer) importTree(dir, mailbox string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to list %s: %w", dir, err)
+	}
+	for _, f := range files {
+		src := filepath.Join(dir, f.Name())
+		switch {
+		case f.IsDir() && isMaildir(src):
+			err = im.importMaildir(src, path.Join(mailbox, f.Name()))
+		case f.IsDir() && strings.HasSuffix(f.Name(), ".sbd"):
+			err = im.importTree(src, path.Join(mailbox, strings.TrimSuffix(f.Name(), ".sbd")))
+		case f.IsDir():
+			err = im.importTree(src, path.Join(mailbox, f.Name()))
+		case strings.HasSuffix(f.Name(), ".eml"):
+			if len(mailbox) == 0 {
+				err = im.importEml(src, "Imported")
+			} else {
+				err = im.importEml(src, mailbox)
+			}
+		case isPst(src):
+			name := path.Join(mailbox, strings.TrimSuffix(f.Name(), filepath.Ext(f.Name())))
+			if err = im.importPst(src, name); err != nil {
+				// continue with the other files, but fail the import
+				logger.Error("import failed", "src", src, "err", err)
+				im.report(name).Failed++
+				err = nil
+			}
+		case isMbox(src):
+			err = im.importMbox(src, path.Join(mailbox, strings.TrimSuffix(f.Name(), ".mbox")))
+		default:
+			logger.Debug("ignoring file", "file", src)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importMaildir imports the cur and new directories. Maildir++ folders like .Sent or .Archive.2020 become
+// mailboxes next to the INBOX or below mailbox.
+func (im *Importer) importMaildir(dir, mailbox string) error {
+	for _, sub := range []string{"cur", "new"} {
+		files, err := ioutil.ReadDir(filepath.Join(dir, sub))
+		if err != nil {
+			continue
+		}
+		for _, f := range files {
+			if f.IsDir() {
+				continue
+			}
+			src := filepath.Join(dir, sub, f.Name())
+			b, err := ioutil.ReadFile(src)
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %w", src, err)
+			}
+			im.add(mailbox, src, b, f.ModTime())
+		}
+	}
+
+	prefix := mailbox
+	if mailbox == "INBOX" {
+		prefix = ""
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to list %s: %w", dir, err)
+	}
+	for _, f := range files {
+		src := filepath.Join(dir, f.Name())
+		if f.IsDir() && len(f.Name()) > 1 && strings.HasPrefix(f.Name(), ".") && isMaildir(src) {
+			name := strings.Replace(f.Name()[1:], ".", importDelimiter, -1)
+			if err := im.importMaildir(src, path.Join(prefix, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (im *Importer) importEml(src, mailbox string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return fmt.Errorf("cannot import: %w", err)
+	}
+	b, err := ioutil.ReadFile(src)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", src, err)
+	}
+	im.add(mailbox, src, b, info.ModTime())
+	return nil
+}
+
+// importMbox splits the file at each line starting with "From " and unescapes quoted From lines. The date of
+// the separator line is used as the date of the mail.
+func (im *Importer) importMbox(src, mailbox string) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("cannot import: %w", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var current []byte
+	var date time.Time
+	count := 0
+	flush := func() {
+		if current == nil {
+			return
+		}
+		count++
+		// the empty line before the next separator is not part of the mail
+		eml := current
+		if bytes.HasSuffix(eml, []byte("\r\n\r\n")) {
+			eml = eml[:len(eml)-2]
+		} else if bytes.HasSuffix(eml, []byte("\n\n")) {
+			eml = eml[:len(eml)-1]
+		}
+		eml = mboxEscapedFrom.ReplaceAll(eml, []byte("$1"))
+		im.add(mailbox, fmt.Sprintf("%s#%d", src, count), eml, date)
+	}
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			if bytes.HasPrefix(line, []byte("From ")) && (current == nil || afterEmptyLine(current)) {
+				flush()
+				current = []byte{}
+				date = mboxDate(string(line))
+			} else if current != nil {
+				current = append(current, line...)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", src, err)
+		}
+	}
+	flush()
+	return nil
+}
+
+// afterEmptyLine returns true, if b is empty or ends with an empty line, as required before a separator line.
+func afterEmptyLine(b []byte) bool {
+	return len(b) == 0 || bytes.HasSuffix(b, []byte("\n\n")) || bytes.HasSuffix(b, []byte("\n\r\n"))
+}
+
+// mboxDate parses the date of a separator line like "From sender@host Wed May 11 14:31:59 2016".
+func mboxDate(line string) time.Time {
+	fields := strings.Fields(line)
+	if len(fields) < 7 {
+		return time.Time{}
+	}
+	t, err := time.ParseInLocation(time.ANSIC, strings.Join(fields[2:7], " "), time.Local)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// importPst converts the messages of all folders of an Outlook pst or ost file. Contacts, appointments and other
+// items, which are not mails, are skipped.
+func (im *Importer) importPst(src, mailbox string) (err error) {
+	pst, err := openPst(src)
+	if err != nil {
+		return fmt.Errorf("cannot import: %w", err)
+	}
+	defer pst.Close()
+	// a corrupt file must not abort the import of other sources
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("cannot import %s: panic while reading: %v", src, r)
+		}
+	}()
+	return pst.walk(func(folder []string, node *pstNode) error {
+		name := path.Join(append([]string{mailbox}, folder...)...)
+		if len(name) == 0 {
+			name = "Imported"
+		}
+		file := fmt.Sprintf("%s#%d", src, node.nid)
+		msg, eml, err := convertPstMessage(pst, node)
+		if err == nil && msg == nil {
+			return nil
+		}
+		if err != nil {
+			logger.Warn("cannot convert message", "file", file, "err", err)
+			report := im.report(name)
+			report.Total++
+			report.Failed++
+			return nil
+		}
+		im.add(name, file, eml, msg.date())
+		return nil
+	})
+}
+
+// convertPstMessage converts a message into an eml. Items, which are no mails, are skipped by returning nil. A
+// panic caused by a corrupt message is returned as error, so that only this message fails.
+func convertPstMessage(pst *pstFile, node *pstNode) (msg *pstMessage, eml []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			msg, eml, err = nil, nil, fmt.Errorf("panic while converting: %v", r)
+		}
+	}()
+	msg, err = pst.message(node)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !msg.isMail() {
+		logger.Debug("ignoring item, which is no mail", "node", node.nid, "class", msg.props.string(pstPropMessageClass))
+		return nil, nil, nil
+	}
+	eml, err = msg.eml()
+	return msg, eml, err
+}
+
+// report returns the counters of the mailbox.
+func (im *Importer) report(mailbox string) *MailboxReport {
+	report := im.reports[mailbox]
+	if report == nil {
+		report = &MailboxReport{Name: mailbox}
+		im.reports[mailbox] = report
+	}
+	return report
+}
+
+// add writes a single mail into the mailbox, unless it is archived already. If date is zero, the Date header is
+// used.
+func (im *Importer) add(mailbox, src string, eml []byte, date time.Time) {
+	report := im.report(mailbox)
+	report.Total++
+
+	// servers deliver CRLF line endings, so the hashes match archived mails
+	eml = bytes.Replace(eml, []byte("\r\n"), []byte("\n"), -1)
+	eml = bytes.Replace(eml, []byte("\n"), []byte("\r\n"), -1)
+	header := headerOf(eml)
+	if !bytes.HasSuffix(header, []byte("\r\n\r\n")) {
+		logger.Warn("ignoring file without mail header", "file", src)
+		report.Failed++
+		return
+	}
+	body := eml[len(header):]
+	header = localHeaders.ReplaceAll(header, nil)
+	eml = append(append([]byte{}, header...), body...)
+	msg, err := mail.ReadMessage(bytes.NewReader(header))
+	if err == nil && date.IsZero() {
+		date, _ = msg.Header.Date()
+	}
+	sum := sha256.Sum224(header)
+	hash := hex.EncodeToString(sum[:])
+
+	hashes, err := im.archived()
+	if err != nil {
+		logger.Warn("cannot import mail", "file", src, "err", err)
+		report.Failed++
+		return
+	}
+	if hashes[hash] {
+		report.Skipped++
+		return
+	}
+	targetDir := filepath.Join(im.dir, escapeMailboxName(mailbox, importDelimiter))
+	emlFile := filepath.Join(targetDir, hash+".eml")
+	meta, err := im.meta(mailbox, targetDir)
+	if err != nil {
+		logger.Warn("cannot import mail", "file", src, "err", err)
+		report.Failed++
+		return
+	}
+	if !im.dryRun {
+		if err := im.storage.WriteFile(emlFile, eml, date); err != nil {
+			logger.Warn("cannot import mail", "file", src, "err", err)
+			report.Failed++
+			return
+		}
+	}
+	hashes[hash] = true
+	report.New++
+	report.Bytes += int64(len(eml))
+	meta.add(&remoteMail{msg: importedMessage(date, len(eml)), hash: hash, emlFile: emlFile})
+	logger.Debug("imported mail", "mailbox", mailbox, "file", src, "dryRun", im.dryRun)
+}
+
+// archived returns the header hashes of all mails of the account. A mail is archived only once per account, even
+// if it has been archived in another mailbox or below the directory of a mailbox named with another delimiter.
+func (im *Importer) archived() (map[string]bool, error) {
+	if im.hashes != nil {
+		return im.hashes, nil
+	}
+	hashes := make(map[string]bool)
+	err := im.storage.Walk(im.dir, func(name string) error {
+		if base := filepath.Base(name); strings.HasSuffix(base, ".eml") {
+			hashes[strings.TrimSuffix(base, ".eml")] = true
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to list archived mails: %w", err)
+	}
+	im.hashes = hashes
+	return hashes, nil
+}
+
+// meta returns the meta of the mailbox, which is written by Finish.
+func (im *Importer) meta(mailbox, targetDir string) (*MailboxMeta, error) {
+	if meta, ok := im.metas[mailbox]; ok {
+		return meta, nil
+	}
+	meta, err := readStoredMeta(im.storage, targetDir)
+	if err != nil {
+		return nil, err
+	}
+	if len(meta.Name) == 0 {
+		meta.Name = mailbox
+		meta.Delimiter = importDelimiter
+	}
+	im.metas[mailbox] = meta
+	return meta, nil
+}
+
+// Finish writes the metas of all mailboxes and returns the counters of each mailbox.
+func (im *Importer) Finish() ([]*MailboxReport, error) {
+	var res []*MailboxReport
+	for _, report := range im.reports {
+		res = append(res, report)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	if im.dryRun {
+		return res, nil
+	}
+	for mailbox, meta := range im.metas {
+		if im.reports[mailbox].New == 0 {
+			continue
+		}
+		targetDir := filepath.Join(im.dir, escapeMailboxName(mailbox, importDelimiter))
+		if err := writeStoredMeta(im.storage, targetDir, meta); err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// importedMessage describes an imported mail for the meta.
+func importedMessage(date time.Time, size int) *imap2.Message {
+	msg := imap2.NewMessage(0, nil)
+	msg.InternalDate = date
+	msg.Size = uint32(size)
+	return msg
+}
+
+func isMaildir(dir string) bool {
+	info, err := os.Stat(filepath.Join(dir, "cur"))
+	return err == nil && info.IsDir()
+}
+
+func isPst(file string) bool {
+	ext := strings.ToLower(filepath.Ext(file))
+	return ext == ".pst" || ext == ".ost"
+}
+
+// isMbox returns true, if the file starts with a separator line.
+func isMbox(file string) bool {
+	f, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(f, buf)
+	return err == nil && string(buf) == "From "
+}
+
+// importCommand imports local mails into an account directory:
+// imaparc import -dir <account> [-configFile file] [-mailbox name] <src>...
+func importCommand(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	dir := flags.String("dir", "", "the account directory to import into")
+	mailbox := flags.String("mailbox", "", "the mailbox to import into, derived from the source if empty")
+	dryRun := flags.Bool("dryRun", false, "only print what would be imported")
+	lockWait := flags.Duration("lockWait", 0, "how long to wait for another run on the same directory, e.g. 10m")
+	configFile := flags.String("configFile", "", "filename to a configuration, which selects the storage")
+	flags.Usage = func() {
+		w := flags.Output()
+		fmt.Fprintln(w, "usage: imaparc import -dir <account> [-configFile file] [-mailbox name] [-dryRun] <mbox|maildir|eml|pst|dir>...")
+		fmt.Fprintln(w, "Mails are deduplicated across the whole account: a mail archived in any mailbox of the account is skipped,")
+		fmt.Fprintln(w, "not only one archived in the mailbox it would be imported into.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if len(*dir) == 0 || flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	if !*dryRun {
+		lock, err := acquireLock(archiveLockFile(*dir), "import", *lockWait)
+		if err != nil {
+			logger.Error("cannot import", "err", err)
+			return 1
+		}
+		defer lock.Unlock()
+	}
+	var storage Storage = localStorage{}
+	if len(*configFile) > 0 {
+		storage = loadConfigOrExit(*configFile).storage
+	}
+	im := NewImporter(*dir, storage, *dryRun)
+	code := 0
+	for _, src := range flags.Args() {
+		if err := im.Import(src, *mailbox); err != nil {
+			logger.Error("import failed", "src", src, "err", err)
+			code = 1
+		}
+	}
+	reports, err := im.Finish()
+	if err != nil {
+		logger.Error("cannot write mailbox meta", "err", err)
+		code = 1
+	}
+	for _, r := range reports {
+		logger.Info("imported mailbox", "mailbox", r.Name, "dryRun", *dryRun, "mails", r.Total, "new", r.New,
+			"duplicates", r.Skipped, "failed", r.Failed, "size", formatSize(r.Bytes))
+		if r.Failed > 0 {
+			code = 1
+		}
+	}
+	return code
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestImportSkipsMailsOfOtherMailboxes(t *testing.T) {
+	dir := t.TempDir()
+	eml := "From: a@example.com\r\nSubject: archived\r\nDate: Wed, 11 May 2016 14:31:59 +0000\r\n\r\nbody\r\n"
+
+	// archived from a server, which uses the delimiter '.'
+	sum := sha256.Sum224(headerOf([]byte(eml)))
+	archived := filepath.Join(dir, escapeMailboxName("INBOX.Archive", "."), hex.EncodeToString(sum[:])+".eml")
+	if err := (localStorage{}).WriteFile(archived, []byte(eml), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	src := filepath.Join(t.TempDir(), "mails.mbox")
+	mbox := "From a@example.com Wed May 11 14:31:59 2016\n" + eml +
+		"\nFrom b@example.com Wed May 11 14:31:59 2016\nFrom: b@example.com\nSubject: new\n\nbody\n"
+	if err := ioutil.WriteFile(src, []byte(mbox), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, target := range []string{"INBOX/Archive", "Other"} {
+		im := NewImporter(dir, nil, false)
+		if err := im.Import(src, target); err != nil {
+			t.Fatal(err)
+		}
+		reports, err := im.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(reports) != 1 || reports[0].Total != 2 {
+			t.Fatalf("%s: unexpected reports %+v", target, reports)
+		}
+		// the mail archived from the server is never imported and the new mail only into the first mailbox
+		want := 1
+		if target == "Other" {
+			want = 0
+		}
+		if reports[0].New != want {
+			t.Fatalf("%s: expected %d new mails, got %+v", target, want, reports[0])
+		}
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*", "*", "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("expected 2 archived mails, got %v", files)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "Other")); !os.IsNotExist(err) {
+		t.Fatal("no directory expected for a mailbox without new mails")
+	}
+}
+
+// TestImportDropsLocalHeaders imports mails, which the mail clients keeping the mbox files have marked with flags
+// and keywords, as the unmarked mails archived from the server.
+func TestImportDropsLocalHeaders(t *testing.T) {
+	dir := t.TempDir()
+	eml := "From: a@example.com\r\nSubject: archived\r\n\r\nbody\r\n"
+	sum := sha256.Sum224(headerOf([]byte(eml)))
+	archived := filepath.Join(dir, "INBOX", hex.EncodeToString(sum[:])+".eml")
+	if err := (localStorage{}).WriteFile(archived, []byte(eml), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	src := filepath.Join(t.TempDir(), "mails.mbox")
+	mbox := "From a@example.com Wed May 11 14:31:59 2016\nFrom: a@example.com\nStatus: RO\nX-Status: A\n" +
+		"X-Keywords: $Label1\n $Label2\nX-Mozilla-Status: 0001\nSubject: archived\n\nbody\n" +
+		"\nFrom b@example.com Wed May 11 14:31:59 2016\nFrom: b@example.com\nStatus: O\nX-Keywords: work\n" +
+		"Subject: new\n\nbody\n"
+	if err := ioutil.WriteFile(src, []byte(mbox), 0644); err != nil {
+		t.Fatal(err)
+	}
+	im := NewImporter(dir, nil, false)
+	if err := im.Import(src, "Old"); err != nil {
+		t.Fatal(err)
+	}
+	reports, err := im.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 1 || reports[0].New != 1 || reports[0].Skipped != 1 {
+		t.Fatalf("expected one new and one skipped mail, got %+v", reports)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "Old", "*.eml"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("expected the new mail, got %v %v", files, err)
+	}
+	b, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "From: b@example.com\r\nSubject: new\r\n\r\nbody\r\n"; string(b) != expected {
+		t.Fatalf("expected %q, got %q", expected, b)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The lock of a directory is refreshed by its holder. A lock, which has not been refreshed within lockStale, or
+// whose process does not exist anymore, is stale and removed by the next run.
+const (
+	lockRefresh = time.Minute
+	lockStale   = 5 * time.Minute
+)
+
+// LockInfo describes the holder of a lock.
+type LockInfo struct {
+	Command  string    `json:"command"`
+	PID      int       `json:"pid"`
+	Host     string    `json:"host"`
+	Acquired time.Time `json:"acquired"`
+}
+
+// LockedError is returned, if another process holds the lock.
+type LockedError struct {
+	File string
+	Info *LockInfo
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("%s is locked by %s (pid %d on %s) since %s", e.File, e.Info.Command, e.Info.PID, e.Info.Host,
+		e.Info.Acquired.Local().Format(time.RFC3339))
+}
+
+// DirLock is an acquired lock file.
+type DirLock struct {
+	fname string
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// archiveLockFile returns the lock of the account in dir, held while mails are written.
+func archiveLockFile(dir string) string {
+	return filepath.Join(dir, stateDir, "lock")
+}
+
+// indexLockFile returns the lock of the search index in dir.
+func indexLockFile(dir string) string {
+	return filepath.Join(dir, stateDir, "index.lock")
+}
+
+// acquireLock creates the lock file fname for the given command. If another process holds it, acquireLock waits up
+// to wait for its release and returns a LockedError afterwards.
+func acquireLock(fname, command string, wait time.Duration) (*DirLock, error) {
+	if err := os.MkdirAll(filepath.Dir(fname), os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to mkdir %s: %w", filepath.Dir(fname), err)
+	}
+	host, _ := os.Hostname()
+	info := &LockInfo{Command: command, PID: os.Getpid(), Host: host, Acquired: time.Now()}
+	b, err := json.Marshal(info)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal: %w", err)
+	}
+
+	deadline := time.Now().Add(wait)
+	logged := false
+	for {
+		file, err := os.OpenFile(fname, os.O_CREATE|os.O_EXCL|os.O_WRONLY, os.ModePerm)
+		if err == nil {
+			_, err = file.Write(b)
+			if cerr := file.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(fname)
+				return nil, fmt.Errorf("failed to write %s: %w", fname, err)
+			}
+			l := &DirLock{fname: fname, stop: make(chan struct{}), done: make(chan struct{})}
+			go l.refresh()
+			return l, nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("failed to create %s: %w", fname, err)
+		}
+
+		holder, stale := readLock(fname)
+		if holder == nil {
+			// released in the meantime
+			continue
+		}
+		if stale {
+			if err := removeStaleLock(fname, holder); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if time.Now().After(deadline) || isInterrupted() {
+			return nil, &LockedError{File: fname, Info: holder}
+		}
+		if !logged {
+			logger.Info("waiting for lock", "file", fname, "command", holder.Command, "pid", holder.PID,
+				"host", holder.Host)
+			logged = true
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// removeStaleLock removes the lock file, if it still belongs to the stale holder. Two runs, which found the same
+// stale lock, would otherwise both remove it, and the slower one would remove the lock just acquired by the other.
+// The takeover is guarded by the exclusive file fname.takeover, within which the lock is read again, so that a lock
+// acquired in the meantime is left alone.
+func removeStaleLock(fname string, holder *LockInfo) error {
+	guard := fname + ".takeover"
+	file, err := os.OpenFile(guard, os.O_CREATE|os.O_EXCL|os.O_WRONLY, os.ModePerm)
+	if err != nil {
+		if !os.IsExist(err) {
+			return fmt.Errorf("failed to create %s: %w", guard, err)
+		}
+		// another run takes over, unless it died while doing so
+		if stat, err := os.Stat(guard); err == nil && time.Since(stat.ModTime()) > lockStale {
+			os.Remove(guard)
+		}
+		time.Sleep(100 * time.Millisecond)
+		return nil
+	}
+	file.Close()
+	defer os.Remove(guard)
+
+	current, stale := readLock(fname)
+	if current == nil || !stale || !current.sameHolder(holder) {
+		return nil
+	}
+	logger.Warn("removing stale lock", "file", fname, "command", holder.Command, "pid", holder.PID,
+		"host", holder.Host)
+	if err := os.Remove(fname); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale lock %s: %w", fname, err)
+	}
+	return nil
+}
+
+// sameHolder returns true, if both describe the same acquisition of a lock.
+func (i *LockInfo) sameHolder(o *LockInfo) bool {
+	return i.Command == o.Command && i.PID == o.PID && i.Host == o.Host && i.Acquired.Equal(o.Acquired)
+}
+
+// readLock returns the holder of the lock file and whether the lock is stale. An unreadable lock, e.g. one which
+// is just being written, is not stale until it has not been modified for lockStale. A missing lock returns nil.
+func readLock(fname string) (*LockInfo, bool) {
+	info := &LockInfo{}
+	stat, err := os.Stat(fname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false
+		}
+		return info, false
+	}
+	b, err := ioutil.ReadFile(fname)
+	if err == nil {
+		err = json.Unmarshal(b, info)
+	}
+	if time.Since(stat.ModTime()) > lockStale {
+		return info, true
+	}
+	if err != nil {
+		return info, false
+	}
+	host, _ := os.Hostname()
+	return info, info.Host == host && info.PID != os.Getpid() && !processAlive(info.PID)
+}
+
+// refresh touches the lock file until it is released, so that it does not become stale.
+func (l *DirLock) refresh() {
+	defer close(l.done)
+	ticker := time.NewTicker(lockRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			now := time.Now()
+			if err := os.Chtimes(l.fname, now, now); err != nil {
+				logger.Warn("cannot refresh lock", "file", l.fname, "err", err)
+			}
+		}
+	}
+}
+
+// Unlock releases the lock.
+func (l *DirLock) Unlock() {
+	close(l.stop)
+	<-l.done
+	if err := os.Remove(l.fname); err != nil {
+		logger.Warn("cannot remove lock", "file", l.fname, "err", err)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func writeTestLock(t *testing.T, fname string, info *LockInfo, modTime time.Time) {
+	b, err := json.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fname, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(fname, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAcquireLock(t *testing.T) {
+	fname := archiveLockFile(t.TempDir())
+	lock, err := acquireLock(fname, "archive", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = acquireLock(fname, "import", 0)
+	if locked, ok := err.(*LockedError); !ok || locked.Info.Command != "archive" || locked.Info.PID != os.Getpid() {
+		t.Fatalf("expected a locked error, got %v", err)
+	}
+	go func(lock *DirLock) {
+		time.Sleep(500 * time.Millisecond)
+		lock.Unlock()
+	}(lock)
+	lock, err = acquireLock(fname, "import", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock.Unlock()
+	if _, err := os.Stat(fname); !os.IsNotExist(err) {
+		t.Fatal("expected the lock to be removed")
+	}
+
+	// a fresh lock of another host is never stale
+	writeTestLock(t, fname, &LockInfo{Command: "archive", PID: 1, Host: "elsewhere", Acquired: time.Now()}, time.Now())
+	if _, err := acquireLock(fname, "archive", 0); err == nil {
+		t.Fatal("expected a locked error")
+	}
+	// unless it has not been refreshed
+	old := time.Now().Add(-2 * lockStale)
+	writeTestLock(t, fname, &LockInfo{Command: "archive", PID: 1, Host: "elsewhere", Acquired: old}, old)
+	lock, err = acquireLock(fname, "archive", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock.Unlock()
+}
+
+func TestStaleLockIsTakenOverOnce(t *testing.T) {
+	host, _ := os.Hostname()
+	fname := archiveLockFile(t.TempDir())
+	if err := os.MkdirAll(filepath.Dir(fname), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		// held by a process, which does not exist anymore
+		writeTestLock(t, fname, &LockInfo{Command: "archive", PID: 1 << 22, Host: host, Acquired: time.Now()}, time.Now())
+		var wg sync.WaitGroup
+		var mutex sync.Mutex
+		var acquired []*DirLock
+		for j := 0; j < 8; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if lock, err := acquireLock(fname, "archive", 0); err == nil {
+					mutex.Lock()
+					acquired = append(acquired, lock)
+					mutex.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		if len(acquired) != 1 {
+			t.Fatalf("expected exactly one run to take over the stale lock, got %d", len(acquired))
+		}
+		acquired[0].Unlock()
+	}
+	if _, err := os.Stat(fname + ".takeover"); !os.IsNotExist(err) {
+		t.Fatal("expected the takeover guard to be removed")
+	}
+}
+
+func TestRemoveStaleLockKeepsNewHolder(t *testing.T) {
+	host, _ := os.Hostname()
+	fname := archiveLockFile(t.TempDir())
+	stale := &LockInfo{Command: "archive", PID: 1 << 22, Host: host, Acquired: time.Now().Add(-time.Hour)}
+	lock, err := acquireLock(fname, "import", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Unlock()
+	// the stale holder has been replaced by another run since it was read
+	if err := removeStaleLock(fname, stale); err != nil {
+		t.Fatal(err)
+	}
+	if holder, _ := readLock(fname); holder == nil || holder.Command != "import" {
+		t.Fatalf("expected the new lock to be kept, got %+v", holder)
+	}
+}
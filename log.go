@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	default:
+		return "level" + strconv.Itoa(int(l))
+	}
+}
+
+// ParseLevel parses one of debug, info, warn or error.
+func ParseLevel(str string) (Level, error) {
+	for l := LevelDebug; l <= LevelError; l++ {
+		if strings.EqualFold(l.String(), str) {
+			return l, nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level '%s'", str)
+}
+
+// Logger writes leveled log lines with additional key/value pairs, either as human readable text or as one json
+// object per line.
+type Logger struct {
+	mutex sync.Mutex
+	out   io.Writer
+	level Level
+	json  bool
+}
+
+// logger is the process wide logger, configured by the command line flags.
+var logger = NewLogger(os.Stdout)
+
+func NewLogger(out io.Writer) *Logger {
+	return &Logger{out: out, level: LevelInfo}
+}
+
+func (l *Logger) SetLevel(level Level) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.level = level
+}
+
+// SetFormat selects either the text or the json format.
+func (l *Logger) SetFormat(format string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	switch format {
+	case "text":
+		l.json = false
+	case "json":
+		l.json = true
+	default:
+		return fmt.Errorf("unknown log format '%s'", format)
+	}
+	return nil
+}
+
+// JSON returns true, if the json format is used.
+func (l *Logger) JSON() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.json
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) {
+	l.log(LevelDebug, msg, kv)
+}
+
+func (l *Logger) Info(msg string, kv ...interface{}) {
+	l.log(LevelInfo, msg, kv)
+}
+
+func (l *Logger) Warn(msg string, kv ...interface{}) {
+	l.log(LevelWarn, msg, kv)
+}
+
+func (l *Logger) Error(msg string, kv ...interface{}) {
+	l.log(LevelError, msg, kv)
+}
+
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if level < l.level {
+		return
+	}
+	now := time.Now()
+	if l.json {
+		l.writeJSON(now, level, msg, kv)
+	} else {
+		l.writeText(now, level, msg, kv)
+	}
+}
+
+func (l *Logger) writeJSON(now time.Time, level Level, msg string, kv []interface{}) {
+	entry := map[string]interface{}{
+		"time":  now.Format(time.RFC3339Nano),
+		"level": level.String(),
+		"msg":   msg,
+	}
+	for i := 0; i < len(kv); i += 2 {
+		key, val := pair(kv, i)
+		if err, ok := val.(error); ok {
+			val = err.Error()
+		}
+		entry[key] = val
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		b, _ = json.Marshal(map[string]interface{}{"time": entry["time"], "level": level.String(), "msg": msg, "logError": err.Error()})
+	}
+	l.out.Write(append(b, '\n'))
+}
+
+func (l *Logger) writeText(now time.Time, level Level, msg string, kv []interface{}) {
+	sb := &strings.Builder{}
+	sb.WriteString(now.Format("2006-01-02 15:04:05"))
+	sb.WriteString(" ")
+	sb.WriteString(strings.ToUpper(level.String()))
+	sb.WriteString(" ")
+	sb.WriteString(msg)
+	for i := 0; i < len(kv); i += 2 {
+		key, val := pair(kv, i)
+		sb.WriteString(" ")
+		sb.WriteString(key)
+		sb.WriteString("=")
+		str := fmt.Sprintf("%v", val)
+		if strings.ContainsAny(str, " \t\"=") || len(str) == 0 {
+			str = strconv.Quote(str)
+		}
+		sb.WriteString(str)
+	}
+	sb.WriteString("\n")
+	io.WriteString(l.out, sb.String())
+}
+
+// pair returns the key and value at index i, tolerating an odd amount of arguments.
+func pair(kv []interface{}, i int) (string, interface{}) {
+	key := fmt.Sprintf("%v", kv[i])
+	if i+1 >= len(kv) {
+		return "!badkey", kv[i]
+	}
+	return key, kv[i+1]
+}
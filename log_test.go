@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoggerJSON(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLogger(&buf)
+	if err := l.SetFormat("json"); err != nil {
+		t.Fatal(err)
+	}
+	l.Debug("hidden", "mailbox", "INBOX")
+	l.Info("saved", "account", "alice", "mailbox", "INBOX", "uid", 7, "bytes", int64(1024), "ok", true)
+	l.Error("failed", "err", errors.New("connection lost"), "dangling")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines below debug, got:\n%s", buf.String())
+	}
+	var saved, failed map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &saved); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &failed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, saved["time"].(string)); err != nil {
+		t.Errorf("invalid time: %v", err)
+	}
+	delete(saved, "time")
+	expected := map[string]interface{}{"level": "info", "msg": "saved", "account": "alice", "mailbox": "INBOX",
+		"uid": 7.0, "bytes": 1024.0, "ok": true}
+	if len(saved) != len(expected) {
+		t.Errorf("expected fields %v, got %v", expected, saved)
+	}
+	for k, v := range expected {
+		if saved[k] != v {
+			t.Errorf("expected %s=%v, got %v", k, v, saved[k])
+		}
+	}
+	if failed["level"] != "error" || failed["err"] != "connection lost" || failed["!badkey"] != "dangling" {
+		t.Errorf("unexpected error line %v", failed)
+	}
+}
+
+func TestLoggerText(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLogger(&buf)
+	l.SetLevel(LevelWarn)
+	l.Info("hidden")
+	l.Warn("hook failed", "command", "notify", "err", `exit status 1: "boom"`, "output", "")
+	line := strings.TrimSpace(buf.String())
+	expected := `WARN hook failed command=notify err="exit status 1: \"boom\"" output=""`
+	if !strings.HasSuffix(line, expected) || strings.Count(line, "\n") != 0 {
+		t.Errorf("expected a line ending with %s, got %s", expected, line)
+	}
+	if err := l.SetFormat("xml"); err == nil {
+		t.Error("expected an unknown format to fail")
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("expected an unknown level to fail")
+	}
+}
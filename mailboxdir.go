@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The directory of a mailbox is derived from its name, which the imap client has already decoded from modified
+// UTF-7. Each level of the hierarchy becomes a directory and each level is escaped reversibly: runes, which are
+// not allowed or not portable in file names, are written as %XX of their UTF-8 bytes. A leading '.' or '#' is
+// escaped as well, so that mailboxes never collide with the state directory or namespace directories. A level,
+// which would be mistaken for an archived mail, the mailbox meta or the snapshots, gets its last '.' escaped.
+
+// escapeMailboxName returns the relative directory of the given mailbox. An empty delimiter means a flat
+// mailbox namespace.
+func escapeMailboxName(name, delimiter string) string {
+	var levels []string
+	if len(delimiter) == 0 {
+		levels = []string{name}
+	} else {
+		levels = strings.Split(name, delimiter)
+	}
+	for i, level := range levels {
+		levels[i] = escapeLevel(level)
+	}
+	return filepath.Join(levels...)
+}
+
+// unescapeMailboxName is the inverse of escapeMailboxName for a directory relative to the account directory.
+func unescapeMailboxName(dir, delimiter string) (string, error) {
+	levels := strings.Split(filepath.ToSlash(dir), "/")
+	for i, level := range levels {
+		name, err := unescapeLevel(level)
+		if err != nil {
+			return "", fmt.Errorf("invalid mailbox directory '%s': %w", dir, err)
+		}
+		levels[i] = name
+	}
+	return strings.Join(levels, delimiter), nil
+}
+
+func escapeLevel(level string) string {
+	if len(level) == 0 {
+		// a single '%' is never produced otherwise
+		return "%"
+	}
+	sb := &strings.Builder{}
+	reservedDot := -1
+	if level == metaFile || level == snapshotFile || strings.HasSuffix(level, ".eml") {
+		reservedDot = strings.LastIndex(level, ".")
+	}
+	for i := 0; i < len(level); {
+		r, size := utf8.DecodeRuneInString(level[i:])
+		escape := false
+		switch {
+		case r == '%' || r == '/' || r == '\\' || r == ':' || r == '*' || r == '?' || r == '"' || r == '<' ||
+			r == '>' || r == '|':
+			escape = true
+		case r == utf8.RuneError || !unicode.IsPrint(r):
+			// invalid UTF-8 is escaped bytewise, so it is restored unchanged
+			escape = true
+		case i == 0 && (r == '.' || r == '#'):
+			escape = true
+		case i+size == len(level) && (r == '.' || r == ' '):
+			// not portable to windows
+			escape = true
+		case i == reservedDot:
+			escape = true
+		}
+		if escape {
+			for _, b := range []byte(level[i : i+size]) {
+				fmt.Fprintf(sb, "%%%02X", b)
+			}
+		} else {
+			sb.WriteString(level[i : i+size])
+		}
+		i += size
+	}
+	return sb.String()
+}
+
+func unescapeLevel(level string) (string, error) {
+	if level == "%" {
+		return "", nil
+	}
+	var buf []byte
+	for i := 0; i < len(level); i++ {
+		if level[i] != '%' {
+			buf = append(buf, level[i])
+			continue
+		}
+		if i+2 >= len(level) {
+			return "", fmt.Errorf("truncated escape at %d", i)
+		}
+		b, err := strconv.ParseUint(level[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("invalid escape at %d", i)
+		}
+		buf = append(buf, byte(b))
+		i += 2
+	}
+	return string(buf), nil
+}
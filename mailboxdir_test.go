@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestEscapeMailboxName(t *testing.T) {
+	// mailboxes named like the files of a mailbox directory must not collide with them
+	for name, want := range map[string]string{
+		"INBOX/mailbox.json":   "INBOX/mailbox%2Ejson",
+		"INBOX/snapshots.json": "INBOX/snapshots%2Ejson",
+		"INBOX/a.eml":          "INBOX/a%2Eeml",
+		"INBOX/notes.json":     "INBOX/notes.json",
+		".hidden/ ":            "%2Ehidden/%20",
+		"INBOX//Sent":          "INBOX/%/Sent",
+	} {
+		got := escapeMailboxName(name, "/")
+		if got != want {
+			t.Fatalf("%s: expected %q, got %q", name, want, got)
+		}
+		back, err := unescapeMailboxName(got, "/")
+		if err != nil || back != name {
+			t.Fatalf("%s: unescaped to %q, %v", name, back, err)
+		}
+	}
+}
@@ -1,23 +1,30 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"os"
-	"path/filepath"
+	"strings"
+	"time"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			os.Exit(cmd(os.Args[2:]))
+		}
+	}
+
 	cfg := &Config{}
-	flag.StringVar(&cfg.Server, "server", "", "the server to use")
-	flag.StringVar(&cfg.Login, "login", "", "the login")
-	flag.StringVar(&cfg.Password, "password", "", "password")
-	flag.IntVar(&cfg.Port, "port", 993, "imap port")
-	flag.BoolVar(&cfg.TLS, "tls", false, "use tls")
-	flag.StringVar(&cfg.Dir, "dir", "", "the target directory to write the mails into")
-	configFile := flag.String("configFile", "", "filename to a batch configuration in json format")
+	addAccountFlags(flag.CommandLine, cfg)
+	flag.IntVar(&cfg.Concurrency, "concurrency", 1, "number of parallel connections")
+	flag.BoolVar(&cfg.DryRun, "dryRun", false, "only print which mails would be downloaded, without writing anything")
+	flag.DurationVar(&cfg.LockWait, "lockWait", 0, "how long to wait for another run on the same directory, e.g. 10m")
+	configFile := flag.String("configFile", "", "filename to a batch configuration in yaml, json or toml format")
+	reportFile := flag.String("report", "", "filename to write a json report of the run into")
+	metricsFile := flag.String("metricsFile", "", "filename to write prometheus metrics of the run into, e.g. for the textfile collector")
+	logLevel := flag.String("logLevel", "info", "the minimum log level: debug, info, warn or error")
+	logFormat := flag.String("logFormat", "text", "the log format: text or json")
 	help := flag.Bool("help", false, "shows this help")
 
 	srcCfg := &SearchConfig{}
@@ -31,59 +38,203 @@ func main() {
 		return
 	}
 
+	level, err := ParseLevel(*logLevel)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	logger.SetLevel(level)
+	if err := logger.SetFormat(*logFormat); err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
+	handleSignals()
 	if len(srcCfg.Dir) > 0 {
 		searchMode(srcCfg)
 		return
 	}
 
+	run := NewRunReport(*reportFile)
+	run.DryRun = cfg.DryRun
 	if len(*configFile) == 0 {
-		singleMode(cfg)
+		if err := cfg.Validate(); err != nil {
+			logger.Error("invalid account", "err", err)
+			os.Exit(2)
+		}
+		err = singleMode(cfg, run)
+		if err == errInterrupted {
+			run.PrintSummary(os.Stdout)
+		}
+		saveReport(run)
+		saveMetrics(*metricsFile)
+		if err == errInterrupted {
+			os.Exit(exitInterrupted)
+		}
+		if err != nil {
+			os.Exit(1)
+		}
 	} else {
-		batchMode(*configFile)
+		failed := batchMode(*configFile, run, cfg.LockWait)
+		run.PrintSummary(os.Stdout)
+		saveReport(run)
+		saveMetrics(*metricsFile)
+		if isInterrupted() {
+			os.Exit(exitInterrupted)
+		}
+		if failed > 0 {
+			// distinct from a single account failure, the other accounts have been archived
+			os.Exit(4)
+		}
 	}
 
-	fmt.Println("archive completed")
+	if cfg.DryRun {
+		logger.Info("dry run completed")
+		return
+	}
+	logger.Info("archive completed")
+}
+
+func saveReport(run *RunReport) {
+	if err := run.Save(); err != nil {
+		logger.Error("failed to save report", "err", err)
+	}
+}
+
+func saveMetrics(fname string) {
+	if len(fname) == 0 {
+		return
+	}
+	if err := metrics.WriteFile(fname); err != nil {
+		logger.Error("failed to save metrics", "err", err)
+	}
 }
 
 func searchMode(cfg *SearchConfig) {
 	search, err := NewSearch(cfg)
 	if err != nil {
-		fmt.Println("failed to init search: %v", err)
+		logger.Error("failed to init search", "err", err)
 		os.Exit(5)
 	}
 	srv := NewServer(search)
 	srv.Start(cfg.Host, cfg.Port)
+	if err := search.Close(); err != nil {
+		logger.Error("failed to close search index", "err", err)
+	}
 }
 
-func batchMode(cfgFile string) {
-	b, err := ioutil.ReadFile(cfgFile)
+// batchMode archives all accounts of the given batch file and returns the number of failed accounts. A failing
+// account does not stop the remaining ones. Afterwards, the configured notifications are sent.
+func batchMode(cfgFile string, run *RunReport, lockWait time.Duration) int {
+	fileCfg := loadConfigOrExit(cfgFile)
+	failed := 0
+	for _, acc := range fileCfg.Accounts {
+		if isInterrupted() {
+			logger.Warn("interrupted, skipping remaining accounts", "account", acc.Name)
+			break
+		}
+		cfg := fileCfg.configFor(acc)
+		cfg.DryRun = run.DryRun
+		cfg.LockWait = lockWait
+		if err := singleMode(cfg, run); err != nil {
+			failed++
+		}
+	}
+	if !run.DryRun {
+		run.Finished = time.Now()
+		run.DurationSeconds = run.Finished.Sub(run.Started).Seconds()
+		fileCfg.Notify.Notify(run)
+	}
+	return failed
+}
+
+// loadConfigOrExit loads the configuration file and exits with code 2, if it cannot be read, or with code 3, if it
+// is invalid.
+func loadConfigOrExit(cfgFile string) *FileConfig {
+	fileCfg, err := LoadConfig(cfgFile)
 	if err != nil {
-		fmt.Printf("cannot read batch file %s: %v\n", cfgFile, err)
+		if errs, ok := err.(ConfigErrors); ok {
+			for _, e := range errs {
+				logger.Error("invalid config", "err", e)
+			}
+			os.Exit(3)
+		}
+		logger.Error("cannot read config", "file", cfgFile, "err", err)
 		os.Exit(2)
 	}
-	accounts := &AccountList{}
-	err = json.Unmarshal(b, accounts)
-	if err != nil {
-		fmt.Printf("cannot decode json config %s: %v", cfgFile, err)
-		os.Exit(3)
+	return fileCfg
+}
+
+// addAccountFlags registers the flags which describe a single account and its target directory.
+func addAccountFlags(flags *flag.FlagSet, cfg *Config) {
+	flags.StringVar(&cfg.Server, "server", "", "the server to use")
+	flags.StringVar(&cfg.Protocol, "protocol", protocolIMAP, "the protocol of the server, imap or pop3")
+	flags.StringVar(&cfg.Login, "login", "", "the login")
+	flags.StringVar(&cfg.Password, "password", "", "password")
+	flags.IntVar(&cfg.Port, "port", 993, "imap port")
+	flags.BoolVar(&cfg.TLS, "tls", false, "use tls")
+	flags.BoolVar(&cfg.StartTLS, "starttls", false, "upgrade a plain connection with starttls")
+	flags.BoolVar(&cfg.InsecureSkipVerify, "insecureSkipVerify", false, "do not verify the server certificate")
+	flags.BoolVar(&cfg.NoCompress, "noCompress", false, "do not compress the connection, even if the server supports it")
+	flags.StringVar(&cfg.Since, "since", "", "only archive mails received at or after the date (yyyy-mm-dd)")
+	flags.StringVar(&cfg.Before, "before", "", "only archive mails received before the date (yyyy-mm-dd)")
+	flags.Var(listValue{&cfg.Include}, "include", "comma separated mailbox patterns to archive, all if empty")
+	flags.Var(listValue{&cfg.Exclude}, "exclude", "comma separated mailbox patterns to ignore")
+	flags.Var(listValue{&cfg.Namespaces}, "namespaces", "comma separated namespaces to archive as well, other and shared")
+	flags.StringVar(&cfg.Dir, "dir", "", "the target directory to write the mails into")
+}
+
+// accountConfigs returns either the accounts of the given configuration file or the single account described by
+// the account flags.
+func accountConfigs(cfg *Config, configFile string) []*Config {
+	if len(configFile) > 0 {
+		fileCfg := loadConfigOrExit(configFile)
+		var res []*Config
+		for _, acc := range fileCfg.Accounts {
+			res = append(res, fileCfg.configFor(acc))
+		}
+		return res
+	}
+	if err := cfg.Validate(); err != nil {
+		logger.Error("invalid account", "err", err)
+		os.Exit(2)
 	}
+	return []*Config{cfg}
+}
+
+// listValue is a flag with comma separated values, ignoring empty entries.
+type listValue struct {
+	dst *[]string
+}
 
-	if accounts.Dir == "." {
-		accounts.Dir = filepath.Dir(cfgFile)
+func (v listValue) String() string {
+	if v.dst == nil {
+		return ""
 	}
+	return strings.Join(*v.dst, ",")
+}
 
-	for _, acc := range accounts.Accounts {
-		cfg := &Config{Account: *acc}
-		cfg.Dir = filepath.Join(accounts.Dir, acc.Name)
-		singleMode(cfg)
+func (v listValue) Set(str string) error {
+	*v.dst = nil
+	for _, s := range strings.Split(str, ",") {
+		s = strings.TrimSpace(s)
+		if len(s) > 0 {
+			*v.dst = append(*v.dst, s)
+		}
 	}
+	return nil
 }
 
-func singleMode(cfg *Config) {
+func singleMode(cfg *Config, run *RunReport) error {
 	app := &App{}
 	err := app.Archive(cfg)
+	run.Accounts = append(run.Accounts, app.Report())
 	if err != nil {
-		fmt.Println("failed to archive:", err)
-		os.Exit(1)
+		logger.Error("failed to archive", "account", cfg.Name, "err", err)
+		return err
 	}
+	report := app.Report()
+	logger.Info("account archived", "account", cfg.Name, "new", report.New, "skipped", report.Skipped,
+		"failed", report.Failed, "bytes", report.Bytes, "duration", report.DurationSeconds)
+	return nil
 }
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// metaFile is the name of the file describing the mailbox in each mailbox directory.
+const metaFile = "mailbox.json"
+
+type MailboxMeta struct {
+	Name      string `json:"name"`
+	Delimiter string `json:"delimiter,omitempty"`
+	// Namespace is set for mailboxes outside of the personal namespace.
+	Namespace   *Namespace `json:"namespace,omitempty"`
+	UIDValidity uint32     `json:"uidValidity,omitempty"`
+	Server      string     `json:"server"`
+	Login       string     `json:"login"`
+	Count       int        `json:"count"`
+	// Messages contains the known details of the archived mails by their header hash.
+	Messages map[string]*MessageMeta `json:"messages,omitempty"`
+}
+
+// MessageMeta contains the details of an archived mail, as reported by the server.
+type MessageMeta struct {
+	InternalDate time.Time `json:"internalDate"`
+	UID          uint32    `json:"uid,omitempty"`
+	Size         uint32    `json:"size,omitempty"`
+	// UIDL is the unique id of mails archived from POP3.
+	UIDL string `json:"uidl,omitempty"`
+}
+
+// add records the details of the given mail.
+func (m *MailboxMeta) add(mail *remoteMail) {
+	if m.Messages == nil {
+		m.Messages = make(map[string]*MessageMeta)
+	}
+	msg := &MessageMeta{
+		InternalDate: mail.msg.InternalDate,
+		UID:          mail.msg.Uid,
+		Size:         mail.msg.Size,
+	}
+	if len(mail.uidl) > 0 {
+		// the uid is only the message number of the session
+		msg.UID = 0
+		msg.UIDL = mail.uidl
+	}
+	m.Messages[mail.hash] = msg
+}
+
+// readMeta reads the mailbox.json of dir from the local file system. A missing file results in an empty meta.
+func readMeta(dir string) (*MailboxMeta, error) {
+	return readStoredMeta(localStorage{}, dir)
+}
+
+// readStoredMeta reads the mailbox.json of dir from the given storage.
+func readStoredMeta(storage Storage, dir string) (*MailboxMeta, error) {
+	meta := &MailboxMeta{}
+	b, err := storage.ReadFile(filepath.Join(dir, metaFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return meta, nil
+		}
+		return meta, fmt.Errorf("failed to read meta: %w", err)
+	}
+	if err := json.Unmarshal(b, meta); err != nil {
+		return meta, fmt.Errorf("failed to decode meta: %w", err)
+	}
+	return meta, nil
+}
+
+func writeMeta(dir string, meta *MailboxMeta) error {
+	return writeStoredMeta(localStorage{}, dir, meta)
+}
+
+func writeStoredMeta(storage Storage, dir string, meta *MailboxMeta) error {
+	b, err := json.MarshalIndent(meta, " ", " ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal: %w", err)
+	}
+	fname := filepath.Join(dir, metaFile)
+	err = storage.WriteFile(fname, b, time.Time{})
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", fname, err)
+	}
+	return nil
+}
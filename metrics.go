@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics is a tiny registry which renders its values in the prometheus text exposition format.
+type Metrics struct {
+	mutex   sync.Mutex
+	metrics []*Metric
+}
+
+// Metric is a named family of samples, distinguished by their label values. Summaries only track sum and count.
+type Metric struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	fn      func() float64
+	mutex   sync.Mutex
+	samples map[string]*sample
+}
+
+type sample struct {
+	labelValues []string
+	value       float64
+	count       uint64
+}
+
+// metrics is the process wide registry, served at /metrics and written by -metricsFile.
+var metrics = &Metrics{}
+
+var (
+	metricSaved = metrics.Counter("imaparc_archive_messages_saved_total",
+		"Number of mails downloaded into the archive.", "account")
+	metricBytes = metrics.Counter("imaparc_archive_bytes_total",
+		"Number of bytes downloaded into the archive.", "account")
+	metricFailures = metrics.Counter("imaparc_archive_message_failures_total",
+		"Number of mails which could not be downloaded.", "account")
+	metricRuns = metrics.Counter("imaparc_archive_runs_total",
+		"Number of archive runs by result.", "account", "result")
+	metricLastSuccess = metrics.Gauge("imaparc_archive_last_success_timestamp_seconds",
+		"Unix time of the last successful archive run.", "account")
+	metricLastDuration = metrics.Gauge("imaparc_archive_last_run_duration_seconds",
+		"Duration of the last archive run.", "account")
+	metricQueryDuration = metrics.Summary("imaparc_search_query_duration_seconds",
+		"Latency of search queries.")
+)
+
+// register adds the metric. It replaces a metric of the same name, e.g. the gauges of a search index, which has
+// been opened again, so that each name is exposed once.
+func (m *Metrics) register(metric *Metric) *Metric {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	metric.samples = make(map[string]*sample)
+	for i, existing := range m.metrics {
+		if existing.name == metric.name {
+			m.metrics[i] = metric
+			return metric
+		}
+	}
+	m.metrics = append(m.metrics, metric)
+	return metric
+}
+
+func (m *Metrics) Counter(name, help string, labels ...string) *Metric {
+	return m.register(&Metric{name: name, help: help, kind: "counter", labels: labels})
+}
+
+func (m *Metrics) Gauge(name, help string, labels ...string) *Metric {
+	return m.register(&Metric{name: name, help: help, kind: "gauge", labels: labels})
+}
+
+func (m *Metrics) Summary(name, help string, labels ...string) *Metric {
+	return m.register(&Metric{name: name, help: help, kind: "summary", labels: labels})
+}
+
+// GaugeFunc registers a gauge without labels, whose value is evaluated on each exposition.
+func (m *Metrics) GaugeFunc(name, help string, fn func() float64) *Metric {
+	return m.register(&Metric{name: name, help: help, kind: "gauge", fn: fn})
+}
+
+func (m *Metric) sample(labelValues []string) *sample {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values but got %d", m.name, len(m.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := m.samples[key]
+	if !ok {
+		s = &sample{labelValues: append([]string(nil), labelValues...)}
+		m.samples[key] = s
+	}
+	return s
+}
+
+// Add increments a counter by the given value.
+func (m *Metric) Add(v float64, labelValues ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.sample(labelValues).value += v
+}
+
+// Set replaces the value of a gauge.
+func (m *Metric) Set(v float64, labelValues ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.sample(labelValues).value = v
+}
+
+// Observe adds a single observation to a summary.
+func (m *Metric) Observe(v float64, labelValues ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	s := m.sample(labelValues)
+	s.value += v
+	s.count++
+}
+
+// WriteTo renders all metrics in the prometheus text format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mutex.Lock()
+	all := append([]*Metric(nil), m.metrics...)
+	m.mutex.Unlock()
+
+	sb := &strings.Builder{}
+	for _, metric := range all {
+		metric.write(sb)
+	}
+	n, err := io.WriteString(w, sb.String())
+	return int64(n), err
+}
+
+func (m *Metric) write(sb *strings.Builder) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.fn == nil && len(m.samples) == 0 {
+		return
+	}
+	fmt.Fprintf(sb, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(sb, "# TYPE %s %s\n", m.name, m.kind)
+	if m.fn != nil {
+		fmt.Fprintf(sb, "%s %s\n", m.name, formatFloat(m.fn()))
+		return
+	}
+
+	keys := make([]string, 0, len(m.samples))
+	for k := range m.samples {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := m.samples[k]
+		labels := formatLabels(m.labels, s.labelValues)
+		if m.kind == "summary" {
+			fmt.Fprintf(sb, "%s_sum%s %s\n", m.name, labels, formatFloat(s.value))
+			fmt.Fprintf(sb, "%s_count%s %d\n", m.name, labels, s.count)
+		} else {
+			fmt.Fprintf(sb, "%s%s %s\n", m.name, labels, formatFloat(s.value))
+		}
+	}
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	sb := &strings.Builder{}
+	sb.WriteString("{")
+	for i, name := range names {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		sb.WriteString(name)
+		sb.WriteString("=\"")
+		v := strings.ReplaceAll(values[i], `\`, `\\`)
+		v = strings.ReplaceAll(v, "\n", `\n`)
+		v = strings.ReplaceAll(v, `"`, `\"`)
+		sb.WriteString(v)
+		sb.WriteString("\"")
+	}
+	sb.WriteString("}")
+	return sb.String()
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if _, err := m.WriteTo(w); err != nil {
+		logger.Warn("failed to write metrics", "err", err)
+	}
+}
+
+// WriteFile renders the metrics into the given file, e.g. for the node exporter textfile collector. The file is
+// replaced atomically, so that a collector never sees a partial file.
+func (m *Metrics) WriteFile(fname string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(fname), filepath.Base(fname)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	_, err = m.WriteTo(tmp)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write metrics: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to close metrics: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("failed to chmod metrics: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), fname); err != nil {
+		return fmt.Errorf("failed to rename metrics: %w", err)
+	}
+	return nil
+}
+
+// recordArchiveMetrics updates the archive metrics after a run of an account. The status is used to report the
+// last success timestamp also for failed runs.
+func recordArchiveMetrics(report *AccountReport, status *AccountStatus) {
+	metricSaved.Add(float64(report.New), report.Name)
+	metricBytes.Add(float64(report.Bytes), report.Name)
+	metricFailures.Add(float64(report.Failed), report.Name)
+	metricLastDuration.Set(report.DurationSeconds, report.Name)
+	if report.Success {
+		metricRuns.Add(1, report.Name, "success")
+	} else {
+		metricRuns.Add(1, report.Name, "failure")
+	}
+	if status != nil && !status.LastSuccess.IsZero() {
+		metricLastSuccess.Set(float64(status.LastSuccess.UnixNano())/float64(time.Second), report.Name)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// migrateDirs moves mailbox directories, which older versions named by sanitize, to the location of
+// mailboxDir. A directory is only moved, if its meta belongs to the mailbox, because the old naming mapped
+// different mailboxes to the same directory. Mailboxes of other namespaces, which have been archived like personal
+// mailboxes before, are moved into the directory of their namespace. In a dry run, the moves are only logged.
+func (a *App) migrateDirs() error {
+	for _, mb := range a.mailboxes {
+		legacyDir := a.legacyDir(mb.Name)
+		if len(legacyDir) == 0 {
+			continue
+		}
+		targetDir := a.mailboxDir(mb.Name)
+		if ok, err := a.storage.Exists(filepath.Join(targetDir, metaFile)); err != nil || ok {
+			logger.Warn("cannot migrate mailbox directory, target exists", "account", a.cfg.Name, "mailbox", mb.Name,
+				"dir", legacyDir, "target", targetDir)
+			continue
+		}
+		if a.cfg.DryRun {
+			logger.Info("would migrate mailbox directory", "account", a.cfg.Name, "mailbox", mb.Name, "dir", legacyDir, "target", targetDir)
+			continue
+		}
+		if err := a.storage.Rename(legacyDir, targetDir); err != nil {
+			return fmt.Errorf("failed to migrate %s to %s: %w", legacyDir, targetDir, err)
+		}
+		logger.Info("migrated mailbox directory", "account", a.cfg.Name, "mailbox", mb.Name, "dir", legacyDir, "target", targetDir)
+	}
+	return nil
+}
+
+// legacyDir returns the directory, in which an older version archived the given mailbox, or an empty string, if
+// there is none to migrate.
+func (a *App) legacyDir(mailbox string) string {
+	legacyDir := filepath.Join(a.cfg.Dir, sanitize(mailbox))
+	if a.namespaces[mailbox] != nil {
+		if ok, _ := a.storage.Exists(filepath.Join(legacyDir, metaFile)); !ok {
+			legacyDir = filepath.Join(a.cfg.Dir, escapeMailboxName(mailbox, a.delimiters[mailbox]))
+		}
+	}
+	if legacyDir == a.mailboxDir(mailbox) {
+		return ""
+	}
+	if ok, err := a.storage.Exists(filepath.Join(legacyDir, metaFile)); err != nil || !ok {
+		return ""
+	}
+	meta, err := readStoredMeta(a.storage, legacyDir)
+	if err != nil {
+		logger.Warn("cannot migrate mailbox directory", "account", a.cfg.Name, "mailbox", mailbox, "dir", legacyDir, "err", err)
+		return ""
+	}
+	if meta.Name != mailbox {
+		return ""
+	}
+	return legacyDir
+}
+
+// sanitize is the lossy mailbox naming of older versions, which replaced everything but ASCII letters and digits
+// by '_'.
+func sanitize(str string) string {
+	sb := &strings.Builder{}
+	for _, r := range str {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			sb.WriteRune(r)
+		} else {
+			sb.WriteByte('_')
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	imap2 "github.com/emersion/go-imap"
+)
+
+func TestLegacyDir(t *testing.T) {
+	dir := t.TempDir()
+	storage := localStorage{}
+	if err := writeStoredMeta(storage, filepath.Join(dir, "INBOX_Sent"), &MailboxMeta{Name: "INBOX/Sent"}); err != nil {
+		t.Fatal(err)
+	}
+	// the old naming mapped both mailboxes to INBOX_Sent, only the one of the meta is migrated
+	a := &App{cfg: &Config{Account: Account{Name: "alice"}, Dir: dir}, storage: storage,
+		mailboxes:  []*imap2.MailboxStatus{{Name: "INBOX/Sent"}, {Name: "INBOX.Sent"}, {Name: "INBOX"}},
+		delimiters: map[string]string{"INBOX/Sent": "/", "INBOX.Sent": ".", "INBOX": "/"}}
+	for mailbox, want := range map[string]string{"INBOX/Sent": filepath.Join(dir, "INBOX_Sent"), "INBOX.Sent": "",
+		"INBOX": ""} {
+		if got := a.legacyDir(mailbox); got != want {
+			t.Fatalf("%s: expected %q, got %q", mailbox, want, got)
+		}
+	}
+
+	if err := a.migrateDirs(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := storage.Exists(filepath.Join(a.mailboxDir("INBOX/Sent"), metaFile)); !ok {
+		t.Fatal("expected the migrated meta")
+	}
+	if got := a.legacyDir("INBOX/Sent"); got != "" {
+		t.Fatalf("nothing left to migrate, got %q", got)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-imap/utf7"
+)
+
+// The kinds of namespaces defined by RFC 2342. The personal namespace contains the mailboxes of the account, the
+// other namespace the mailboxes of other users shared with the account and the shared namespace public folders.
+const (
+	namespacePersonal = "personal"
+	namespaceOther    = "other"
+	namespaceShared   = "shared"
+)
+
+// Namespace is a part of the mailbox hierarchy of a server, as reported by the NAMESPACE command.
+type Namespace struct {
+	Kind      string `json:"kind"`
+	Prefix    string `json:"prefix"`
+	Delimiter string `json:"delimiter,omitempty"`
+	// Dir is the directory of the namespace within the account directory, e.g. #shared/Shared. Mailboxes of the
+	// personal namespace are kept directly in the account directory.
+	Dir string `json:"dir,omitempty"`
+}
+
+// namespaceSource is implemented by sources, which may provide mailboxes outside of the personal namespace.
+type namespaceSource interface {
+	Source
+	// Namespaces returns the namespaces of the server or nil, if the server does not support them.
+	Namespaces() ([]*Namespace, error)
+	// MailboxesOf lists the mailboxes of the given namespace.
+	MailboxesOf(ns *Namespace) ([]*imap.MailboxInfo, error)
+}
+
+// mailboxPath returns the directory of the mailbox relative to the account directory. The prefix of a namespace
+// is replaced by the directory of the namespace. A nil namespace is the personal one.
+func (ns *Namespace) mailboxPath(name, delimiter string) string {
+	if ns == nil || ns.Kind == namespacePersonal {
+		return escapeMailboxName(name, delimiter)
+	}
+	return filepath.Join(ns.Dir, escapeMailboxName(strings.TrimPrefix(name, ns.Prefix), delimiter))
+}
+
+// namespaceDir derives the directory of a namespace from its kind and prefix, e.g. #other/Other Users for the
+// prefix "Other Users/". It does not depend on the order or the number of namespaces reported by the server.
+func namespaceDir(ns *Namespace) string {
+	if ns.Kind == namespacePersonal {
+		return ""
+	}
+	prefix := strings.TrimSuffix(ns.Prefix, ns.Delimiter)
+	return filepath.Join("#"+ns.Kind, escapeMailboxName(prefix, ns.Delimiter))
+}
+
+// contains returns true, if the mailbox belongs to the namespace.
+func (ns *Namespace) contains(name string) bool {
+	return len(ns.Prefix) > 0 && strings.HasPrefix(name, ns.Prefix)
+}
+
+// namespaceOf returns the namespace with the longest prefix of the mailbox or nil.
+func namespaceOf(namespaces []*Namespace, name string) *Namespace {
+	var res *Namespace
+	for _, ns := range namespaces {
+		if ns.contains(name) && (res == nil || len(ns.Prefix) > len(res.Prefix)) {
+			res = ns
+		}
+	}
+	return res
+}
+
+// validNamespaceKind returns true for the kinds, which can be archived in addition to the personal namespace.
+func validNamespaceKind(kind string) bool {
+	return kind == namespaceOther || kind == namespaceShared
+}
+
+type namespaceCmd struct{}
+
+func (namespaceCmd) Command() *imap.Command {
+	return &imap.Command{Name: "NAMESPACE"}
+}
+
+// namespaceResp parses the untagged NAMESPACE response, which contains the personal, other and shared namespaces,
+// each either NIL or a list of prefix and delimiter pairs.
+type namespaceResp struct {
+	namespaces []*Namespace
+}
+
+func (r *namespaceResp) Handle(resp imap.Resp) error {
+	name, fields, ok := imap.ParseNamedResp(resp)
+	if !ok || name != "NAMESPACE" {
+		return responses.ErrUnhandled
+	}
+	dec := utf7.Encoding.NewDecoder()
+	for i, kind := range []string{namespacePersonal, namespaceOther, namespaceShared} {
+		if i >= len(fields) {
+			break
+		}
+		list, ok := fields[i].([]interface{})
+		if !ok {
+			continue
+		}
+		for _, field := range list {
+			desc, ok := field.([]interface{})
+			if !ok || len(desc) == 0 {
+				return fmt.Errorf("invalid %s namespace: %v", kind, field)
+			}
+			prefix, err := imap.ParseString(desc[0])
+			if err != nil {
+				return fmt.Errorf("invalid %s namespace prefix: %w", kind, err)
+			}
+			if decoded, err := dec.String(prefix); err == nil {
+				prefix = decoded
+			}
+			ns := &Namespace{Kind: kind, Prefix: prefix}
+			if len(desc) > 1 && desc[1] != nil {
+				if ns.Delimiter, err = imap.ParseString(desc[1]); err != nil {
+					return fmt.Errorf("invalid %s namespace delimiter: %w", kind, err)
+				}
+			}
+			r.namespaces = append(r.namespaces, ns)
+		}
+	}
+	return nil
+}
+
+// Namespaces queries the namespaces of the server.
+func (i *Imap) Namespaces() ([]*Namespace, error) {
+	ok, err := i.client.Support("NAMESPACE")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query capabilities: %w", err)
+	}
+	if !ok {
+		return nil, nil
+	}
+	res := &namespaceResp{}
+	status, err := i.client.Execute(namespaceCmd{}, res)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query namespaces: %w", err)
+	}
+	if err := status.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query namespaces: %w", err)
+	}
+	for _, ns := range res.namespaces {
+		ns.Dir = namespaceDir(ns)
+	}
+	return res.namespaces, nil
+}
+
+// MailboxesOf lists the mailboxes below the prefix of the namespace.
+func (i *Imap) MailboxesOf(ns *Namespace) ([]*imap.MailboxInfo, error) {
+	return i.list(ns.Prefix + "*")
+}
+
+// listMailboxes lists the mailboxes of the personal namespace and of the namespaces enabled for the account.
+// Mailboxes, which belong to an enabled namespace, are assigned to it, so that they are kept in its directory.
+// Mailboxes of other namespaces, which the server lists with the personal ones, are kept as before, like
+// personal mailboxes.
+func (a *App) listMailboxes(srv Source) ([]*imap.MailboxInfo, error) {
+	cfg := a.cfg
+	a.namespaces = make(map[string]*Namespace)
+	mailboxes, err := srv.Mailboxes()
+	if err != nil {
+		return nil, err
+	}
+	nsSrv, ok := srv.(namespaceSource)
+	if !ok {
+		return mailboxes, nil
+	}
+	namespaces, err := nsSrv.Namespaces()
+	if err != nil {
+		return nil, err
+	}
+	enabled := make(map[string]bool)
+	for _, kind := range cfg.Namespaces {
+		enabled[kind] = true
+	}
+
+	var res []*imap.MailboxInfo
+	listed := make(map[string]bool)
+	for _, mb := range mailboxes {
+		ns := namespaceOf(namespaces, mb.Name)
+		if ns != nil && enabled[ns.Kind] {
+			// listed below with the mailboxes of its namespace
+			continue
+		}
+		listed[mb.Name] = true
+		res = append(res, mb)
+	}
+	for _, ns := range namespaces {
+		if ns.Kind == namespacePersonal || len(ns.Prefix) == 0 {
+			continue
+		}
+		if !enabled[ns.Kind] {
+			logger.Info("ignoring namespace", "account", cfg.Name, "kind", ns.Kind, "prefix", ns.Prefix)
+			continue
+		}
+		nsMailboxes, err := nsSrv.MailboxesOf(ns)
+		if err != nil {
+			return nil, err
+		}
+		for _, mb := range nsMailboxes {
+			if listed[mb.Name] || namespaceOf(namespaces, mb.Name) != ns {
+				continue
+			}
+			if hasAttr(mb.Attributes, imap.NoSelectAttr) {
+				// e.g. the directory of another user
+				continue
+			}
+			listed[mb.Name] = true
+			a.namespaces[mb.Name] = ns
+			res = append(res, mb)
+		}
+	}
+	return res, nil
+}
+
+func hasAttr(attrs []string, attr string) bool {
+	for _, a := range attrs {
+		if strings.EqualFold(a, attr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// namespaceTestSource lists mailboxes and namespaces like a server, which reports its shared folders with the
+// personal mailboxes. Nothing else is supported.
+type namespaceTestSource struct {
+	Source
+	mailboxes  []string
+	namespaces []*Namespace
+}
+
+func (s *namespaceTestSource) Mailboxes() ([]*imap.MailboxInfo, error) {
+	var res []*imap.MailboxInfo
+	for _, name := range s.mailboxes {
+		res = append(res, &imap.MailboxInfo{Name: name, Delimiter: "/"})
+	}
+	return res, nil
+}
+
+func (s *namespaceTestSource) Namespaces() ([]*Namespace, error) {
+	return s.namespaces, nil
+}
+
+func (s *namespaceTestSource) MailboxesOf(ns *Namespace) ([]*imap.MailboxInfo, error) {
+	res := []*imap.MailboxInfo{{Name: "Other Users/bob", Attributes: []string{imap.NoSelectAttr}, Delimiter: "/"}}
+	for _, name := range append(s.mailboxes, "Other Users/bob/INBOX") {
+		if strings.HasPrefix(name, ns.Prefix) {
+			res = append(res, &imap.MailboxInfo{Name: name, Delimiter: "/"})
+		}
+	}
+	return res, nil
+}
+
+func testNamespaces() []*Namespace {
+	namespaces := []*Namespace{
+		{Kind: namespacePersonal, Delimiter: "/"},
+		{Kind: namespaceOther, Prefix: "Other Users/", Delimiter: "/"},
+		{Kind: namespaceShared, Prefix: "Shared/", Delimiter: "/"},
+		{Kind: namespaceShared, Prefix: "#public/", Delimiter: "/"},
+	}
+	for _, ns := range namespaces {
+		ns.Dir = namespaceDir(ns)
+	}
+	return namespaces
+}
+
+func TestNamespaceDir(t *testing.T) {
+	var dirs []string
+	for _, ns := range testNamespaces() {
+		dirs = append(dirs, filepath.ToSlash(ns.Dir))
+	}
+	want := []string{"", "#other/Other Users", "#shared/Shared", "#shared/%23public"}
+	if strings.Join(dirs, ",") != strings.Join(want, ",") {
+		t.Fatalf("unexpected directories %q", dirs)
+	}
+
+	// the directories do not depend on the order of the namespaces
+	ns := &Namespace{Kind: namespaceShared, Prefix: "#public.", Delimiter: "."}
+	if dir := filepath.ToSlash(namespaceDir(ns)); dir != "#shared/%23public" {
+		t.Fatalf("unexpected directory %s", dir)
+	}
+}
+
+func TestListMailboxesKeepsNamespacesUnlessEnabled(t *testing.T) {
+	srv := &namespaceTestSource{mailboxes: []string{"INBOX", "Shared/Team"}, namespaces: testNamespaces()}
+	dir := t.TempDir()
+	a := &App{cfg: &Config{Account: Account{Name: "alice"}, Dir: dir}, storage: localStorage{},
+		delimiters: map[string]string{"INBOX": "/", "Shared/Team": "/"}}
+
+	mailboxes, err := a.listMailboxes(srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := mailboxNames(mailboxes); names != "INBOX,Shared/Team" || len(a.namespaces) != 0 {
+		t.Fatalf("expected the listing of older versions, got %s %v", names, a.namespaces)
+	}
+	legacyDir := a.mailboxDir("Shared/Team")
+	if legacyDir != filepath.Join(dir, "Shared", "Team") {
+		t.Fatalf("unexpected directory %s", legacyDir)
+	}
+	if err := writeStoredMeta(a.storage, legacyDir, &MailboxMeta{Name: "Shared/Team"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.storage.WriteFile(filepath.Join(legacyDir, "a.eml"), []byte("a"), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	a.cfg.Namespaces = []string{namespaceShared, namespaceOther}
+	mailboxes, err = a.listMailboxes(srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := mailboxNames(mailboxes); names != "INBOX,Other Users/bob/INBOX,Shared/Team" {
+		t.Fatalf("unexpected mailboxes %s", names)
+	}
+	a.delimiters["Other Users/bob/INBOX"] = "/"
+	a.mailboxes = nil
+	for _, mb := range mailboxes {
+		a.mailboxes = append(a.mailboxes, &imap.MailboxStatus{Name: mb.Name})
+	}
+	if err := a.migrateDirs(); err != nil {
+		t.Fatal(err)
+	}
+	target := a.mailboxDir("Shared/Team")
+	if target != filepath.Join(dir, "#shared", "Shared", "Team") {
+		t.Fatalf("unexpected directory %s", target)
+	}
+	if ok, _ := a.storage.Exists(filepath.Join(target, "a.eml")); !ok {
+		t.Fatal("expected the archived mail to be moved into the namespace directory")
+	}
+	if ok, _ := a.storage.Exists(legacyDir); ok {
+		t.Fatal("expected the old directory to be moved")
+	}
+}
+
+func mailboxNames(mailboxes []*imap.MailboxInfo) string {
+	var names []string
+	for _, mb := range mailboxes {
+		names = append(names, mb.Name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// NotifyConfig sends the summary of a run by mail and to a webhook.
+type NotifyConfig struct {
+	SMTP    *SMTPNotify    `json:"smtp"`
+	Webhook *WebhookNotify `json:"webhook"`
+}
+
+// SMTPNotify sends the summary as a plain text mail.
+type SMTPNotify struct {
+	Host     string   `json:"host"`
+	Port     int      `json:"port"`
+	TLS      bool     `json:"tls"`
+	StartTLS bool     `json:"starttls"`
+	Login    string   `json:"login"`
+	Password string   `json:"password"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+	// Subject and Body are text templates of the run report. If empty, a default is used.
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+	// OnlyOnFailure only sends a mail, if an account or a mail failed.
+	OnlyOnFailure bool `json:"onlyOnFailure"`
+}
+
+// WebhookNotify posts the summary as json.
+type WebhookNotify struct {
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	// Body is a text template of the run report. If empty, the report is posted as json.
+	Body string `json:"body"`
+	// OnlyOnFailure only posts, if an account or a mail failed.
+	OnlyOnFailure bool `json:"onlyOnFailure"`
+}
+
+const defaultNotifySubject = `imaparc: {{ .FailedAccounts }} of {{ len .Accounts }} accounts failed, {{ .New }} new mails`
+
+const defaultNotifyBody = `{{ .Summary }}
+{{- range .Accounts }}{{ if .Errors }}
+{{ .Name }}:
+{{- range .Errors }}
+  {{ . }}
+{{- end }}
+{{ end }}{{ end }}`
+
+var notifyFuncs = template.FuncMap{"formatSize": formatSize}
+
+// Validate checks the notifications for obviously invalid settings and templates.
+func (c *NotifyConfig) Validate() error {
+	if m := c.SMTP; m != nil {
+		if len(m.Host) == 0 {
+			return fmt.Errorf("smtp: host is required")
+		}
+		if len(m.From) == 0 || len(m.To) == 0 {
+			return fmt.Errorf("smtp: from and to are required")
+		}
+		if m.TLS && m.StartTLS {
+			return fmt.Errorf("smtp: tls and starttls are exclusive")
+		}
+		for _, tpl := range []string{m.Subject, m.Body} {
+			if _, err := template.New("").Funcs(notifyFuncs).Parse(tpl); err != nil {
+				return fmt.Errorf("smtp: invalid template: %w", err)
+			}
+		}
+	}
+	if w := c.Webhook; w != nil {
+		u, err := url.Parse(w.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("webhook: invalid url '%s'", w.URL)
+		}
+		if _, err := template.New("").Funcs(notifyFuncs).Parse(w.Body); err != nil {
+			return fmt.Errorf("webhook: invalid template: %w", err)
+		}
+	}
+	return nil
+}
+
+// notifyModel is passed to the templates. Besides the fields of the report, it provides totals and the summary
+// table.
+type notifyModel struct {
+	*RunReport
+	FailedAccounts int
+	New            int
+	FailedMails    int
+	Bytes          int64
+	Summary        string
+}
+
+func newNotifyModel(run *RunReport) *notifyModel {
+	m := &notifyModel{RunReport: run, FailedAccounts: run.Failed()}
+	for _, acc := range run.Accounts {
+		m.New += acc.New
+		m.FailedMails += acc.Failed
+		m.Bytes += acc.Bytes
+	}
+	sb := &strings.Builder{}
+	run.writeSummary(sb)
+	m.Summary = sb.String()
+	return m
+}
+
+// Notify sends the summary of the run to all configured channels. Failures are logged and do not affect the run.
+func (c *NotifyConfig) Notify(run *RunReport) {
+	if c == nil {
+		return
+	}
+	model := newNotifyModel(run)
+	failed := model.FailedAccounts > 0 || model.FailedMails > 0
+	if c.SMTP != nil && (failed || !c.SMTP.OnlyOnFailure) {
+		if err := c.SMTP.send(model); err != nil {
+			logger.Error("cannot send notification mail", "host", c.SMTP.Host, "err", err)
+		} else {
+			logger.Info("notification mail sent", "to", strings.Join(c.SMTP.To, ","))
+		}
+	}
+	if c.Webhook != nil && (failed || !c.Webhook.OnlyOnFailure) {
+		if err := c.Webhook.post(model); err != nil {
+			logger.Error("cannot notify webhook", "url", c.Webhook.URL, "err", err)
+		} else {
+			logger.Info("webhook notified", "url", c.Webhook.URL)
+		}
+	}
+}
+
+func executeTemplate(tpl, def string, model *notifyModel) (string, error) {
+	if len(tpl) == 0 {
+		tpl = def
+	}
+	t, err := template.New("notify").Funcs(notifyFuncs).Parse(tpl)
+	if err != nil {
+		return "", err
+	}
+	sb := &strings.Builder{}
+	if err := t.Execute(sb, model); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+func (m *SMTPNotify) send(model *notifyModel) error {
+	subject, err := executeTemplate(m.Subject, defaultNotifySubject, model)
+	if err != nil {
+		return fmt.Errorf("invalid subject: %w", err)
+	}
+	body, err := executeTemplate(m.Body, defaultNotifyBody, model)
+	if err != nil {
+		return fmt.Errorf("invalid body: %w", err)
+	}
+
+	msg := &bytes.Buffer{}
+	fmt.Fprintf(msg, "From: %s\r\n", m.From)
+	fmt.Fprintf(msg, "To: %s\r\n", strings.Join(m.To, ", "))
+	fmt.Fprintf(msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", strings.TrimSpace(subject)))
+	fmt.Fprintf(msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	qp := quotedprintable.NewWriter(msg)
+	qp.Write([]byte(strings.ReplaceAll(body, "\n", "\r\n")))
+	qp.Close()
+
+	port := m.Port
+	if port == 0 {
+		port = 25
+		if m.TLS {
+			port = 465
+		}
+	}
+	addr := net.JoinHostPort(m.Host, strconv.Itoa(port))
+	var conn net.Conn
+	if m.TLS {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: 30 * time.Second}, "tcp", addr, &tls.Config{ServerName: m.Host})
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, 30*time.Second)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot connect: %w", err)
+	}
+	client, err := smtp.NewClient(conn, m.Host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("cannot connect: %w", err)
+	}
+	defer client.Close()
+	if m.StartTLS {
+		if err := client.StartTLS(&tls.Config{ServerName: m.Host}); err != nil {
+			return fmt.Errorf("starttls failed: %w", err)
+		}
+	}
+	if len(m.Login) > 0 {
+		if err := client.Auth(smtp.PlainAuth("", m.Login, m.Password, m.Host)); err != nil {
+			return fmt.Errorf("authentication failed: %w", err)
+		}
+	}
+	if err := client.Mail(m.From); err != nil {
+		return err
+	}
+	for _, to := range m.To {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg.Bytes()); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+func (w *WebhookNotify) post(model *notifyModel) error {
+	var body []byte
+	if len(w.Body) == 0 {
+		b, err := json.Marshal(model.RunReport)
+		if err != nil {
+			return fmt.Errorf("failed to marshal report: %w", err)
+		}
+		body = b
+	} else {
+		str, err := executeTemplate(w.Body, "", model)
+		if err != nil {
+			return fmt.Errorf("invalid body: %w", err)
+		}
+		body = []byte(str)
+	}
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range w.Headers {
+		req.Header.Set(name, value)
+	}
+	res, err := (&http.Client{Timeout: 30 * time.Second}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("unexpected status %s: %s", res.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
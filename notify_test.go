@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpTestMail is a mail received by the smtp stand-in.
+type smtpTestMail struct {
+	auth string
+	from string
+	to   []string
+	data string
+}
+
+// smtpTestServer accepts mails on a local port and passes them to the returned channel.
+func smtpTestServer(t *testing.T) (int, chan *smtpTestMail) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	mails := make(chan *smtpTestMail, 4)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSMTP(conn, mails)
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).Port, mails
+}
+
+func serveSMTP(conn net.Conn, mails chan *smtpTestMail) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	fmt.Fprintf(conn, "220 localhost ESMTP\r\n")
+	m := &smtpTestMail{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSpace(line)
+		cmd := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"):
+			fmt.Fprintf(conn, "250-localhost\r\n250 AUTH PLAIN\r\n")
+		case strings.HasPrefix(cmd, "AUTH PLAIN "):
+			b, _ := base64.StdEncoding.DecodeString(line[len("AUTH PLAIN "):])
+			m.auth = string(b)
+			fmt.Fprintf(conn, "235 ok\r\n")
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			m.from = strings.Trim(line[len("MAIL FROM:"):], "<>")
+			fmt.Fprintf(conn, "250 ok\r\n")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			m.to = append(m.to, strings.Trim(line[len("RCPT TO:"):], "<>"))
+			fmt.Fprintf(conn, "250 ok\r\n")
+		case cmd == "DATA":
+			fmt.Fprintf(conn, "354 go ahead\r\n")
+			sb := &strings.Builder{}
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				sb.WriteString(strings.TrimPrefix(line, "."))
+			}
+			m.data = sb.String()
+			mails <- m
+			m = &smtpTestMail{}
+			fmt.Fprintf(conn, "250 queued\r\n")
+		case cmd == "QUIT":
+			fmt.Fprintf(conn, "221 bye\r\n")
+			return
+		default:
+			fmt.Fprintf(conn, "250 ok\r\n")
+		}
+	}
+}
+
+// webhookTestServer passes the headers and bodies of the posted requests to the returned channel.
+func webhookTestServer(t *testing.T) (string, chan *http.Request) {
+	posts := make(chan *http.Request, 4)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		r.Body = ioutil.NopCloser(strings.NewReader(string(b)))
+		posts <- r
+		if r.Header.Get("X-Token") == "invalid" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("invalid token"))
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return ts.URL, posts
+}
+
+func testRunReport(failed bool) *RunReport {
+	run := &RunReport{Started: time.Now(), Finished: time.Now()}
+	run.Accounts = append(run.Accounts, &AccountReport{Name: "alice", Success: true, New: 3, Bytes: 4096})
+	if failed {
+		run.Accounts = append(run.Accounts, &AccountReport{Name: "bob", New: 1, Failed: 2,
+			Errors: []string{"cannot login: invalid credentials"}})
+	}
+	return run
+}
+
+func TestSMTPNotify(t *testing.T) {
+	port, mails := smtpTestServer(t)
+	m := &SMTPNotify{Host: "127.0.0.1", Port: port, Login: "archiver", Password: "secret", From: "imaparc@example.com",
+		To: []string{"admin@example.com", "ops@example.com"}}
+	if err := m.send(newNotifyModel(testRunReport(true))); err != nil {
+		t.Fatal(err)
+	}
+	received := <-mails
+	if received.auth != "\x00archiver\x00secret" || received.from != "imaparc@example.com" ||
+		strings.Join(received.to, ",") != "admin@example.com,ops@example.com" {
+		t.Fatalf("unexpected envelope %+v", received)
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(received.data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil || subject != "imaparc: 1 of 2 accounts failed, 4 new mails" {
+		t.Fatalf("unexpected subject %q: %v", subject, err)
+	}
+	body, err := ioutil.ReadAll(quotedprintable.NewReader(msg.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"ACCOUNT", "alice", "FAILED", "bob:\r\n  cannot login: invalid credentials"} {
+		if !strings.Contains(string(body), want) {
+			t.Fatalf("body misses %q:\n%s", want, body)
+		}
+	}
+
+	// custom templates
+	m.Login = ""
+	m.Subject = `{{ .New }} new, {{ formatSize .Bytes }} – Grüße`
+	m.Body = `{{ range .Accounts }}{{ .Name }}={{ .Success }} {{ end }}`
+	if err := m.send(newNotifyModel(testRunReport(false))); err != nil {
+		t.Fatal(err)
+	}
+	received = <-mails
+	msg, err = mail.ReadMessage(strings.NewReader(received.data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, _ = new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	body, _ = ioutil.ReadAll(quotedprintable.NewReader(msg.Body))
+	if received.auth != "" || subject != "3 new, 4 KiB – Grüße" || strings.TrimSuffix(string(body), "\r\n") != "alice=true " {
+		t.Fatalf("unexpected mail %q %q %+v", subject, body, received)
+	}
+
+	m.Body = `{{ .Unknown }}`
+	if err := m.send(newNotifyModel(testRunReport(false))); err == nil || !strings.Contains(err.Error(), "invalid body") {
+		t.Fatalf("expected an invalid body, got %v", err)
+	}
+}
+
+func TestWebhookNotify(t *testing.T) {
+	url, posts := webhookTestServer(t)
+	w := &WebhookNotify{URL: url, Headers: map[string]string{"X-Token": "secret"}}
+	if err := w.post(newNotifyModel(testRunReport(true))); err != nil {
+		t.Fatal(err)
+	}
+	req := <-posts
+	if req.Method != http.MethodPost || req.Header.Get("X-Token") != "secret" ||
+		req.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("unexpected request %s %v", req.Method, req.Header)
+	}
+	report := &RunReport{}
+	if err := json.NewDecoder(req.Body).Decode(report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Accounts) != 2 || report.Accounts[1].Errors[0] != "cannot login: invalid credentials" {
+		t.Fatalf("unexpected report %+v", report)
+	}
+
+	w.Body = `{"text": "{{ .FailedAccounts }} failed, {{ .FailedMails }} mails, {{ formatSize .Bytes }}"}`
+	if err := w.post(newNotifyModel(testRunReport(true))); err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll((<-posts).Body)
+	if string(body) != `{"text": "1 failed, 2 mails, 4 KiB"}` {
+		t.Fatalf("unexpected body %s", body)
+	}
+
+	w.Headers["X-Token"] = "invalid"
+	err := w.post(newNotifyModel(testRunReport(true)))
+	<-posts
+	if err == nil || !strings.Contains(err.Error(), "401") || !strings.Contains(err.Error(), "invalid token") {
+		t.Fatalf("expected the status, got %v", err)
+	}
+}
+
+func TestNotifyOnlyOnFailure(t *testing.T) {
+	port, mails := smtpTestServer(t)
+	url, posts := webhookTestServer(t)
+	cfg := &NotifyConfig{
+		SMTP:    &SMTPNotify{Host: "127.0.0.1", Port: port, From: "imaparc@example.com", To: []string{"admin@example.com"}},
+		Webhook: &WebhookNotify{URL: url},
+	}
+	for _, onlyOnFailure := range []bool{false, true} {
+		cfg.SMTP.OnlyOnFailure, cfg.Webhook.OnlyOnFailure = onlyOnFailure, onlyOnFailure
+		for _, failed := range []bool{false, true} {
+			cfg.Notify(testRunReport(failed))
+			want := failed || !onlyOnFailure
+			// Notify returns after sending, so nothing arrives later
+			select {
+			case <-mails:
+				if !want {
+					t.Fatalf("onlyOnFailure=%v failed=%v: unexpected mail", onlyOnFailure, failed)
+				}
+			default:
+				if want {
+					t.Fatalf("onlyOnFailure=%v failed=%v: mail expected", onlyOnFailure, failed)
+				}
+			}
+			select {
+			case <-posts:
+				if !want {
+					t.Fatalf("onlyOnFailure=%v failed=%v: unexpected post", onlyOnFailure, failed)
+				}
+			default:
+				if want {
+					t.Fatalf("onlyOnFailure=%v failed=%v: post expected", onlyOnFailure, failed)
+				}
+			}
+		}
+	}
+
+	// a failed mail of a successful account is a failure, too
+	run := testRunReport(false)
+	run.Accounts[0].Failed = 1
+	cfg.Notify(run)
+	if len(mails) != 1 || len(posts) != 1 {
+		t.Fatal("expected a notification for a failed mail")
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// pop3Mailbox is the only mailbox of a POP3 account.
+const pop3Mailbox = "INBOX"
+
+// Pop3 is a Source for servers, which only offer POP3. The maildrop is provided as INBOX. Mails are never deleted
+// on the server. Sequence numbers are used as uids, because they are stable within a session, and the UIDL of each
+// mail is used to recognize already archived mails.
+type Pop3 struct {
+	cfg    *Config
+	conn   net.Conn
+	reader *bufio.Reader
+	uidls  map[uint32]string // unique id by message number
+	sizes  map[uint32]uint32 // size by message number
+}
+
+func (p *Pop3) Login(cfg *Config) error {
+	p.cfg = cfg
+	port := cfg.Port
+	if port == 0 {
+		port = 110
+		if cfg.TLS {
+			port = 995
+		}
+	}
+	addr := cfg.Server + ":" + strconv.Itoa(port)
+	logger.Info("connecting", "server", cfg.Server, "port", port, "protocol", protocolPOP3, "tls", cfg.TLS,
+		"starttls", cfg.StartTLS)
+
+	var err error
+	dialer := &net.Dialer{Timeout: time.Minute}
+	if cfg.TLS {
+		p.conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfigFor(cfg))
+	} else {
+		p.conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to connect to server %s: %w", cfg.Server, err)
+	}
+	p.reader = bufio.NewReader(p.conn)
+	if _, err := p.response(); err != nil {
+		p.conn.Close()
+		return fmt.Errorf("unexpected greeting of server %s: %w", cfg.Server, err)
+	}
+
+	if cfg.StartTLS {
+		if _, err := p.cmd("STLS"); err != nil {
+			p.conn.Close()
+			return fmt.Errorf("failed to starttls with server %s: %w", cfg.Server, err)
+		}
+		tlsConn := tls.Client(p.conn, tlsConfigFor(cfg))
+		if err := tlsConn.Handshake(); err != nil {
+			p.conn.Close()
+			return fmt.Errorf("failed to starttls with server %s: %w", cfg.Server, err)
+		}
+		p.conn = tlsConn
+		p.reader = bufio.NewReader(p.conn)
+	}
+
+	logger.Info("connected", "server", cfg.Server)
+
+	if _, err := p.cmd("USER %s", cfg.Login); err != nil {
+		p.Logout()
+		return fmt.Errorf("username or password invalid: %w", err)
+	}
+	if _, err := p.cmd("PASS %s", cfg.Password); err != nil {
+		p.Logout()
+		return fmt.Errorf("username or password invalid: %w", err)
+	}
+	return nil
+}
+
+func (p *Pop3) Logout() error {
+	_, err := p.cmd("QUIT")
+	p.conn.Close()
+	return err
+}
+
+func (p *Pop3) Mailboxes() ([]*imap.MailboxInfo, error) {
+	return []*imap.MailboxInfo{{Name: pop3Mailbox}}, nil
+}
+
+func (p *Pop3) Status(mailbox string) (*imap.MailboxStatus, error) {
+	if err := checkPop3Mailbox(mailbox); err != nil {
+		return nil, err
+	}
+	line, err := p.cmd("STAT")
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat maildrop: %w", err)
+	}
+	var count, size int
+	if _, err := fmt.Sscanf(line, "%d %d", &count, &size); err != nil {
+		return nil, fmt.Errorf("invalid STAT response '%s'", line)
+	}
+	status := imap.NewMailboxStatus(mailbox, []imap.StatusItem{imap.StatusMessages})
+	status.Messages = uint32(count)
+	return status, nil
+}
+
+// Mails lists the mails by LIST and UIDL. Headers are only fetched by TOP, if requested.
+func (p *Pop3) Mails(mailbox string, fetchItem []imap.FetchItem, from, to int) ([]*imap.Message, error) {
+	if err := checkPop3Mailbox(mailbox); err != nil {
+		return nil, err
+	}
+	if err := p.list(); err != nil {
+		return nil, err
+	}
+	headers := false
+	for _, item := range fetchItem {
+		if item == imap.FetchEnvelope || item == imap.FetchRFC822Header {
+			headers = true
+		}
+	}
+
+	var res []*imap.Message
+	for i := from; i <= to; i++ {
+		num := uint32(i)
+		size, ok := p.sizes[num]
+		if !ok {
+			continue
+		}
+		msg := imap.NewMessage(num, fetchItem)
+		msg.Uid = num
+		msg.Size = size
+		msg.Envelope = &imap.Envelope{}
+		if headers {
+			header, err := p.multiline("TOP %d 0", num)
+			if err != nil {
+				// TOP is optional, so fall back to the complete mail
+				full, err := p.multiline("RETR %d", num)
+				if err != nil {
+					return nil, fmt.Errorf("failed to fetch header of mail %d: %w", num, err)
+				}
+				header = headerOf(full)
+			}
+			if !bytes.HasSuffix(header, []byte("\r\n\r\n")) {
+				// like the imap RFC822.HEADER, the header includes the empty line
+				header = append(header, "\r\n"...)
+			}
+			if err := setBody(msg, imap.FetchRFC822Header, header); err != nil {
+				return nil, err
+			}
+			msg.Envelope, msg.InternalDate = envelopeOf(header)
+		}
+		res = append(res, msg)
+	}
+	return res, nil
+}
+
+func (p *Pop3) Mail(mailbox string, num int) (*imap.Message, error) {
+	if err := checkPop3Mailbox(mailbox); err != nil {
+		return nil, err
+	}
+	b, err := p.multiline("RETR %d", num)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch mail %d: %w", num, err)
+	}
+	msg := imap.NewMessage(uint32(num), []imap.FetchItem{imap.FetchRFC822})
+	msg.Uid = uint32(num)
+	if err := setBody(msg, imap.FetchRFC822, b); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (p *Pop3) RawMail(mailbox string, uid uint32) ([]byte, error) {
+	msg, err := p.Mail(mailbox, int(uid))
+	if err != nil {
+		return nil, err
+	}
+	return bodyFor(msg, imap.FetchRFC822)
+}
+
+func (p *Pop3) UIDL(mail *imap.Message) string {
+	return p.uidls[mail.SeqNum]
+}
+
+// list loads the unique ids and sizes of the mails. The maildrop is locked while the session lasts, so this is
+// only done once.
+func (p *Pop3) list() error {
+	if p.sizes != nil {
+		return nil
+	}
+	if err := p.loadUIDLs(); err != nil {
+		return err
+	}
+	b, err := p.multiline("LIST")
+	if err != nil {
+		return fmt.Errorf("failed to list mails: %w", err)
+	}
+	p.sizes = make(map[uint32]uint32)
+	for _, line := range strings.Split(string(b), "\r\n") {
+		var num, size uint32
+		if _, err := fmt.Sscanf(line, "%d %d", &num, &size); err == nil {
+			p.sizes[num] = size
+		}
+	}
+	return nil
+}
+
+func (p *Pop3) loadUIDLs() error {
+	b, err := p.multiline("UIDL")
+	if err != nil {
+		return fmt.Errorf("server does not support UIDL: %w", err)
+	}
+	p.uidls = make(map[uint32]string)
+	for _, line := range strings.Split(string(b), "\r\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		num, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			continue
+		}
+		p.uidls[uint32(num)] = fields[1]
+	}
+	return nil
+}
+
+func checkPop3Mailbox(mailbox string) error {
+	if mailbox != pop3Mailbox {
+		return fmt.Errorf("pop3 only provides %s, not '%s'", pop3Mailbox, mailbox)
+	}
+	return nil
+}
+
+// cmd sends a command and returns the text of the single line response.
+func (p *Pop3) cmd(format string, args ...interface{}) (string, error) {
+	p.conn.SetDeadline(time.Now().Add(5 * time.Minute))
+	if _, err := fmt.Fprintf(p.conn, format+"\r\n", args...); err != nil {
+		return "", err
+	}
+	return p.response()
+}
+
+func (p *Pop3) response() (string, error) {
+	line, err := p.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, "+OK") {
+		return strings.TrimSpace(strings.TrimPrefix(line, "+OK")), nil
+	}
+	return "", fmt.Errorf("server responded '%s'", line)
+}
+
+// multiline sends a command and reads the dot terminated response. Line endings are kept as sent by the server,
+// so that archived mails are byte identical to those of the imap source.
+func (p *Pop3) multiline(format string, args ...interface{}) ([]byte, error) {
+	if _, err := p.cmd(format, args...); err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	for {
+		line, err := p.reader.ReadBytes('\n')
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if bytes.Equal(line, []byte(".\r\n")) || bytes.Equal(line, []byte(".\n")) {
+			return buf.Bytes(), nil
+		}
+		if bytes.HasPrefix(line, []byte("..")) {
+			line = line[1:]
+		}
+		buf.Write(line)
+	}
+}
+
+// headerOf returns the header of a mail including the empty line, which terminates it.
+func headerOf(eml []byte) []byte {
+	if i := bytes.Index(eml, []byte("\r\n\r\n")); i >= 0 {
+		return eml[:i+4]
+	}
+	return eml
+}
+
+// envelopeOf parses the fields of the header shown in logs and returns the date of the mail, which replaces the
+// internal date unknown to POP3.
+func envelopeOf(header []byte) (*imap.Envelope, time.Time) {
+	env := &imap.Envelope{}
+	msg, err := mail.ReadMessage(bytes.NewReader(header))
+	if err != nil {
+		return env, time.Time{}
+	}
+	env.Subject = msg.Header.Get("Subject")
+	env.MessageId = msg.Header.Get("Message-Id")
+	if addrs, err := msg.Header.AddressList("From"); err == nil {
+		for _, addr := range addrs {
+			at := strings.LastIndex(addr.Address, "@")
+			if at < 0 {
+				at = len(addr.Address)
+			}
+			env.From = append(env.From, &imap.Address{
+				PersonalName: addr.Name,
+				MailboxName:  addr.Address[:at],
+				HostName:     strings.TrimPrefix(addr.Address[at:], "@"),
+			})
+		}
+	}
+	date, err := msg.Header.Date()
+	if err == nil {
+		env.Date = date
+	}
+	return env, env.Date
+}
+
+// setBody stores b as the given fetch item, so that bodyFor returns it.
+func setBody(msg *imap.Message, item imap.FetchItem, b []byte) error {
+	section, err := imap.ParseBodySectionName(item)
+	if err != nil {
+		return fmt.Errorf("invalid body section %s: %w", item, err)
+	}
+	msg.Body = map[*imap.BodySectionName]imap.Literal{section: bytes.NewBuffer(b)}
+	return nil
+}
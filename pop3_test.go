@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testTLSConfig returns a server configuration with a self signed certificate for localhost.
+func testTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+type pop3TestMail struct {
+	uidl string
+	eml  string
+}
+
+// pop3TestServer is a POP3 maildrop, which counts the received commands.
+type pop3TestServer struct {
+	port      int
+	tlsConfig *tls.Config // STLS is offered, if set
+	mutex     sync.Mutex
+	mails     []pop3TestMail
+	commands  map[string]int
+	secure    bool // whether the last login happened after STLS
+}
+
+func newPop3TestServer(t *testing.T, tlsConfig *tls.Config, mails ...pop3TestMail) *pop3TestServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	s := &pop3TestServer{port: l.Addr().(*net.TCPAddr).Port, tlsConfig: tlsConfig, mails: mails}
+	s.reset()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+// reset clears the command counters.
+func (s *pop3TestServer) reset() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.commands = make(map[string]int)
+}
+
+func (s *pop3TestServer) count(cmd string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.commands[cmd]
+}
+
+func (s *pop3TestServer) setMails(mails ...pop3TestMail) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.mails = mails
+}
+
+func (s *pop3TestServer) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+	r := bufio.NewReader(conn)
+	secure := false
+	fmt.Fprint(conn, "+OK ready\r\n")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			fmt.Fprint(conn, "-ERR empty command\r\n")
+			continue
+		}
+		cmd := strings.ToUpper(fields[0])
+		s.mutex.Lock()
+		s.commands[cmd]++
+		mails := s.mails
+		s.mutex.Unlock()
+
+		num := 0
+		if len(fields) > 1 {
+			fmt.Sscanf(fields[1], "%d", &num)
+		}
+		switch {
+		case cmd == "STLS" && s.tlsConfig != nil && !secure:
+			fmt.Fprint(conn, "+OK begin tls\r\n")
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, r, secure = tlsConn, bufio.NewReader(tlsConn), true
+		case cmd == "USER":
+			s.mutex.Lock()
+			s.secure = secure
+			s.mutex.Unlock()
+			fmt.Fprint(conn, "+OK\r\n")
+		case cmd == "PASS" && len(fields) == 2 && fields[1] == "secret":
+			fmt.Fprint(conn, "+OK\r\n")
+		case cmd == "STAT":
+			fmt.Fprintf(conn, "+OK %d 0\r\n", len(mails))
+		case cmd == "LIST" || cmd == "UIDL":
+			fmt.Fprint(conn, "+OK\r\n")
+			for i, m := range mails {
+				if cmd == "LIST" {
+					fmt.Fprintf(conn, "%d %d\r\n", i+1, len(m.eml))
+				} else {
+					fmt.Fprintf(conn, "%d %s\r\n", i+1, m.uidl)
+				}
+			}
+			fmt.Fprint(conn, ".\r\n")
+		case (cmd == "TOP" || cmd == "RETR") && num >= 1 && num <= len(mails):
+			eml := mails[num-1].eml
+			if cmd == "TOP" {
+				eml = eml[:strings.Index(eml, "\r\n\r\n")+4]
+			}
+			fmt.Fprint(conn, "+OK\r\n")
+			for _, l := range strings.SplitAfter(eml, "\r\n") {
+				if strings.HasPrefix(l, ".") {
+					l = "." + l
+				}
+				fmt.Fprint(conn, l)
+			}
+			fmt.Fprint(conn, ".\r\n")
+		case cmd == "QUIT":
+			fmt.Fprint(conn, "+OK bye\r\n")
+			return
+		default:
+			fmt.Fprint(conn, "-ERR\r\n")
+		}
+	}
+}
+
+func pop3TestMessage(uidl, subject string) pop3TestMail {
+	return pop3TestMail{uidl: uidl, eml: "From: a@example.com\r\nSubject: " + subject +
+		"\r\nDate: Wed, 11 May 2016 14:31:59 +0000\r\n\r\nbody of " + subject + "\r\n.line with a dot\r\n"}
+}
+
+func (s *pop3TestServer) archive(t *testing.T, cfg *Config) *AccountReport {
+	s.reset()
+	app := &App{}
+	if err := app.Archive(cfg); err != nil {
+		t.Fatal(err)
+	}
+	return app.Report()
+}
+
+func TestPop3UIDL(t *testing.T) {
+	a, b, c := pop3TestMessage("uid-a", "a"), pop3TestMessage("uid-b", "b"), pop3TestMessage("uid-c", "c")
+	srv := newPop3TestServer(t, nil, a, b)
+	cfg := &Config{Account: Account{Name: "pop3", Protocol: protocolPOP3, Server: "127.0.0.1", Port: srv.port,
+		Login: "user", Password: "secret"}, Dir: t.TempDir()}
+
+	report := srv.archive(t, cfg)
+	if report.New != 2 || srv.count("RETR") != 2 {
+		t.Fatalf("expected 2 new mails, got %d with %d RETR", report.New, srv.count("RETR"))
+	}
+	// the header of each unknown mail is fetched without listing the maildrop again
+	if srv.count("TOP") != 2 || srv.count("UIDL") != 1 || srv.count("LIST") != 1 {
+		t.Fatalf("expected one UIDL and LIST for the session, got %v", srv.commands)
+	}
+
+	// known unique ids are neither fetched nor scanned again
+	report = srv.archive(t, cfg)
+	if report.New != 0 || report.Skipped != 2 || srv.count("TOP") != 0 || srv.count("RETR") != 0 {
+		t.Fatalf("expected 2 skipped mails without TOP or RETR, got %+v, %v", report, srv.commands)
+	}
+
+	// a is deleted, so b is renumbered, and c arrives
+	srv.setMails(b, c)
+	report = srv.archive(t, cfg)
+	if report.New != 1 || srv.count("TOP") != 1 || srv.count("RETR") != 1 {
+		t.Fatalf("expected only c to be fetched, got %+v, %v", report, srv.commands)
+	}
+
+	// the server assigned a new unique id to b, whose header hash is archived already
+	b.uidl = "uid-b2"
+	srv.setMails(b, c)
+	report = srv.archive(t, cfg)
+	if report.New != 0 || srv.count("TOP") != 1 || srv.count("RETR") != 0 {
+		t.Fatalf("expected only the header of b to be fetched, got %+v, %v", report, srv.commands)
+	}
+	report = srv.archive(t, cfg)
+	if report.New != 0 || srv.count("TOP") != 0 {
+		t.Fatalf("expected the new unique id of b to be recorded, got %+v, %v", report, srv.commands)
+	}
+}
+
+func TestPop3STLS(t *testing.T) {
+	srv := newPop3TestServer(t, testTLSConfig(t), pop3TestMessage("uid-a", "a"))
+	cfg := &Config{Account: Account{Name: "pop3", Protocol: protocolPOP3, Server: "127.0.0.1", Port: srv.port,
+		Login: "user", Password: "secret", StartTLS: true, InsecureSkipVerify: true}, Dir: t.TempDir()}
+
+	report := srv.archive(t, cfg)
+	if report.New != 1 || srv.count("STLS") != 1 || !srv.secure {
+		t.Fatalf("expected a login after STLS, got %+v, %v", report, srv.commands)
+	}
+
+	// the certificate is self signed
+	cfg.InsecureSkipVerify = false
+	if err := (&App{}).Archive(cfg); err == nil {
+		t.Fatal("expected the unverified certificate to fail")
+	}
+
+	// STLS is not offered
+	plain := newPop3TestServer(t, nil, pop3TestMessage("uid-a", "a"))
+	cfg.Port, cfg.InsecureSkipVerify = plain.port, true
+	if err := (&App{}).Archive(cfg); err == nil {
+		t.Fatal("expected a server without STLS to fail")
+	}
+	if plain.count("USER") != 0 {
+		t.Fatal("credentials must not be sent without tls")
+	}
+}
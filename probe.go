@@ -0,0 +1,417 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/responses"
+)
+
+// specialUseAttrs are the mailbox attributes defined by SPECIAL-USE (RFC 6154).
+var specialUseAttrs = []string{"\\All", "\\Archive", "\\Drafts", "\\Flagged", "\\Junk", "\\Sent", "\\Trash"}
+
+// Probe describes what a server offers to an account. It is collected without downloading or writing any mail.
+type Probe struct {
+	Account string    `json:"account"`
+	Server  string    `json:"server"`
+	Port    int       `json:"port"`
+	Login   string    `json:"login"`
+	Probed  time.Time `json:"probed"`
+	TLS     *ProbeTLS `json:"tls,omitempty"`
+	// Capabilities are announced before the login, LoginCapabilities afterwards.
+	Capabilities      []string          `json:"capabilities,omitempty"`
+	LoginCapabilities []string          `json:"loginCapabilities,omitempty"`
+	AuthMechanisms    []string          `json:"authMechanisms,omitempty"`
+	Compression       bool              `json:"compression"`
+	ID                map[string]string `json:"id,omitempty"`
+	Namespaces        []*Namespace      `json:"namespaces,omitempty"`
+	Mailboxes         []*ProbeMailbox   `json:"mailboxes,omitempty"`
+	Error             string            `json:"error,omitempty"`
+}
+
+// ProbeTLS describes the tls connection and the certificate of the server.
+type ProbeTLS struct {
+	Version     string    `json:"version"`
+	CipherSuite string    `json:"cipherSuite"`
+	Subject     string    `json:"subject"`
+	Issuer      string    `json:"issuer"`
+	DNSNames    []string  `json:"dnsNames,omitempty"`
+	NotAfter    time.Time `json:"notAfter"`
+	Verified    bool      `json:"verified"`
+	VerifyError string    `json:"verifyError,omitempty"`
+}
+
+// ProbeMailbox is a mailbox on the server. Archived tells, whether the configuration of the account includes it.
+type ProbeMailbox struct {
+	Name        string   `json:"name"`
+	Delimiter   string   `json:"delimiter,omitempty"`
+	Attributes  []string `json:"attributes,omitempty"`
+	SpecialUse  string   `json:"specialUse,omitempty"`
+	Namespace   string   `json:"namespace,omitempty"`
+	Messages    uint32   `json:"messages"`
+	Unseen      uint32   `json:"unseen"`
+	UIDValidity uint32   `json:"uidValidity,omitempty"`
+	Archived    bool     `json:"archived"`
+	Error       string   `json:"error,omitempty"`
+}
+
+// ProbeServer connects to the server of the account and collects its capabilities, namespaces and mailboxes.
+func ProbeServer(cfg *Config) *Probe {
+	p := &Probe{Account: cfg.Name, Server: cfg.Server, Port: imapPort(cfg), Login: cfg.Login, Probed: time.Now()}
+	if cfg.Protocol == protocolPOP3 {
+		p.Error = "probing is only supported for imap"
+		return p
+	}
+	if cfg.TLS || cfg.StartTLS {
+		tlsInfo, err := probeTLS(cfg)
+		if err != nil {
+			p.Error = err.Error()
+			return p
+		}
+		p.TLS = tlsInfo
+	}
+	if err := p.probe(cfg); err != nil {
+		p.Error = err.Error()
+	}
+	return p
+}
+
+// probeTLS establishes a separate tls connection without verification, so that the certificate is described even
+// if it is invalid. The certificate is verified afterwards like a regular connection would do it.
+func probeTLS(cfg *Config) (*ProbeTLS, error) {
+	tlsConfig := tlsConfigFor(cfg)
+	serverName := tlsConfig.ServerName
+	tlsConfig.InsecureSkipVerify = true
+	addr := net.JoinHostPort(cfg.Server, strconv.Itoa(imapPort(cfg)))
+
+	var state tls.ConnectionState
+	if cfg.TLS {
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Minute}, "tcp", addr, tlsConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to tls server %s: %w", cfg.Server, err)
+		}
+		defer conn.Close()
+		state = conn.ConnectionState()
+	} else {
+		// the client does not expose the upgraded connection, but its state is passed to the verification
+		tlsConfig.VerifyConnection = func(s tls.ConnectionState) error {
+			state = s
+			return nil
+		}
+		c, err := client.DialWithDialer(&net.Dialer{Timeout: time.Minute}, addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to server %s: %w", cfg.Server, err)
+		}
+		defer c.Terminate()
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return nil, fmt.Errorf("failed to starttls with server %s: %w", cfg.Server, err)
+		}
+	}
+
+	res := &ProbeTLS{Version: tlsVersionName(state.Version), CipherSuite: tls.CipherSuiteName(state.CipherSuite)}
+	if len(state.PeerCertificates) == 0 {
+		res.VerifyError = "no certificate"
+		return res, nil
+	}
+	cert := state.PeerCertificates[0]
+	res.Subject = cert.Subject.String()
+	res.Issuer = cert.Issuer.String()
+	res.DNSNames = cert.DNSNames
+	res.NotAfter = cert.NotAfter
+	opts := x509.VerifyOptions{DNSName: serverName, Intermediates: x509.NewCertPool()}
+	for _, c := range state.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	if _, err := cert.Verify(opts); err != nil {
+		res.VerifyError = err.Error()
+	} else {
+		res.Verified = true
+	}
+	return res, nil
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+func (p *Probe) probe(cfg *Config) error {
+	srv := &Imap{}
+	if err := srv.dial(cfg); err != nil {
+		return err
+	}
+	defer srv.Logout()
+
+	caps, err := srv.client.Capability()
+	if err != nil {
+		return fmt.Errorf("failed to query capabilities: %w", err)
+	}
+	p.Capabilities = sortedCaps(caps)
+	for _, c := range p.Capabilities {
+		if strings.HasPrefix(strings.ToUpper(c), "AUTH=") {
+			p.AuthMechanisms = append(p.AuthMechanisms, c[len("AUTH="):])
+		}
+	}
+	if caps["ID"] {
+		// servers may restrict the login to clients, which identified themselves
+		if p.ID, err = srv.id(); err != nil {
+			logger.Warn("cannot query server id", "server", cfg.Server, "err", err)
+		}
+	}
+
+	if err := srv.client.Login(cfg.Login, cfg.Password); err != nil {
+		return fmt.Errorf("username or password invalid: %w", err)
+	}
+	caps, err = srv.client.Capability()
+	if err != nil {
+		return fmt.Errorf("failed to query capabilities: %w", err)
+	}
+	p.LoginCapabilities = sortedCaps(caps)
+	p.Compression = caps["COMPRESS=DEFLATE"]
+
+	p.Namespaces, err = srv.Namespaces()
+	if err != nil {
+		return err
+	}
+	// the mailboxes are listed like for archiving, the namespaces, which are not enabled, are listed in addition
+	mailboxes, err := (&App{cfg: cfg}).listMailboxes(srv)
+	if err != nil {
+		return fmt.Errorf("unable to list mailboxes: %w", err)
+	}
+	listed := make(map[string]bool)
+	for _, mb := range mailboxes {
+		listed[mb.Name] = true
+	}
+	enabled := make(map[string]bool)
+	for _, kind := range cfg.Namespaces {
+		enabled[kind] = true
+	}
+	for _, ns := range p.Namespaces {
+		if ns.Kind == namespacePersonal || len(ns.Prefix) == 0 || enabled[ns.Kind] {
+			continue
+		}
+		nsMailboxes, err := srv.MailboxesOf(ns)
+		if err != nil {
+			return fmt.Errorf("unable to list mailboxes: %w", err)
+		}
+		for _, mb := range nsMailboxes {
+			if !listed[mb.Name] && namespaceOf(p.Namespaces, mb.Name) == ns {
+				mailboxes = append(mailboxes, mb)
+			}
+		}
+	}
+	for _, mb := range mailboxes {
+		pm := &ProbeMailbox{Name: mb.Name, Delimiter: mb.Delimiter, Attributes: mb.Attributes}
+		for _, attr := range specialUseAttrs {
+			if hasAttr(mb.Attributes, attr) {
+				pm.SpecialUse = attr
+			}
+		}
+		pm.Archived = cfg.IncludesMailbox(mb.Name) && listed[mb.Name]
+		if ns := namespaceOf(p.Namespaces, mb.Name); ns != nil && ns.Kind != namespacePersonal && len(ns.Prefix) > 0 {
+			pm.Namespace = ns.Kind
+		}
+		if !hasAttr(mb.Attributes, imap.NoSelectAttr) {
+			status, err := srv.client.Status(mb.Name, []imap.StatusItem{imap.StatusMessages, imap.StatusUnseen,
+				imap.StatusUidValidity})
+			if err != nil {
+				pm.Error = err.Error()
+			} else {
+				pm.Messages, pm.Unseen, pm.UIDValidity = status.Messages, status.Unseen, status.UidValidity
+			}
+		}
+		p.Mailboxes = append(p.Mailboxes, pm)
+	}
+	sort.Slice(p.Mailboxes, func(i, j int) bool { return p.Mailboxes[i].Name < p.Mailboxes[j].Name })
+	return nil
+}
+
+func sortedCaps(caps map[string]bool) []string {
+	var res []string
+	for c := range caps {
+		res = append(res, c)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// idCmd identifies imaparc to the server and asks for the identity of the server (RFC 2971).
+type idCmd struct{}
+
+func (idCmd) Command() *imap.Command {
+	return &imap.Command{Name: "ID", Arguments: []interface{}{[]interface{}{"name", "imaparc"}}}
+}
+
+type idResp struct {
+	id map[string]string
+}
+
+func (r *idResp) Handle(resp imap.Resp) error {
+	name, fields, ok := imap.ParseNamedResp(resp)
+	if !ok || name != "ID" {
+		return responses.ErrUnhandled
+	}
+	r.id = make(map[string]string)
+	if len(fields) == 0 {
+		return nil
+	}
+	list, ok := fields[0].([]interface{})
+	if !ok {
+		// NIL
+		return nil
+	}
+	for i := 0; i+1 < len(list); i += 2 {
+		key, err := imap.ParseString(list[i])
+		if err != nil {
+			return fmt.Errorf("invalid id field: %w", err)
+		}
+		value, _ := imap.ParseString(list[i+1])
+		r.id[key] = value
+	}
+	return nil
+}
+
+// id queries the identity of the server.
+func (i *Imap) id() (map[string]string, error) {
+	res := &idResp{}
+	status, err := i.client.Execute(idCmd{}, res)
+	if err != nil {
+		return nil, err
+	}
+	if err := status.Err(); err != nil {
+		return nil, err
+	}
+	return res.id, nil
+}
+
+// PrintProbe writes the probe in a human readable format. If the logger uses json, the probe is logged instead.
+func PrintProbe(w io.Writer, p *Probe) {
+	if logger.JSON() {
+		for _, mb := range p.Mailboxes {
+			logger.Info("probed mailbox", "account", p.Account, "mailbox", mb.Name, "specialUse", mb.SpecialUse,
+				"namespace", mb.Namespace, "messages", mb.Messages, "unseen", mb.Unseen, "archived", mb.Archived)
+		}
+		logger.Info("probe", "account", p.Account, "server", p.Server, "port", p.Port,
+			"capabilities", strings.Join(p.LoginCapabilities, " "), "auth", strings.Join(p.AuthMechanisms, " "),
+			"compression", p.Compression, "mailboxes", len(p.Mailboxes), "error", p.Error)
+		return
+	}
+
+	if len(p.Account) > 0 {
+		fmt.Fprintf(w, "account %s (%s@%s:%d)\n", p.Account, p.Login, p.Server, p.Port)
+	} else {
+		fmt.Fprintf(w, "account %s@%s:%d\n", p.Login, p.Server, p.Port)
+	}
+	if t := p.TLS; t != nil {
+		fmt.Fprintf(w, "tls: %s, %s\n", t.Version, t.CipherSuite)
+		fmt.Fprintf(w, "certificate: %s, issued by %s, valid until %s\n", t.Subject, t.Issuer,
+			t.NotAfter.Local().Format(dateLayout))
+		if t.Verified {
+			fmt.Fprintln(w, "certificate verified")
+		} else {
+			fmt.Fprintf(w, "certificate NOT verified: %s\n", t.VerifyError)
+		}
+	}
+	if len(p.Capabilities) > 0 {
+		fmt.Fprintf(w, "capabilities: %s\n", strings.Join(p.Capabilities, " "))
+		fmt.Fprintf(w, "auth mechanisms: %s\n", strings.Join(p.AuthMechanisms, " "))
+	}
+	if len(p.ID) > 0 {
+		var keys []string
+		for k := range p.ID {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var fields []string
+		for _, k := range keys {
+			fields = append(fields, fmt.Sprintf("%s=%s", k, p.ID[k]))
+		}
+		fmt.Fprintf(w, "id: %s\n", strings.Join(fields, ", "))
+	}
+	if len(p.Error) > 0 {
+		fmt.Fprintf(w, "probe failed: %s\n", p.Error)
+		return
+	}
+	fmt.Fprintf(w, "capabilities after login: %s\n", strings.Join(p.LoginCapabilities, " "))
+	fmt.Fprintf(w, "compression: %t\n", p.Compression)
+	for _, ns := range p.Namespaces {
+		dir := ns.Dir
+		if len(dir) == 0 {
+			dir = "."
+		}
+		fmt.Fprintf(w, "namespace: %s %q delimiter %q -> %s\n", ns.Kind, ns.Prefix, ns.Delimiter, dir)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "MAILBOX\tSPECIAL-USE\tNAMESPACE\tMESSAGES\tUNSEEN\tARCHIVED")
+	for _, mb := range p.Mailboxes {
+		messages, unseen := strconv.Itoa(int(mb.Messages)), strconv.Itoa(int(mb.Unseen))
+		if len(mb.Error) > 0 {
+			messages, unseen = "error", mb.Error
+		} else if hasAttr(mb.Attributes, imap.NoSelectAttr) {
+			messages, unseen = "-", "-"
+		}
+		archived := "yes"
+		if !mb.Archived {
+			archived = "no"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", mb.Name, mb.SpecialUse, mb.Namespace, messages, unseen, archived)
+	}
+	tw.Flush()
+}
+
+// probeCommand probes the servers of the given accounts: imaparc probe [account flags | -configFile]
+func probeCommand(args []string) int {
+	flags := flag.NewFlagSet("probe", flag.ExitOnError)
+	cfg := &Config{}
+	addAccountFlags(flags, cfg)
+	configFile := flags.String("configFile", "", "filename to a configuration in yaml, json or toml format")
+	report := flags.String("report", "", "filename to write the probes as json")
+	flags.Parse(args)
+
+	var results []*Probe
+	code := 0
+	for _, accCfg := range accountConfigs(cfg, *configFile) {
+		p := ProbeServer(accCfg)
+		PrintProbe(os.Stdout, p)
+		results = append(results, p)
+		if len(p.Error) > 0 {
+			code = 1
+		}
+	}
+
+	if len(*report) > 0 {
+		b, err := json.MarshalIndent(results, "", " ")
+		if err == nil {
+			err = ioutil.WriteFile(*report, b, os.ModePerm)
+		}
+		if err != nil {
+			logger.Error("cannot write probe", "file", *report, "err", err)
+			return 2
+		}
+	}
+	return code
+}
@@ -0,0 +1,702 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// The node ids of the messaging layer, which have a fixed value in every pst file.
+const (
+	pstNidMessageStore    = 0x21
+	pstNidRootFolder      = 0x122
+	pstNidAttachmentTable = 0x671
+	pstNidRecipientTable  = 0x692
+)
+
+// The node types encoded in the lowest 5 bits of a node id.
+const (
+	pstNidTypeHierarchyTable = 0x0D
+	pstNidTypeContentsTable  = 0x0E
+)
+
+const (
+	pstPageSize     = 512
+	pstPageTypeBBT  = 0x80
+	pstPageTypeNBT  = 0x81
+	pstCryptNone    = 0
+	pstCryptPermute = 1
+	pstMaxDepth     = 16
+)
+
+// errPstNotFound is returned for nodes and blocks, which are missing in their b-tree.
+var errPstNotFound = errors.New("not found")
+
+// pstDecrypt inverts the permutation of the compressible encryption, which is the default of Outlook.
+var pstDecrypt = func() [256]byte {
+	encrypt := [256]byte{
+		65, 54, 19, 98, 168, 33, 110, 187, 244, 22, 204, 4, 127, 100, 232, 93, 30, 242, 203, 42, 116, 197, 94, 53,
+		210, 149, 71, 158, 150, 45, 154, 136, 76, 125, 132, 63, 219, 172, 49, 182, 72, 95, 246, 196, 216, 57, 139, 231,
+		35, 59, 56, 142, 200, 193, 223, 37, 177, 32, 165, 70, 96, 78, 156, 251, 170, 211, 86, 81, 69, 124, 85, 0, 7,
+		201, 43, 157, 133, 155, 9, 160, 143, 173, 179, 15, 99, 171, 137, 75, 215, 167, 21, 90, 113, 102, 66, 191, 38,
+		74, 107, 152, 250, 234, 119, 83, 178, 112, 5, 44, 253, 89, 58, 134, 126, 206, 6, 235, 130, 120, 87, 199, 141,
+		67, 175, 180, 28, 212, 91, 205, 226, 233, 39, 79, 195, 8, 114, 128, 207, 176, 239, 245, 40, 109, 190, 48, 77,
+		52, 146, 213, 14, 60, 34, 50, 229, 228, 249, 159, 194, 209, 10, 129, 18, 225, 238, 145, 131, 118, 227, 151,
+		230, 97, 138, 23, 121, 164, 183, 220, 144, 122, 92, 140, 2, 166, 202, 105, 222, 80, 26, 17, 147, 185, 82, 135,
+		88, 252, 237, 29, 55, 73, 27, 106, 224, 41, 51, 153, 189, 108, 217, 148, 243, 64, 84, 111, 240, 198, 115, 184,
+		214, 62, 101, 24, 68, 31, 221, 103, 16, 241, 12, 25, 236, 174, 3, 161, 20, 123, 169, 11, 255, 248, 163, 192,
+		162, 1, 247, 46, 188, 36, 104, 117, 13, 254, 186, 47, 181, 208, 218, 61,
+	}
+	var res [256]byte
+	for i, b := range encrypt {
+		res[b] = byte(i)
+	}
+	return res
+}()
+
+// pstFile reads the Outlook personal folders format as specified by [MS-PST]. Both the ANSI format of Outlook 97
+// to 2002 and the unicode format of later versions are supported, as well as OST files in the unicode format.
+// Only the layers needed to read folders and messages are implemented: the node database with its two b-trees,
+// the heap, property contexts and tables.
+type pstFile struct {
+	r       io.ReaderAt
+	closer  io.Closer
+	unicode bool
+	crypt   byte
+	nbt     uint64 // offset of the root page of the node b-tree
+	bbt     uint64 // offset of the root page of the block b-tree
+}
+
+func openPst(name string) (*pstFile, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	p, err := newPstFile(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("invalid pst file %s: %w", name, err)
+	}
+	p.closer = f
+	return p, nil
+}
+
+func newPstFile(r io.ReaderAt) (*pstFile, error) {
+	header := make([]byte, 564)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, fmt.Errorf("cannot read header: %w", err)
+	}
+	if string(header[:4]) != "!BDN" {
+		return nil, errors.New("missing magic !BDN")
+	}
+	p := &pstFile{r: r}
+	version := binary.LittleEndian.Uint16(header[10:])
+	switch {
+	case version == 14 || version == 15:
+		p.nbt = uint64(binary.LittleEndian.Uint32(header[188:]))
+		p.bbt = uint64(binary.LittleEndian.Uint32(header[196:]))
+		p.crypt = header[461]
+	case version == 23:
+		p.unicode = true
+		p.nbt = binary.LittleEndian.Uint64(header[224:])
+		p.bbt = binary.LittleEndian.Uint64(header[240:])
+		p.crypt = header[513]
+	case version == 36:
+		return nil, errors.New("the ost format of Outlook 2013 and later is not supported")
+	default:
+		return nil, fmt.Errorf("unknown version %d", version)
+	}
+	if p.crypt != pstCryptNone && p.crypt != pstCryptPermute {
+		return nil, errors.New("high encryption is not supported")
+	}
+	return p, nil
+}
+
+func (p *pstFile) Close() error {
+	if p.closer == nil {
+		return nil
+	}
+	return p.closer.Close()
+}
+
+// idSize is the size of block ids and byte offsets.
+func (p *pstFile) idSize() int {
+	if p.unicode {
+		return 8
+	}
+	return 4
+}
+
+func (p *pstFile) id(b []byte) uint64 {
+	if p.unicode {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return uint64(binary.LittleEndian.Uint32(b))
+}
+
+// lookup searches the b-tree with the root page at offset ib and returns the leaf entry of key. The lowest bit of
+// block ids is reserved and node ids have 32 bits only, so both are masked.
+func (p *pstFile) lookup(ib, key uint64, pageType byte) ([]byte, error) {
+	mask := uint64(0xFFFFFFFF)
+	if pageType == pstPageTypeBBT {
+		mask = ^uint64(1)
+	}
+	key &= mask
+	page := make([]byte, pstPageSize)
+	for depth := 0; depth < pstMaxDepth; depth++ {
+		if _, err := p.r.ReadAt(page, int64(ib)); err != nil {
+			return nil, fmt.Errorf("cannot read page at %d: %w", ib, err)
+		}
+		meta, trailer := 496, 500
+		if p.unicode {
+			meta, trailer = 488, 496
+		}
+		count, size, level := int(page[meta]), int(page[meta+2]), page[meta+3]
+		if page[trailer] != pageType || size < p.entrySize(pageType, level) || count*size > meta {
+			return nil, fmt.Errorf("corrupt b-tree page at %d", ib)
+		}
+		if level == 0 {
+			for i := 0; i < count; i++ {
+				entry := page[i*size : (i+1)*size]
+				if p.id(entry)&mask == key {
+					return append([]byte{}, entry...), nil
+				}
+			}
+			return nil, errPstNotFound
+		}
+		next := uint64(0)
+		for i := 0; i < count; i++ {
+			entry := page[i*size : (i+1)*size]
+			if p.id(entry)&mask > key {
+				break
+			}
+			next = p.id(entry[2*p.idSize():])
+		}
+		if next == 0 {
+			return nil, errPstNotFound
+		}
+		ib = next
+	}
+	return nil, errors.New("b-tree too deep")
+}
+
+// entrySize returns the minimal size of the entries of a b-tree page. Intermediate entries consist of the key and
+// a reference to the child page, leaf entries of the block b-tree of the block id, its offset and size and leaf
+// entries of the node b-tree of the node id and the block ids of its data and subnodes.
+func (p *pstFile) entrySize(pageType, level byte) int {
+	if level == 0 && pageType == pstPageTypeBBT {
+		return 2*p.idSize() + 2
+	}
+	return 3 * p.idSize()
+}
+
+// block reads and decrypts a single block.
+func (p *pstFile) block(bid uint64) ([]byte, error) {
+	entry, err := p.lookup(p.bbt, bid, pstPageTypeBBT)
+	if err != nil {
+		return nil, fmt.Errorf("block %d: %w", bid, err)
+	}
+	ib := p.id(entry[p.idSize():])
+	size := binary.LittleEndian.Uint16(entry[2*p.idSize():])
+	b := make([]byte, size)
+	if _, err := p.r.ReadAt(b, int64(ib)); err != nil {
+		return nil, fmt.Errorf("cannot read block %d: %w", bid, err)
+	}
+	// internal blocks, which form the data and subnode trees, are never encrypted
+	if bid&2 == 0 && p.crypt == pstCryptPermute {
+		for i, c := range b {
+			b[i] = pstDecrypt[c]
+		}
+	}
+	return b, nil
+}
+
+// dataBlocks returns the data blocks of a node. Large nodes are split into several blocks, referenced by an
+// XBLOCK or, for even larger nodes, by an XXBLOCK of XBLOCKs.
+func (p *pstFile) dataBlocks(bid uint64, depth int) ([][]byte, error) {
+	if bid == 0 {
+		return nil, nil
+	}
+	b, err := p.block(bid)
+	if err != nil {
+		return nil, err
+	}
+	if bid&2 == 0 {
+		return [][]byte{b}, nil
+	}
+	if len(b) < 8 || b[0] != 1 || depth > 2 {
+		return nil, fmt.Errorf("corrupt data tree in block %d", bid)
+	}
+	count := int(binary.LittleEndian.Uint16(b[2:]))
+	if 8+count*p.idSize() > len(b) {
+		return nil, fmt.Errorf("corrupt data tree in block %d", bid)
+	}
+	var res [][]byte
+	for i := 0; i < count; i++ {
+		blocks, err := p.dataBlocks(p.id(b[8+i*p.idSize():]), depth+1)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, blocks...)
+	}
+	return res, nil
+}
+
+// subnodes reads the subnode tree of a node. Subnodes hold the parts of a node, which do not fit into its heap,
+// like large property values, and the tables and attachments of a message.
+func (p *pstFile) subnodes(bid uint64, res map[uint32]*pstNode, depth int) error {
+	if bid == 0 {
+		return nil
+	}
+	b, err := p.block(bid)
+	if err != nil {
+		return err
+	}
+	off := 4
+	if p.unicode {
+		off = 8
+	}
+	if len(b) < off || b[0] != 2 || depth > pstMaxDepth {
+		return fmt.Errorf("corrupt subnode tree in block %d", bid)
+	}
+	level := b[1]
+	count := int(binary.LittleEndian.Uint16(b[2:]))
+	size := 2 * p.idSize()
+	if level == 0 {
+		size = 3 * p.idSize()
+	}
+	if off+count*size > len(b) {
+		return fmt.Errorf("corrupt subnode tree in block %d", bid)
+	}
+	for i := 0; i < count; i++ {
+		entry := b[off+i*size:]
+		nid := uint32(p.id(entry))
+		if level > 0 {
+			if err := p.subnodes(p.id(entry[p.idSize():]), res, depth+1); err != nil {
+				return err
+			}
+			continue
+		}
+		res[nid] = &pstNode{p: p, nid: nid, bidData: p.id(entry[p.idSize():]), bidSub: p.id(entry[2*p.idSize():])}
+	}
+	return nil
+}
+
+// pstNode is a node of the node b-tree or a subnode of another node.
+type pstNode struct {
+	p       *pstFile
+	nid     uint32
+	bidData uint64
+	bidSub  uint64
+	subs    map[uint32]*pstNode
+}
+
+// node looks up a top level node by its id.
+func (p *pstFile) node(nid uint32) (*pstNode, error) {
+	entry, err := p.lookup(p.nbt, uint64(nid), pstPageTypeNBT)
+	if err != nil {
+		return nil, fmt.Errorf("node %#x: %w", nid, err)
+	}
+	n := p.idSize()
+	return &pstNode{p: p, nid: nid, bidData: p.id(entry[n:]), bidSub: p.id(entry[2*n:])}, nil
+}
+
+func (n *pstNode) blocks() ([][]byte, error) {
+	return n.p.dataBlocks(n.bidData, 0)
+}
+
+func (n *pstNode) data() ([]byte, error) {
+	blocks, err := n.blocks()
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Join(blocks, nil), nil
+}
+
+// sub returns a subnode of this node.
+func (n *pstNode) sub(nid uint32) (*pstNode, error) {
+	if n.subs == nil {
+		subs := make(map[uint32]*pstNode)
+		if err := n.p.subnodes(n.bidSub, subs, 0); err != nil {
+			return nil, err
+		}
+		n.subs = subs
+	}
+	sub, ok := n.subs[nid]
+	if !ok {
+		return nil, fmt.Errorf("subnode %#x of node %#x: %w", nid, n.nid, errPstNotFound)
+	}
+	return sub, nil
+}
+
+// pstHeap is the heap-on-node, which stores the allocations of property contexts and tables.
+type pstHeap struct {
+	node      *pstNode
+	blocks    [][]byte
+	clientSig byte
+	userRoot  uint32
+}
+
+func (n *pstNode) heap() (*pstHeap, error) {
+	blocks, err := n.blocks()
+	if err != nil {
+		return nil, err
+	}
+	if len(blocks) == 0 || len(blocks[0]) < 12 || blocks[0][2] != 0xEC {
+		return nil, fmt.Errorf("node %#x has no heap", n.nid)
+	}
+	return &pstHeap{
+		node:      n,
+		blocks:    blocks,
+		clientSig: blocks[0][3],
+		userRoot:  binary.LittleEndian.Uint32(blocks[0][4:]),
+	}, nil
+}
+
+// get returns a heap allocation.
+func (h *pstHeap) get(hid uint32) ([]byte, error) {
+	index := int(hid>>5) & 0x7FF
+	block := int(hid >> 16)
+	if hid&0x1F != 0 || index == 0 || block >= len(h.blocks) {
+		return nil, fmt.Errorf("invalid heap id %#x in node %#x", hid, h.node.nid)
+	}
+	b := h.blocks[block]
+	if len(b) < 2 {
+		return nil, fmt.Errorf("invalid heap id %#x in node %#x", hid, h.node.nid)
+	}
+	pageMap := int(binary.LittleEndian.Uint16(b))
+	if pageMap+4 > len(b) || index > int(binary.LittleEndian.Uint16(b[pageMap:])) ||
+		pageMap+6+2*index > len(b) {
+		return nil, fmt.Errorf("invalid heap id %#x in node %#x", hid, h.node.nid)
+	}
+	start := int(binary.LittleEndian.Uint16(b[pageMap+2+2*index:]))
+	end := int(binary.LittleEndian.Uint16(b[pageMap+4+2*index:]))
+	if start > end || end > len(b) {
+		return nil, fmt.Errorf("invalid heap id %#x in node %#x", hid, h.node.nid)
+	}
+	return b[start:end], nil
+}
+
+// value returns the data of a heap id or, for larger values, of a subnode.
+func (h *pstHeap) value(hnid uint32) ([]byte, error) {
+	if hnid == 0 {
+		return nil, nil
+	}
+	if hnid&0x1F == 0 {
+		return h.get(hnid)
+	}
+	sub, err := h.node.sub(hnid)
+	if err != nil {
+		return nil, err
+	}
+	return sub.data()
+}
+
+// records returns the leaf records of the b-tree on the heap with its header at hid. Each record starts with the
+// key, followed by the data.
+func (h *pstHeap) records(hid uint32) (keySize, dataSize int, res [][]byte, err error) {
+	header, err := h.get(hid)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if len(header) < 8 || header[0] != 0xB5 {
+		return 0, 0, nil, fmt.Errorf("no b-tree on heap of node %#x", h.node.nid)
+	}
+	keySize, dataSize = int(header[1]), int(header[2])
+	var collect func(hid uint32, level int) error
+	collect = func(hid uint32, level int) error {
+		if hid == 0 {
+			return nil
+		}
+		b, err := h.get(hid)
+		if err != nil {
+			return err
+		}
+		size := keySize + dataSize
+		if level > 0 {
+			size = keySize + 4
+		}
+		if size == 0 {
+			return fmt.Errorf("corrupt b-tree on heap of node %#x", h.node.nid)
+		}
+		for i := 0; i+size <= len(b); i += size {
+			if level == 0 {
+				res = append(res, b[i:i+size])
+			} else if err := collect(binary.LittleEndian.Uint32(b[i+keySize:]), level-1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if int(header[3]) > pstMaxDepth {
+		return 0, 0, nil, fmt.Errorf("corrupt b-tree on heap of node %#x", h.node.nid)
+	}
+	err = collect(binary.LittleEndian.Uint32(header[4:]), int(header[3]))
+	return keySize, dataSize, res, err
+}
+
+// The property types, which are read from pst files.
+const (
+	pstTypeInt16   = 0x0002
+	pstTypeInt32   = 0x0003
+	pstTypeBoolean = 0x000B
+	pstTypeObject  = 0x000D
+	pstTypeInt64   = 0x0014
+	pstTypeString8 = 0x001E
+	pstTypeString  = 0x001F
+	pstTypeTime    = 0x0040
+	pstTypeBinary  = 0x0102
+)
+
+// pstFixedSize returns the size of fixed length property types and 0 for variable length types.
+func pstFixedSize(typ uint16) int {
+	switch typ {
+	case 0x0001, 0x0002, 0x000B:
+		return 2
+	case 0x0003, 0x0004, 0x000A:
+		return 4
+	case 0x0005, 0x0006, 0x0007, 0x0014, 0x0040:
+		return 8
+	case 0x0048:
+		return 16
+	}
+	return 0
+}
+
+type pstProp struct {
+	typ   uint16
+	hnid  uint32
+	value []byte
+}
+
+// pstProps are the properties of a message, folder, attachment or table row.
+type pstProps map[uint16]pstProp
+
+// props reads the property context of a node.
+func (n *pstNode) props() (pstProps, error) {
+	h, err := n.heap()
+	if err != nil {
+		return nil, err
+	}
+	if h.clientSig != 0xBC {
+		return nil, fmt.Errorf("node %#x is no property context", n.nid)
+	}
+	keySize, dataSize, records, err := h.records(h.userRoot)
+	if err != nil {
+		return nil, err
+	}
+	if keySize != 2 || dataSize != 6 {
+		return nil, fmt.Errorf("corrupt property context in node %#x", n.nid)
+	}
+	res := make(pstProps)
+	for _, rec := range records {
+		prop := pstProp{typ: binary.LittleEndian.Uint16(rec[2:]), hnid: binary.LittleEndian.Uint32(rec[4:])}
+		if size := pstFixedSize(prop.typ); size > 0 && size <= 4 {
+			prop.value = rec[4 : 4+size]
+		} else if prop.value, err = h.value(prop.hnid); err != nil {
+			logger.Debug("ignoring unreadable property", "node", n.nid, "property", binary.LittleEndian.Uint16(rec), "err", err)
+			continue
+		}
+		res[binary.LittleEndian.Uint16(rec)] = prop
+	}
+	return res, nil
+}
+
+// pstTable is a table context, like the list of subfolders, the messages of a folder or the recipients and
+// attachments of a message.
+type pstTable struct {
+	heap    *pstHeap
+	columns map[uint16]pstColumn
+	bitmap  int // offset of the cell existence bitmap in a row
+	rows    [][]byte
+}
+
+type pstColumn struct {
+	typ    uint16
+	offset int
+	size   int
+	bit    int
+}
+
+func (n *pstNode) table() (*pstTable, error) {
+	h, err := n.heap()
+	if err != nil {
+		return nil, err
+	}
+	info, err := h.get(h.userRoot)
+	if err != nil {
+		return nil, err
+	}
+	if h.clientSig != 0x7C || len(info) < 22 || info[0] != 0x7C || len(info) < 22+8*int(info[1]) {
+		return nil, fmt.Errorf("node %#x is no table", n.nid)
+	}
+	t := &pstTable{heap: h, columns: make(map[uint16]pstColumn), bitmap: int(binary.LittleEndian.Uint16(info[6:]))}
+	rowSize := int(binary.LittleEndian.Uint16(info[8:]))
+	for i := 0; i < int(info[1]); i++ {
+		col := info[22+8*i:]
+		tag := binary.LittleEndian.Uint32(col)
+		t.columns[uint16(tag>>16)] = pstColumn{
+			typ:    uint16(tag),
+			offset: int(binary.LittleEndian.Uint16(col[4:])),
+			size:   int(col[6]),
+			bit:    int(col[7]),
+		}
+	}
+
+	// the row matrix is either a heap allocation or a subnode, whose blocks contain whole rows only
+	hnidRows := binary.LittleEndian.Uint32(info[14:])
+	var blocks [][]byte
+	switch {
+	case hnidRows == 0 || rowSize == 0:
+	case hnidRows&0x1F == 0:
+		b, err := h.get(hnidRows)
+		if err != nil {
+			return nil, err
+		}
+		blocks = [][]byte{b}
+	default:
+		sub, err := n.sub(hnidRows)
+		if err != nil {
+			return nil, err
+		}
+		if blocks, err = sub.blocks(); err != nil {
+			return nil, err
+		}
+	}
+	for _, b := range blocks {
+		for i := 0; i+rowSize <= len(b); i += rowSize {
+			t.rows = append(t.rows, b[i:i+rowSize])
+		}
+	}
+	return t, nil
+}
+
+// props returns the existing cells of a row.
+func (t *pstTable) props(row []byte) pstProps {
+	res := make(pstProps)
+	for id, col := range t.columns {
+		if t.bitmap+col.bit/8 >= len(row) || row[t.bitmap+col.bit/8]&(0x80>>uint(col.bit%8)) == 0 ||
+			col.offset+col.size > len(row) {
+			continue
+		}
+		cell := row[col.offset : col.offset+col.size]
+		prop := pstProp{typ: col.typ}
+		if size := pstFixedSize(col.typ); size > 0 && size <= 8 {
+			if len(cell) < size {
+				logger.Debug("ignoring truncated cell", "node", t.heap.node.nid, "property", id)
+				continue
+			}
+			prop.value = cell
+		} else if len(cell) == 4 {
+			prop.hnid = binary.LittleEndian.Uint32(cell)
+			value, err := t.heap.value(prop.hnid)
+			if err != nil {
+				logger.Debug("ignoring unreadable cell", "node", t.heap.node.nid, "property", id, "err", err)
+				continue
+			}
+			prop.value = value
+		}
+		res[id] = prop
+	}
+	return res
+}
+
+// rowIDs returns the node ids of all rows.
+func (t *pstTable) rowIDs() []uint32 {
+	var res []uint32
+	for _, row := range t.rows {
+		if id, ok := t.props(row).int(0x67F2); ok {
+			res = append(res, uint32(id))
+		}
+	}
+	return res
+}
+
+func (p pstProps) int(id uint16) (int64, bool) {
+	prop, ok := p[id]
+	if !ok {
+		return 0, false
+	}
+	switch {
+	case prop.typ == pstTypeBoolean && len(prop.value) >= 1:
+		return int64(prop.value[0]), true
+	case prop.typ == pstTypeInt16 && len(prop.value) >= 2:
+		return int64(int16(binary.LittleEndian.Uint16(prop.value))), true
+	case prop.typ == pstTypeInt32 && len(prop.value) >= 4:
+		return int64(int32(binary.LittleEndian.Uint32(prop.value))), true
+	case prop.typ == pstTypeInt64 && len(prop.value) >= 8:
+		return int64(binary.LittleEndian.Uint64(prop.value)), true
+	}
+	return 0, false
+}
+
+func (p pstProps) bytes(id uint16) []byte {
+	return p[id].value
+}
+
+// string decodes unicode strings and ANSI strings in the code page of the message.
+func (p pstProps) string(id uint16) string {
+	prop, ok := p[id]
+	if !ok {
+		return ""
+	}
+	switch prop.typ {
+	case pstTypeString:
+		u := make([]uint16, len(prop.value)/2)
+		for i := range u {
+			u[i] = binary.LittleEndian.Uint16(prop.value[2*i:])
+		}
+		return string(bytes.TrimRight([]byte(string(utf16.Decode(u))), "\x00"))
+	case pstTypeString8, pstTypeBinary:
+		b := bytes.TrimRight(prop.value, "\x00")
+		if enc, err := htmlindex.Get(p.charset()); err == nil {
+			if decoded, err := enc.NewDecoder().Bytes(b); err == nil {
+				return string(decoded)
+			}
+		}
+		return string(b)
+	}
+	return ""
+}
+
+// charset returns the name of the code page used by ANSI strings and the html body.
+func (p pstProps) charset() string {
+	for _, id := range []uint16{0x3FDE, 0x3FFD} {
+		if cp, ok := p.int(id); ok {
+			if name, ok := pstCodePages[cp]; ok {
+				return name
+			}
+		}
+	}
+	return "windows-1252"
+}
+
+var pstCodePages = map[int64]string{
+	874: "windows-874", 932: "shift_jis", 936: "gbk", 949: "euc-kr", 950: "big5", 1250: "windows-1250",
+	1251: "windows-1251", 1252: "windows-1252", 1253: "windows-1253", 1254: "windows-1254", 1255: "windows-1255",
+	1256: "windows-1256", 1257: "windows-1257", 1258: "windows-1258", 20127: "us-ascii", 20866: "koi8-r",
+	21866: "koi8-u", 28591: "iso-8859-1", 28592: "iso-8859-2", 28595: "iso-8859-5", 28597: "iso-8859-7",
+	28599: "iso-8859-9", 28605: "iso-8859-15", 50220: "iso-2022-jp", 51932: "euc-jp", 54936: "gb18030",
+	65001: "utf-8",
+}
+
+// time converts a FILETIME, counting 100ns intervals since 1601.
+func (p pstProps) time(id uint16) time.Time {
+	prop, ok := p[id]
+	if !ok || prop.typ != pstTypeTime || len(prop.value) < 8 {
+		return time.Time{}
+	}
+	ft := int64(binary.LittleEndian.Uint64(prop.value))
+	if ft == 0 {
+		return time.Time{}
+	}
+	ft -= 116444736000000000 // 1601 to 1970
+	return time.Unix(ft/1e7, ft%1e7*100)
+}
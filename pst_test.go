@@ -0,0 +1,730 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+// pstWriter writes pst files for the tests in the unicode or the ANSI format: the header, the node database with
+// its b-trees and the heaps, property contexts and tables of the messaging layer, including the checksums and
+// signatures of [MS-PST]. The allocation maps are not written and are marked as invalid in the header, which makes
+// Outlook rebuild them.
+type pstWriter struct {
+	unicode bool
+	crypt   byte
+	buf     []byte
+	nextBid uint64
+	blocks  []pstWriterBlock
+	nodes   []pstWriterNode
+}
+
+type pstWriterBlock struct {
+	bid, ib, size uint64
+}
+
+type pstWriterNode struct {
+	nid, parent     uint32
+	bidData, bidSub uint64
+}
+
+type pstWriterProp struct {
+	id, typ uint16
+	value   []byte
+	hnid    uint32 // a subnode holding the value
+}
+
+type pstWriterRow struct {
+	id    uint32
+	props []pstWriterProp
+}
+
+// pstEncrypt is the permutation of the compressible encryption.
+var pstEncrypt = func() [256]byte {
+	var res [256]byte
+	for i, b := range pstDecrypt {
+		res[b] = byte(i)
+	}
+	return res
+}()
+
+func newPstWriter(unicode bool, crypt byte) *pstWriter {
+	return &pstWriter{unicode: unicode, crypt: crypt, buf: make([]byte, 1024), nextBid: 4}
+}
+
+func le16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.LittleEndian.PutUint16(b, v)
+	return b
+}
+
+func le32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return b
+}
+
+func le64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, v)
+	return b
+}
+
+// pstCRC is the CRC-32 of the format, which starts with 0 and is not inverted.
+func pstCRC(b []byte) uint32 {
+	return ^crc32.Update(^uint32(0), crc32.IEEETable, b)
+}
+
+// pstSig is the signature of blocks and pages, derived from their offset and id.
+func pstSig(ib, bid uint64) uint16 {
+	ib ^= bid
+	return uint16(ib>>16) ^ uint16(ib)
+}
+
+// id encodes block ids, node ids and offsets.
+func (w *pstWriter) id(v uint64) []byte {
+	if w.unicode {
+		return le64(v)
+	}
+	return le32(uint32(v))
+}
+
+// entries returns the number of entries of the given size, which fit into a b-tree page.
+func (w *pstWriter) entries(size int) int {
+	if w.unicode {
+		return 488 / size
+	}
+	return 496 / size
+}
+
+func (w *pstWriter) bid() uint64 {
+	bid := w.nextBid
+	w.nextBid += 4
+	return bid
+}
+
+// block appends a block with its trailer. Data blocks are encrypted, internal blocks are not.
+func (w *pstWriter) block(b []byte, internal bool) uint64 {
+	bid := w.bid()
+	if internal {
+		bid |= 2
+	} else if w.crypt == pstCryptPermute {
+		encrypted := make([]byte, len(b))
+		for i, c := range b {
+			encrypted[i] = pstEncrypt[c]
+		}
+		b = encrypted
+	}
+	ib := uint64(len(w.buf))
+	var trailer []byte
+	if w.unicode {
+		trailer = append(append(append(le16(uint16(len(b))), le16(pstSig(ib, bid))...), le32(pstCRC(b))...), le64(bid)...)
+	} else {
+		trailer = append(append(append(le16(uint16(len(b))), le16(pstSig(ib, bid))...), le32(uint32(bid))...), le32(pstCRC(b))...)
+	}
+	w.buf = append(w.buf, b...)
+	for (len(w.buf)+len(trailer))%64 != 0 {
+		w.buf = append(w.buf, 0)
+	}
+	w.buf = append(w.buf, trailer...)
+	w.blocks = append(w.blocks, pstWriterBlock{bid: bid, ib: ib, size: uint64(len(b))})
+	return bid
+}
+
+// data stores b in a single block or, if it is too large, in an XBLOCK of blocks.
+func (w *pstWriter) data(b []byte) uint64 {
+	max := 8180
+	if w.unicode {
+		max = 8176
+	}
+	if len(b) <= max {
+		return w.block(b, false)
+	}
+	x := append(append([]byte{1, 1}, le16(uint16((len(b)+max-1)/max))...), le32(uint32(len(b)))...)
+	for len(b) > 0 {
+		n := max
+		if n > len(b) {
+			n = len(b)
+		}
+		x = append(x, w.id(w.block(b[:n], false))...)
+		b = b[n:]
+	}
+	return w.block(x, true)
+}
+
+// subnodes stores the subnode tree of a node in a single SLBLOCK.
+func (w *pstWriter) subnodes(subs ...pstWriterNode) uint64 {
+	sort.Slice(subs, func(i, j int) bool { return subs[i].nid < subs[j].nid })
+	b := append([]byte{2, 0}, le16(uint16(len(subs)))...)
+	if w.unicode {
+		b = append(b, 0, 0, 0, 0)
+	}
+	for _, sub := range subs {
+		b = append(append(append(b, w.id(uint64(sub.nid))...), w.id(sub.bidData)...), w.id(sub.bidSub)...)
+	}
+	return w.block(b, true)
+}
+
+func (w *pstWriter) node(nid, parent uint32, bidData, bidSub uint64) {
+	w.nodes = append(w.nodes, pstWriterNode{nid: nid, parent: parent, bidData: bidData, bidSub: bidSub})
+}
+
+// offset returns the offset of the first data block of a node.
+func (w *pstWriter) offset(nid uint32) int {
+	for _, n := range w.nodes {
+		if n.nid != nid {
+			continue
+		}
+		for _, b := range w.blocks {
+			if b.bid == n.bidData {
+				return int(b.ib)
+			}
+		}
+	}
+	return -1
+}
+
+// stringType is the type of the strings written by str.
+func (w *pstWriter) stringType() uint16 {
+	if w.unicode {
+		return pstTypeString
+	}
+	return pstTypeString8
+}
+
+// str returns a unicode string in the unicode format and a windows-1252 string in the ANSI format.
+func (w *pstWriter) str(id uint16, s string) pstWriterProp {
+	if !w.unicode {
+		b, _ := charmap.Windows1252.NewEncoder().Bytes([]byte(s))
+		return pstWriterProp{id: id, typ: pstTypeString8, value: b}
+	}
+	var b []byte
+	for _, c := range utf16.Encode([]rune(s)) {
+		b = append(b, le16(c)...)
+	}
+	return pstWriterProp{id: id, typ: pstTypeString, value: b}
+}
+
+// pstHeapWriter builds a heap-on-node, which fits into a single block.
+type pstHeapWriter struct {
+	allocs [][]byte
+}
+
+func (h *pstHeapWriter) alloc(b []byte) uint32 {
+	h.allocs = append(h.allocs, b)
+	return uint32(len(h.allocs)) << 5
+}
+
+// bth allocates a b-tree with a single leaf and returns the id of its header.
+func (h *pstHeapWriter) bth(keySize, dataSize byte, records [][]byte) uint32 {
+	var root uint32
+	if len(records) > 0 {
+		root = h.alloc(bytes.Join(records, nil))
+	}
+	return h.alloc(append([]byte{0xB5, keySize, dataSize, 0}, le32(root)...))
+}
+
+func (h *pstHeapWriter) bytes(clientSig byte, userRoot uint32) []byte {
+	b := append([]byte{0, 0, 0xEC, clientSig}, le32(userRoot)...)
+	b = append(b, 0, 0, 0, 0)
+	offsets := []int{len(b)}
+	for _, a := range h.allocs {
+		b = append(b, a...)
+		offsets = append(offsets, len(b))
+	}
+	if len(b)%2 == 1 {
+		b = append(b, 0)
+	}
+	binary.LittleEndian.PutUint16(b, uint16(len(b)))
+	b = append(b, le16(uint16(len(h.allocs)))...)
+	b = append(b, 0, 0)
+	for _, off := range offsets {
+		b = append(b, le16(uint16(off))...)
+	}
+	return b
+}
+
+// pc stores a property context.
+func (w *pstWriter) pc(props ...pstWriterProp) uint64 {
+	h := &pstHeapWriter{}
+	sort.Slice(props, func(i, j int) bool { return props[i].id < props[j].id })
+	var records [][]byte
+	for _, p := range props {
+		rec := append(le16(p.id), le16(p.typ)...)
+		switch size := pstFixedSize(p.typ); {
+		case p.hnid != 0:
+			rec = append(rec, le32(p.hnid)...)
+		case size > 0 && size <= 4:
+			rec = append(rec, append(append([]byte{}, p.value...), 0, 0, 0, 0)[:4]...)
+		default:
+			rec = append(rec, le32(h.alloc(p.value))...)
+		}
+		records = append(records, rec)
+	}
+	return w.data(h.bytes(0xBC, h.bth(2, 6, records)))
+}
+
+// tc stores a table context with the given columns, which must have 4 byte cells. The row id and version
+// columns are added.
+func (w *pstWriter) tc(columns []uint32, rows ...pstWriterRow) uint64 {
+	h := &pstHeapWriter{}
+	columns = append([]uint32{0x67F20003, 0x67F30003}, columns...)
+	sort.Slice(columns[2:], func(i, j int) bool { return columns[2+i] < columns[2+j] })
+	end := 4 * len(columns)
+	rowSize := end + (len(columns)+7)/8
+	var matrix, index []byte
+	for i, row := range rows {
+		cells := make([]byte, rowSize)
+		props := append([]pstWriterProp{{id: 0x67F2, typ: pstTypeInt32, value: le32(row.id)},
+			{id: 0x67F3, typ: pstTypeInt32, value: le32(1)}}, row.props...)
+		for _, p := range props {
+			for c, tag := range columns {
+				if tag != uint32(p.id)<<16|uint32(p.typ) {
+					continue
+				}
+				if pstFixedSize(p.typ) > 0 {
+					copy(cells[4*c:], p.value)
+				} else {
+					copy(cells[4*c:], le32(h.alloc(p.value)))
+				}
+				cells[end+c/8] |= 0x80 >> uint(c%8)
+			}
+		}
+		matrix = append(matrix, cells...)
+		index = append(index, le32(row.id)...)
+		if w.unicode {
+			index = append(index, le32(uint32(i))...)
+		} else {
+			index = append(index, le16(uint16(i))...)
+		}
+	}
+	var rowIndex [][]byte
+	size := 6
+	if w.unicode {
+		size = 8
+	}
+	for i := 0; i < len(index); i += size {
+		rowIndex = append(rowIndex, index[i:i+size])
+	}
+	var hnidRows uint32
+	if len(rows) > 0 {
+		hnidRows = h.alloc(matrix)
+	}
+	info := append([]byte{0x7C, byte(len(columns))}, le16(uint16(end))...)
+	info = append(info, le16(uint16(end))...)
+	info = append(info, le16(uint16(end))...)
+	info = append(info, le16(uint16(rowSize))...)
+	info = append(info, le32(h.bth(4, byte(size-4), rowIndex))...)
+	info = append(info, le32(hnidRows)...)
+	info = append(info, 0, 0, 0, 0)
+	for c, tag := range columns {
+		info = append(append(info, le32(tag)...), le16(uint16(4*c))...)
+		info = append(info, 4, byte(c))
+	}
+	return w.data(h.bytes(0x7C, h.alloc(info)))
+}
+
+// rowIDs stores a table, which lists nodes by id only.
+func (w *pstWriter) rowIDs(ids ...uint32) uint64 {
+	var rows []pstWriterRow
+	for _, id := range ids {
+		rows = append(rows, pstWriterRow{id: id})
+	}
+	return w.tc(nil, rows...)
+}
+
+// page appends a b-tree page and returns its id and offset.
+func (w *pstWriter) page(pageType, level byte, entrySize int, entries [][]byte) (uint64, uint64) {
+	meta, trailer := 496, 500
+	if w.unicode {
+		meta, trailer = 488, 496
+	}
+	p := make([]byte, pstPageSize)
+	for i, e := range entries {
+		copy(p[i*entrySize:], e)
+	}
+	p[meta], p[meta+1], p[meta+2], p[meta+3] = byte(len(entries)), byte(w.entries(entrySize)), byte(entrySize), level
+	bid := w.bid()
+	ib := uint64(len(w.buf))
+	p[trailer], p[trailer+1] = pageType, pageType
+	binary.LittleEndian.PutUint16(p[trailer+2:], pstSig(ib, bid))
+	if w.unicode {
+		binary.LittleEndian.PutUint32(p[trailer+4:], pstCRC(p[:trailer]))
+		binary.LittleEndian.PutUint64(p[trailer+8:], bid)
+	} else {
+		binary.LittleEndian.PutUint32(p[trailer+4:], uint32(bid))
+		binary.LittleEndian.PutUint32(p[trailer+8:], pstCRC(p[:trailer]))
+	}
+	w.buf = append(w.buf, p...)
+	return bid, ib
+}
+
+// btree appends the pages of a b-tree with the given leaf entries and returns the id and offset of the root.
+func (w *pstWriter) btree(pageType byte, entries [][]byte) (uint64, uint64) {
+	for level := byte(0); ; level++ {
+		perPage := w.entries(len(entries[0]))
+		var parents [][]byte
+		for start := 0; start < len(entries); start += perPage {
+			end := start + perPage
+			if end > len(entries) {
+				end = len(entries)
+			}
+			bid, ib := w.page(pageType, level, len(entries[0]), entries[start:end])
+			if len(entries) <= perPage {
+				return bid, ib
+			}
+			key := entries[start][:len(w.id(0))]
+			parents = append(parents, append(append(append([]byte{}, key...), w.id(bid)...), w.id(ib)...))
+		}
+		entries = parents
+	}
+}
+
+// bytes writes the b-trees and the header and returns the file.
+func (w *pstWriter) bytes() []byte {
+	sort.Slice(w.blocks, func(i, j int) bool { return w.blocks[i].bid < w.blocks[j].bid })
+	var bbt [][]byte
+	for _, b := range w.blocks {
+		// the reference count of each block is 1
+		e := append(append(append(w.id(b.bid), w.id(b.ib)...), le16(uint16(b.size))...), 1, 0)
+		if w.unicode {
+			e = append(e, 0, 0, 0, 0)
+		}
+		bbt = append(bbt, e)
+	}
+	sort.Slice(w.nodes, func(i, j int) bool { return w.nodes[i].nid < w.nodes[j].nid })
+	var nbt [][]byte
+	for _, n := range w.nodes {
+		e := append(append(append(w.id(uint64(n.nid)), w.id(n.bidData)...), w.id(n.bidSub)...), le32(n.parent)...)
+		if w.unicode {
+			e = append(e, 0, 0, 0, 0)
+		}
+		nbt = append(nbt, e)
+	}
+	for len(w.buf)%pstPageSize != 0 {
+		w.buf = append(w.buf, 0)
+	}
+	nbtBid, nbtIb := w.btree(pstPageTypeNBT, nbt)
+	bbtBid, bbtIb := w.btree(pstPageTypeBBT, bbt)
+
+	h := w.buf
+	copy(h, "!BDN")
+	copy(h[8:], "SM")
+	binary.LittleEndian.PutUint16(h[12:], 19)
+	h[14], h[15] = 1, 1
+	if w.unicode {
+		binary.LittleEndian.PutUint16(h[10:], 23)
+		binary.LittleEndian.PutUint64(h[32:], w.nextBid)
+		binary.LittleEndian.PutUint64(h[184:], uint64(len(w.buf)))
+		binary.LittleEndian.PutUint64(h[216:], nbtBid)
+		binary.LittleEndian.PutUint64(h[224:], nbtIb)
+		binary.LittleEndian.PutUint64(h[232:], bbtBid)
+		binary.LittleEndian.PutUint64(h[240:], bbtIb)
+		h[512], h[513] = 0x80, w.crypt
+		binary.LittleEndian.PutUint64(h[516:], w.nextBid)
+		binary.LittleEndian.PutUint32(h[524:], pstCRC(h[8:524]))
+	} else {
+		binary.LittleEndian.PutUint16(h[10:], 14)
+		binary.LittleEndian.PutUint32(h[24:], uint32(w.nextBid))
+		binary.LittleEndian.PutUint32(h[28:], uint32(w.nextBid))
+		binary.LittleEndian.PutUint32(h[168:], uint32(len(w.buf)))
+		binary.LittleEndian.PutUint32(h[184:], uint32(nbtBid))
+		binary.LittleEndian.PutUint32(h[188:], uint32(nbtIb))
+		binary.LittleEndian.PutUint32(h[192:], uint32(bbtBid))
+		binary.LittleEndian.PutUint32(h[196:], uint32(bbtIb))
+		h[460], h[461] = 0x80, w.crypt
+	}
+	binary.LittleEndian.PutUint32(h[4:], pstCRC(h[8:8+471]))
+	return w.buf
+}
+
+// The node ids of the sample.
+const (
+	sampleTop      = 0x8022
+	sampleInbox    = 0x8042
+	sampleSub      = 0x8082
+	sampleAB       = 0x8062
+	sampleReceived = 0x200024
+	sampleContact  = 0x200044
+	sampleComposed = 0x200064
+	sampleANSI     = 0x200084
+)
+
+// filetime converts unix seconds to a FILETIME.
+func filetime(sec int64) []byte {
+	return le64(uint64(sec*1e7 + 116444736000000000))
+}
+
+// samplePst builds a pst file with the folders Inbox with the subfolder Sub and A/B. The Inbox holds a received
+// mail with a large html body and an attachment, a contact and a composed mail with two recipients and an attached
+// message, Sub holds a mail with ANSI strings. The unicode sample uses the compressible encryption.
+func samplePst(unicode bool) *pstWriter {
+	crypt := byte(pstCryptNone)
+	if unicode {
+		crypt = pstCryptPermute
+	}
+	w := newPstWriter(unicode, crypt)
+	entryID := append(make([]byte, 20), le32(sampleTop)...)
+	w.node(pstNidMessageStore, 0, w.pc(pstWriterProp{id: pstPropIpmSubTree, typ: pstTypeBinary, value: entryID},
+		w.str(pstPropDisplayName, "Personal Folders")), 0)
+
+	folder := func(nid, parent uint32, name string, children, messages []uint32) {
+		w.node(nid, parent, w.pc(w.str(pstPropDisplayName, name)), 0)
+		w.node(nid&^0x1F|pstNidTypeHierarchyTable, nid, w.rowIDs(children...), 0)
+		w.node(nid&^0x1F|pstNidTypeContentsTable, nid, w.rowIDs(messages...), 0)
+	}
+	folder(sampleTop, sampleTop, "Top of Personal Folders", []uint32{sampleInbox, sampleAB}, nil)
+	folder(sampleInbox, sampleTop, "Inbox", []uint32{sampleSub}, []uint32{sampleReceived, sampleContact, sampleComposed})
+	folder(sampleAB, sampleTop, "A/B", nil, nil)
+	folder(sampleSub, sampleInbox, "Sub", nil, []uint32{sampleANSI})
+
+	// the body is too large for the heap, so it is a subnode split into several blocks
+	body := w.str(pstPropBody, strings.Repeat("line of the big body\r\n", 600))
+	body.hnid = 0x803F
+	bodyBid := w.data(body.value)
+	attachment := w.pc(
+		w.str(pstPropAttachLongName, "report.pdf"),
+		pstWriterProp{id: pstPropAttachMethod, typ: pstTypeInt32, value: le32(1)},
+		pstWriterProp{id: pstPropAttachData, typ: pstTypeBinary, value: []byte("%PDF-1.4 binary\x00\x01\x02")},
+		w.str(pstPropAttachMimeTag, "application/pdf"))
+	headers := "Return-Path: <x@example.com>\r\nFrom: Sender <sender@example.com>\r\nTo: me@example.com\r\n" +
+		"Subject: received\r\nDate: Wed, 01 Jan 2020 12:00:00 +0000\r\nMessage-ID: <m1@example.com>\r\n" +
+		"MIME-Version: 1.0\r\nContent-Type: multipart/alternative;\r\n\tboundary=\"old\"\r\n\r\n"
+	received := w.pc(
+		w.str(pstPropMessageClass, "IPM.Note"),
+		w.str(pstPropSubject, "received"),
+		w.str(pstPropTransportHeaders, headers),
+		pstWriterProp{id: pstPropDeliveryTime, typ: pstTypeTime, value: filetime(1577880000)},
+		body,
+		pstWriterProp{id: pstPropHTML, typ: pstTypeBinary, value: []byte("<p>caf\xe9</p>")},
+		pstWriterProp{id: 0x3FDE, typ: pstTypeInt32, value: le32(1252)})
+	w.node(sampleReceived, sampleInbox, received, w.subnodes(
+		pstWriterNode{nid: body.hnid, bidData: bodyBid},
+		pstWriterNode{nid: pstNidAttachmentTable, bidData: w.rowIDs(0x8025)},
+		pstWriterNode{nid: 0x8025, bidData: attachment}))
+
+	w.node(sampleContact, sampleInbox, w.pc(w.str(pstPropMessageClass, "IPM.Contact")), 0)
+
+	recipients := w.tc([]uint32{pstPropRecipientType<<16 | pstTypeInt32,
+		pstPropDisplayName<<16 | uint32(w.stringType()), pstPropSmtpAddress<<16 | uint32(w.stringType())},
+		pstWriterRow{id: 1, props: []pstWriterProp{{id: pstPropRecipientType, typ: pstTypeInt32, value: le32(1)},
+			w.str(pstPropDisplayName, "Alice"), w.str(pstPropSmtpAddress, "alice@example.com")}},
+		pstWriterRow{id: 2, props: []pstWriterProp{{id: pstPropRecipientType, typ: pstTypeInt32, value: le32(2)},
+			w.str(pstPropDisplayName, "Bob Müller"), w.str(pstPropSmtpAddress, "bob@example.com")}})
+	inner := w.pc(w.str(pstPropMessageClass, "IPM.Note"), w.str(pstPropSubject, "inner"),
+		w.str(pstPropBody, "inner body"))
+	// the object value refers to the subnode of the attachment, which holds the message
+	attached := w.pc(pstWriterProp{id: pstPropAttachMethod, typ: pstTypeInt32, value: le32(pstAttachEmbedded)},
+		pstWriterProp{id: pstPropAttachData, typ: pstTypeObject, value: append(le32(0x8064), le32(10)...)})
+	composed := w.pc(
+		w.str(pstPropMessageClass, "IPM.Note"),
+		w.str(pstPropSubject, "\x01\x04RE: Hallo Ü"),
+		pstWriterProp{id: pstPropSubmitTime, typ: pstTypeTime, value: filetime(1609502400)},
+		w.str(pstPropSenderName, "Me"),
+		w.str(pstPropSenderAddress, "/O=EXCHANGE/CN=ME"),
+		w.str(pstPropSenderSmtpAddress, "me@example.com"),
+		w.str(pstPropBody, "hello"),
+		w.str(pstPropMessageID, "<m2@example.com>"))
+	w.node(sampleComposed, sampleInbox, composed, w.subnodes(
+		pstWriterNode{nid: pstNidRecipientTable, bidData: recipients},
+		pstWriterNode{nid: pstNidAttachmentTable, bidData: w.rowIDs(0x8045)},
+		pstWriterNode{nid: 0x8045, bidData: attached, bidSub: w.subnodes(pstWriterNode{nid: 0x8064, bidData: inner})}))
+
+	w.node(sampleANSI, sampleSub, w.pc(
+		pstWriterProp{id: pstPropMessageClass, typ: pstTypeString8, value: []byte("IPM.Note\x00")},
+		pstWriterProp{id: pstPropSubject, typ: pstTypeString8, value: []byte("Gr\xfc\xdfe\x00")},
+		pstWriterProp{id: pstPropBody, typ: pstTypeString8, value: []byte("text\x00")},
+		pstWriterProp{id: 0x3FFD, typ: pstTypeInt32, value: le32(1252)}), 0)
+	return w
+}
+
+// pstFormats names the formats of the samples.
+var pstFormats = map[bool]string{true: "unicode", false: "ansi"}
+
+func writeSamplePst(t *testing.T, b []byte) string {
+	file := filepath.Join(t.TempDir(), "sample.pst")
+	if err := ioutil.WriteFile(file, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// pstMails converts all mails of the file by folder and subject.
+func pstMails(p *pstFile) (map[string]string, error) {
+	res := make(map[string]string)
+	err := p.walk(func(folder []string, node *pstNode) error {
+		msg, err := p.message(node)
+		if err != nil {
+			return err
+		}
+		if !msg.isMail() {
+			return nil
+		}
+		eml, err := msg.eml()
+		if err != nil {
+			return err
+		}
+		res[strings.Join(append(folder, msg.subject()), "|")] = string(eml)
+		return nil
+	})
+	return res, err
+}
+
+func TestPstMessages(t *testing.T) {
+	for unicode, format := range pstFormats {
+		p, err := newPstFile(bytes.NewReader(samplePst(unicode).bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.unicode != unicode {
+			t.Fatalf("%s: read as unicode %t", format, p.unicode)
+		}
+		mails, err := pstMails(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(mails) != 3 {
+			t.Fatalf("%s: expected 3 mails, got %d: %v", format, len(mails), mails)
+		}
+
+		received := mails["Inbox|received"]
+		for _, s := range []string{"Message-ID: <m1@example.com>", "text/html; charset=windows-1252", "caf=E9",
+			"filename=report.pdf", "application/pdf", "line of the big body"} {
+			if !strings.Contains(received, s) {
+				t.Errorf("%s: received mail does not contain %q", format, s)
+			}
+		}
+		if strings.Contains(received, `boundary="old"`) {
+			t.Errorf("%s: the original content type must be replaced", format)
+		}
+
+		composed := mails["Inbox|RE: Hallo Ü"]
+		for _, s := range []string{`To: "Alice" <alice@example.com>`, "Cc: =?utf-8?q?Bob_M=C3=BCller?= <bob@example.com>",
+			"Message-ID: <m2@example.com>", "message/rfc822", "Subject: inner", "hello"} {
+			if !strings.Contains(composed, s) {
+				t.Errorf("%s: composed mail does not contain %q", format, s)
+			}
+		}
+
+		if ansi, ok := mails["Inbox|Sub|Grüße"]; !ok || !strings.Contains(ansi, "text") {
+			t.Errorf("%s: missing mail with ANSI strings: %v", format, mails)
+		}
+	}
+}
+
+func TestPstImport(t *testing.T) {
+	for unicode, format := range pstFormats {
+		src := writeSamplePst(t, samplePst(unicode).bytes())
+		dir := t.TempDir()
+		for i := 0; i < 2; i++ {
+			im := NewImporter(dir, nil, false)
+			if err := im.Import(src, ""); err != nil {
+				t.Fatal(err)
+			}
+			reports, err := im.Finish()
+			if err != nil {
+				t.Fatal(err)
+			}
+			total := 0
+			for _, r := range reports {
+				total += r.Total
+				if r.Failed > 0 {
+					t.Errorf("%s: %s: %d failed", format, r.Name, r.Failed)
+				}
+				if i == 1 && r.New > 0 {
+					t.Errorf("%s: %s: imported %d mails again", format, r.Name, r.New)
+				}
+			}
+			if total != 3 {
+				t.Fatalf("%s: expected 3 mails, got %d", format, total)
+			}
+		}
+		report, err := Fsck(nil, dir, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range report.Problems {
+			t.Errorf("%s: %v", format, p)
+		}
+	}
+}
+
+// TestPstCorrupt reads truncated and damaged copies of the samples, which must fail with errors instead of panics.
+func TestPstCorrupt(t *testing.T) {
+	for unicode, format := range pstFormats {
+		sample := samplePst(unicode).bytes()
+		read := func(name string, b []byte) {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Fatalf("%s: %s: panic: %v", format, name, r)
+				}
+			}()
+			p, err := newPstFile(bytes.NewReader(b))
+			if err != nil {
+				return
+			}
+			pstMails(p)
+		}
+
+		for size := 0; size < len(sample); size += 97 {
+			read("truncated", sample[:size])
+		}
+		for off := 512; off < len(sample); off += 31 {
+			for _, v := range []byte{0x00, 0x01, 0x08, 0x12, 0x7F, 0xFF} {
+				b := append([]byte{}, sample...)
+				b[off] = v
+				read("damaged", b)
+			}
+		}
+	}
+}
+
+// TestPstImportCorrupt imports a file with a damaged message, which fails alone, and a truncated file, which
+// cannot be imported at all.
+func TestPstImportCorrupt(t *testing.T) {
+	for unicode, format := range pstFormats {
+		w := samplePst(unicode)
+		sample := w.bytes()
+		// the heap signature of the composed mail
+		damaged := append([]byte{}, sample...)
+		damaged[w.offset(sampleComposed)+2] = 0
+
+		im := NewImporter(t.TempDir(), nil, false)
+		if err := im.Import(writeSamplePst(t, damaged), ""); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		reports, err := im.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []MailboxReport{{Name: "Inbox", Total: 2, New: 1, Failed: 1}, {Name: "Inbox/Sub", Total: 1, New: 1}}
+		if len(reports) != len(expected) {
+			t.Fatalf("%s: expected %d reports, got %d", format, len(expected), len(reports))
+		}
+		for i, r := range reports {
+			r.Bytes = 0
+			if *r != expected[i] {
+				t.Errorf("%s: expected %+v, got %+v", format, expected[i], *r)
+			}
+		}
+
+		im = NewImporter(t.TempDir(), nil, false)
+		err = im.Import(writeSamplePst(t, sample[:100]), "")
+		if !errors.Is(err, io.EOF) || !strings.Contains(err.Error(), "cannot read header") {
+			t.Errorf("%s: expected error reading the header, got %v", format, err)
+		}
+		if reports, err := im.Finish(); err != nil || len(reports) != 0 {
+			t.Errorf("%s: expected no reports, got %v %v", format, reports, err)
+		}
+	}
+}
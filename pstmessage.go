@@ -0,0 +1,535 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The property ids of the messaging layer, which are needed to convert messages.
+const (
+	pstPropMessageClass      = 0x001A
+	pstPropSubject           = 0x0037
+	pstPropSubmitTime        = 0x0039
+	pstPropSentRepName       = 0x0042
+	pstPropSentRepAddress    = 0x0065
+	pstPropTransportHeaders  = 0x007D
+	pstPropRecipientType     = 0x0C15
+	pstPropSenderName        = 0x0C1A
+	pstPropSenderAddress     = 0x0C1F
+	pstPropDisplayBcc        = 0x0E02
+	pstPropDisplayCc         = 0x0E03
+	pstPropDisplayTo         = 0x0E04
+	pstPropDeliveryTime      = 0x0E06
+	pstPropBody              = 0x1000
+	pstPropRtfCompressed     = 0x1009
+	pstPropHTML              = 0x1013
+	pstPropMessageID         = 0x1035
+	pstPropReferences        = 0x1039
+	pstPropInReplyTo         = 0x1042
+	pstPropDisplayName       = 0x3001
+	pstPropEmailAddress      = 0x3003
+	pstPropCreationTime      = 0x3007
+	pstPropIpmSubTree        = 0x35E0
+	pstPropAttachData        = 0x3701
+	pstPropAttachFilename    = 0x3704
+	pstPropAttachMethod      = 0x3705
+	pstPropAttachLongName    = 0x3707
+	pstPropAttachMimeTag     = 0x370E
+	pstPropAttachContentID   = 0x3712
+	pstPropSmtpAddress       = 0x39FE
+	pstPropSenderSmtpAddress = 0x5D01
+	pstPropSentRepSmtp       = 0x5D02
+)
+
+// pstAttachEmbedded is the attach method of attached messages.
+const pstAttachEmbedded = 5
+
+// pstMailClasses are the prefixes of the message classes of mails. Contacts, appointments, tasks and notes are
+// not imported.
+var pstMailClasses = []string{"IPM.Note", "IPM.Post", "IPM.Schedule.Meeting", "REPORT.IPM.Note"}
+
+// mimeHeaders are replaced in the transport headers of a received mail, because the body is rebuilt.
+var mimeHeaders = regexp.MustCompile(`(?im)^(Content-[a-z-]+|MIME-Version):.*\r\n(?:[ \t].*\r\n)*`)
+
+// walk calls fn for each message below the root of the visible folders. The path of the folder excludes the
+// name of the root, which is "Top of Personal Folders" or similar.
+func (p *pstFile) walk(fn func(folder []string, msg *pstNode) error) error {
+	root := uint32(pstNidRootFolder)
+	if store, err := p.node(pstNidMessageStore); err == nil {
+		if props, err := store.props(); err == nil {
+			// the entry id consists of 4 bytes flags, the 16 bytes uid of the store and the node id
+			if id := props.bytes(pstPropIpmSubTree); len(id) == 24 {
+				root = binary.LittleEndian.Uint32(id[20:])
+			}
+		}
+	}
+	return p.walkFolder(root, nil, fn)
+}
+
+func (p *pstFile) walkFolder(nid uint32, folder []string, fn func(folder []string, msg *pstNode) error) error {
+	if len(folder) > pstMaxDepth {
+		return nil
+	}
+	if contents, err := p.node(nid&^0x1F | pstNidTypeContentsTable); err == nil {
+		table, err := contents.table()
+		if err != nil {
+			logger.Warn("cannot read folder", "folder", strings.Join(folder, importDelimiter), "err", err)
+		} else {
+			for _, id := range table.rowIDs() {
+				msg, err := p.node(id)
+				if err != nil {
+					logger.Warn("cannot read message", "folder", strings.Join(folder, importDelimiter), "err", err)
+					continue
+				}
+				if err := fn(folder, msg); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	hierarchy, err := p.node(nid&^0x1F | pstNidTypeHierarchyTable)
+	if err != nil {
+		return nil
+	}
+	table, err := hierarchy.table()
+	if err != nil {
+		logger.Warn("cannot read subfolders", "folder", strings.Join(folder, importDelimiter), "err", err)
+		return nil
+	}
+	for _, id := range table.rowIDs() {
+		child, err := p.node(id)
+		if err != nil {
+			logger.Warn("cannot read subfolder", "folder", strings.Join(folder, importDelimiter), "err", err)
+			continue
+		}
+		props, err := child.props()
+		if err != nil {
+			logger.Warn("cannot read subfolder", "folder", strings.Join(folder, importDelimiter), "err", err)
+			continue
+		}
+		// the delimiter separates the levels of the mailbox name
+		name := strings.Replace(props.string(pstPropDisplayName), importDelimiter, "_", -1)
+		if err := p.walkFolder(id, append(append([]string{}, folder...), name), fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pstMessage is a message with its recipients and attachments.
+type pstMessage struct {
+	node  *pstNode
+	props pstProps
+}
+
+func (p *pstFile) message(n *pstNode) (*pstMessage, error) {
+	props, err := n.props()
+	if err != nil {
+		return nil, err
+	}
+	return &pstMessage{node: n, props: props}, nil
+}
+
+// isMail returns true for mails, meeting requests and delivery reports.
+func (m *pstMessage) isMail() bool {
+	class := m.props.string(pstPropMessageClass)
+	if len(class) == 0 {
+		return true
+	}
+	for _, prefix := range pstMailClasses {
+		if strings.HasPrefix(strings.ToUpper(class), strings.ToUpper(prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// date returns the time the message was received, sent or created.
+func (m *pstMessage) date() time.Time {
+	for _, id := range []uint16{pstPropDeliveryTime, pstPropSubmitTime, pstPropCreationTime} {
+		if t := m.props.time(id); !t.IsZero() {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (m *pstMessage) subject() string {
+	subject := m.props.string(pstPropSubject)
+	// a leading \x01 is followed by the length of the prefix like "RE: ", which is part of the subject
+	if len(subject) >= 2 && subject[0] == 1 {
+		subject = subject[2:]
+	}
+	return subject
+}
+
+// recipients returns the header fields To, Cc and Bcc.
+func (m *pstMessage) recipients() map[string][]string {
+	res := make(map[string][]string)
+	fields := map[int64]string{1: "To", 2: "Cc", 3: "Bcc"}
+	if sub, err := m.node.sub(pstNidRecipientTable); err == nil {
+		if table, err := sub.table(); err == nil {
+			for _, row := range table.rows {
+				props := table.props(row)
+				kind, _ := props.int(pstPropRecipientType)
+				if field, ok := fields[kind]; ok {
+					res[field] = append(res[field], formatAddress(props.string(pstPropDisplayName),
+						props.string(pstPropSmtpAddress), props.string(pstPropEmailAddress)))
+				}
+			}
+			return res
+		}
+	}
+	// without a recipient table, only the display names are known
+	for id, field := range map[uint16]string{pstPropDisplayTo: "To", pstPropDisplayCc: "Cc", pstPropDisplayBcc: "Bcc"} {
+		for _, name := range strings.Split(m.props.string(id), ";") {
+			if name = strings.TrimSpace(name); len(name) > 0 {
+				res[field] = append(res[field], formatAddress(name, "", ""))
+			}
+		}
+	}
+	return res
+}
+
+// formatAddress prefers the smtp address, because exchange addresses are no valid mail addresses. Recipients
+// without any mail address are written by name only.
+func formatAddress(name, smtp, address string) string {
+	if len(smtp) == 0 {
+		smtp = address
+	}
+	if !strings.Contains(smtp, "@") {
+		if len(name) == 0 {
+			name = smtp
+		}
+		return mime.QEncoding.Encode("utf-8", name)
+	}
+	return (&mail.Address{Name: name, Address: smtp}).String()
+}
+
+// eml converts the message to RFC822. Received mails keep their original header, except for the MIME fields,
+// which describe the rebuilt body. Otherwise the header is built from the properties of the message.
+func (m *pstMessage) eml() ([]byte, error) {
+	return m.render(0)
+}
+
+func (m *pstMessage) render(depth int) ([]byte, error) {
+	if depth > pstMaxDepth {
+		return nil, errors.New("too many nested messages")
+	}
+	body, err := m.body(depth)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	if headers := m.props.string(pstPropTransportHeaders); len(strings.TrimSpace(headers)) > 0 {
+		headers = strings.Replace(strings.Replace(headers, "\r\n", "\n", -1), "\n", "\r\n", -1)
+		headers = strings.TrimRight(headers, "\r\n") + "\r\n"
+		buf.WriteString(mimeHeaders.ReplaceAllString(headers, ""))
+	} else {
+		writeField := func(name, value string) {
+			if len(value) > 0 {
+				fmt.Fprintf(buf, "%s: %s\r\n", name, value)
+			}
+		}
+		if date := m.props.time(pstPropSubmitTime); !date.IsZero() {
+			writeField("Date", date.UTC().Format(time.RFC1123Z))
+		} else if date := m.date(); !date.IsZero() {
+			writeField("Date", date.UTC().Format(time.RFC1123Z))
+		}
+		if name := m.props.string(pstPropSenderName); len(name) > 0 || len(m.props.string(pstPropSenderAddress)) > 0 {
+			writeField("From", formatAddress(name, m.props.string(pstPropSenderSmtpAddress),
+				m.props.string(pstPropSenderAddress)))
+		} else {
+			writeField("From", formatAddress(m.props.string(pstPropSentRepName), m.props.string(pstPropSentRepSmtp),
+				m.props.string(pstPropSentRepAddress)))
+		}
+		writeField("Subject", mime.QEncoding.Encode("utf-8", m.subject()))
+		recipients := m.recipients()
+		for _, field := range []string{"To", "Cc", "Bcc"} {
+			writeField(field, strings.Join(recipients[field], ", "))
+		}
+		writeField("Message-ID", m.props.string(pstPropMessageID))
+		writeField("In-Reply-To", m.props.string(pstPropInReplyTo))
+		writeField("References", m.props.string(pstPropReferences))
+	}
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	body.writeTo(buf)
+	return buf.Bytes(), nil
+}
+
+// mimePart is a part of a rebuilt mail.
+type mimePart struct {
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+func (p *mimePart) writeTo(buf *bytes.Buffer) {
+	keys := make([]string, 0, len(p.header))
+	for key := range p.header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, value := range p.header[key] {
+			fmt.Fprintf(buf, "%s: %s\r\n", key, value)
+		}
+	}
+	buf.WriteString("\r\n")
+	buf.Write(p.body)
+}
+
+func textPart(contentType string, text []byte) *mimePart {
+	body := &bytes.Buffer{}
+	w := quotedprintable.NewWriter(body)
+	w.Write(text)
+	w.Close()
+	return &mimePart{
+		header: textproto.MIMEHeader{"Content-Type": {contentType}, "Content-Transfer-Encoding": {"quoted-printable"}},
+		body:   body.Bytes(),
+	}
+}
+
+func binaryPart(header textproto.MIMEHeader, b []byte) *mimePart {
+	header.Set("Content-Transfer-Encoding", "base64")
+	body := &bytes.Buffer{}
+	encoded := base64.StdEncoding.EncodeToString(b)
+	for len(encoded) > 76 {
+		body.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	body.WriteString(encoded + "\r\n")
+	return &mimePart{header: header, body: body.Bytes()}
+}
+
+// multipartPart combines parts. The boundary is derived from the parts, so that converting the same message
+// twice yields the same header hash.
+func multipartPart(subtype string, parts []*mimePart) *mimePart {
+	if len(parts) == 1 {
+		return parts[0]
+	}
+	h := sha256.New224()
+	for _, part := range parts {
+		h.Write(part.body)
+	}
+	boundary := "imaparc-" + hex.EncodeToString(h.Sum(nil))[:32]
+
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+	w.SetBoundary(boundary)
+	for _, part := range parts {
+		pw, _ := w.CreatePart(part.header)
+		pw.Write(part.body)
+	}
+	w.Close()
+	return &mimePart{
+		header: textproto.MIMEHeader{"Content-Type": {mime.FormatMediaType("multipart/"+subtype,
+			map[string]string{"boundary": boundary})}},
+		body: body.Bytes(),
+	}
+}
+
+// body builds the text and html bodies as alternatives and adds the attachments.
+func (m *pstMessage) body(depth int) (*mimePart, error) {
+	var alternatives []*mimePart
+	if text := m.props.string(pstPropBody); len(text) > 0 {
+		alternatives = append(alternatives, textPart("text/plain; charset=utf-8", []byte(text)))
+	}
+	if html, ok := m.props[pstPropHTML]; ok && len(html.value) > 0 {
+		if html.typ == pstTypeString {
+			alternatives = append(alternatives, textPart("text/html; charset=utf-8", []byte(m.props.string(pstPropHTML))))
+		} else {
+			alternatives = append(alternatives, textPart("text/html; charset="+m.props.charset(), html.value))
+		}
+	}
+	var parts []*mimePart
+	if len(alternatives) > 0 {
+		parts = append(parts, multipartPart("alternative", alternatives))
+	} else if rtf := m.props.bytes(pstPropRtfCompressed); len(rtf) > 0 {
+		// messages without any other body are attached as rtf
+		if b, err := decompressRtf(rtf); err == nil {
+			parts = append(parts, binaryPart(textproto.MIMEHeader{
+				"Content-Type":        {"application/rtf"},
+				"Content-Disposition": {mime.FormatMediaType("attachment", map[string]string{"filename": "body.rtf"})},
+			}, b))
+		} else {
+			logger.Debug("ignoring rtf body", "node", m.node.nid, "err", err)
+		}
+	}
+	if len(parts) == 0 {
+		parts = append(parts, textPart("text/plain; charset=utf-8", nil))
+	}
+
+	attachments, err := m.attachments(depth)
+	if err != nil {
+		return nil, err
+	}
+	parts = append(parts, attachments...)
+	return multipartPart("mixed", parts), nil
+}
+
+// attachments converts the attached files and messages.
+func (m *pstMessage) attachments(depth int) ([]*mimePart, error) {
+	sub, err := m.node.sub(pstNidAttachmentTable)
+	if err != nil {
+		return nil, nil
+	}
+	table, err := sub.table()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read attachments: %w", err)
+	}
+	var res []*mimePart
+	for _, id := range table.rowIDs() {
+		node, err := m.node.sub(id)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read attachment: %w", err)
+		}
+		props, err := node.props()
+		if err != nil {
+			return nil, fmt.Errorf("cannot read attachment: %w", err)
+		}
+		name := props.string(pstPropAttachLongName)
+		if len(name) == 0 {
+			name = props.string(pstPropAttachFilename)
+		}
+		if len(name) == 0 {
+			name = props.string(pstPropDisplayName)
+		}
+		header := textproto.MIMEHeader{}
+
+		if method, _ := props.int(pstPropAttachMethod); method == pstAttachEmbedded {
+			embedded, err := embeddedMessage(node, props[pstPropAttachData])
+			if err != nil {
+				return nil, fmt.Errorf("cannot read attached message: %w", err)
+			}
+			eml, err := embedded.render(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if len(name) == 0 {
+				name = embedded.subject()
+			}
+			header.Set("Content-Type", "message/rfc822")
+			header.Set("Content-Disposition", mime.FormatMediaType("attachment",
+				map[string]string{"filename": strings.TrimSuffix(name, ".eml") + ".eml"}))
+			res = append(res, &mimePart{header: header, body: eml})
+			continue
+		}
+
+		contentType := props.string(pstPropAttachMimeTag)
+		if len(contentType) == 0 {
+			if ext := strings.LastIndex(name, "."); ext >= 0 {
+				contentType = mime.TypeByExtension(name[ext:])
+			}
+		}
+		if len(contentType) == 0 {
+			contentType = "application/octet-stream"
+		}
+		header.Set("Content-Type", contentType)
+		disposition := "attachment"
+		if cid := props.string(pstPropAttachContentID); len(cid) > 0 {
+			disposition = "inline"
+			header.Set("Content-ID", "<"+strings.Trim(cid, "<>")+">")
+		}
+		params := map[string]string{}
+		if len(name) > 0 {
+			params["filename"] = name
+		}
+		header.Set("Content-Disposition", mime.FormatMediaType(disposition, params))
+		res = append(res, binaryPart(header, props.bytes(pstPropAttachData)))
+	}
+	return res, nil
+}
+
+// embeddedMessage returns the message attached to the attachment node. The value of the object property refers
+// to a subnode of the attachment, which holds the message.
+func embeddedMessage(attachment *pstNode, data pstProp) (*pstMessage, error) {
+	nid := data.hnid
+	if nid&0x1F == 0 {
+		if len(data.value) < 4 {
+			return nil, errors.New("missing object data")
+		}
+		nid = binary.LittleEndian.Uint32(data.value)
+	}
+	node, err := attachment.sub(nid)
+	if err != nil {
+		return nil, err
+	}
+	return attachment.p.message(node)
+}
+
+// rtfDictionary initializes the dictionary of compressed rtf.
+const rtfDictionary = `{\rtf1\ansi\mac\deff0\deftab720{\fonttbl;}{\f0\fnil \froman \fswiss \fmodern \fscript \fdecor MS Sans ` +
+	`SerifSymbolArialTimes New RomanCourier{\colortbl\red0\green0\blue0` + "\r\n" + `\par \pard\plain\f0\fs20\b\i\u\tab\tx`
+
+// decompressRtf decodes the LZFu compression of rtf bodies as specified by [MS-OXRTFCP].
+func decompressRtf(b []byte) ([]byte, error) {
+	if len(b) < 16 {
+		return nil, errors.New("rtf header too short")
+	}
+	size := int(binary.LittleEndian.Uint32(b[4:]))
+	switch string(b[8:12]) {
+	case "MELA":
+		if 16+size > len(b) {
+			return nil, errors.New("rtf truncated")
+		}
+		return b[16 : 16+size], nil
+	case "LZFu":
+	default:
+		return nil, errors.New("unknown rtf compression")
+	}
+
+	var dict [4096]byte
+	copy(dict[:], rtfDictionary)
+	pos := len(rtfDictionary)
+	// the size is only a hint, as it is not trustworthy in a corrupt file
+	if size > 16*len(b) {
+		size = 16 * len(b)
+	}
+	res := make([]byte, 0, size)
+	in := b[16:]
+	for len(in) > 0 {
+		control := in[0]
+		in = in[1:]
+		for bit := uint(0); bit < 8 && len(in) > 0; bit++ {
+			if control&(1<<bit) == 0 {
+				res = append(res, in[0])
+				dict[pos] = in[0]
+				pos = (pos + 1) % len(dict)
+				in = in[1:]
+				continue
+			}
+			if len(in) < 2 {
+				return nil, errors.New("rtf truncated")
+			}
+			ref := int(in[0])<<8 | int(in[1])
+			in = in[2:]
+			offset, length := ref>>4, ref&0xF+2
+			if offset == pos {
+				return res, nil
+			}
+			for i := 0; i < length; i++ {
+				c := dict[(offset+i)%len(dict)]
+				res = append(res, c)
+				dict[pos] = c
+				pos = (pos + 1) % len(dict)
+			}
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	imap2 "github.com/emersion/go-imap"
+)
+
+// orphanDir is an archived mailbox directory, whose mailbox does not exist on the server anymore.
+type orphanDir struct {
+	dir    string
+	meta   *MailboxMeta
+	hashes map[string]bool
+}
+
+// followRenames detects mailboxes, which have been renamed on the server since the last run. A mailbox without
+// a directory is compared with all orphaned directories of the account. If at least half of the archived mails of
+// an orphan are found in the mailbox, or it has the same UIDVALIDITY and shares any mail, the orphan is moved to
+// the directory of the mailbox, so that nothing is downloaded again. The headers of a mailbox are only fetched, if
+// its UIDVALIDITY or number of mails allows a match. In a dry run, the moves are only logged.
+func (a *App) followRenames(srv Source) error {
+	orphans, err := a.findOrphans()
+	if err != nil {
+		return err
+	}
+	if len(orphans) == 0 {
+		return nil
+	}
+
+	// parents first, so that moving a parent also moves the directories of its renamed children
+	mailboxes := append([]*imap2.MailboxStatus{}, a.mailboxes...)
+	sort.Slice(mailboxes, func(i, j int) bool { return mailboxes[i].Name < mailboxes[j].Name })
+	for _, mb := range mailboxes {
+		targetDir := a.mailboxDir(mb.Name)
+		if ok, err := a.storage.Exists(filepath.Join(targetDir, metaFile)); err != nil || ok {
+			continue
+		}
+		if !anyMayMatch(orphans, mb) {
+			continue
+		}
+		all, _, err := a.scanMailbox(srv, mb, targetDir, a.cfg.IncludesDate)
+		if err != nil {
+			return err
+		}
+		orphan := bestOrphan(orphans, mb, all)
+		if orphan == nil {
+			continue
+		}
+		if a.cfg.DryRun {
+			logger.Info("would follow renamed mailbox", "account", a.cfg.Name, "from", orphan.meta.Name, "to", mb.Name,
+				"dir", orphan.dir, "target", targetDir)
+			delete(orphans, orphan.dir)
+			continue
+		}
+		if err := a.storage.Rename(orphan.dir, targetDir); err != nil {
+			logger.Warn("cannot follow renamed mailbox", "account", a.cfg.Name, "from", orphan.meta.Name, "to", mb.Name,
+				"err", err)
+			continue
+		}
+		logger.Info("followed renamed mailbox", "account", a.cfg.Name, "from", orphan.meta.Name, "to", mb.Name,
+			"dir", orphan.dir, "target", targetDir)
+		if a.retries != nil {
+			a.retries.rename(orphan.meta.Name, mb.Name)
+		}
+
+		// the directories of children have been moved along
+		delete(orphans, orphan.dir)
+		var children []*orphanDir
+		for dir, child := range orphans {
+			if strings.HasPrefix(dir, orphan.dir+string(filepath.Separator)) {
+				delete(orphans, dir)
+				children = append(children, child)
+			}
+		}
+		for _, child := range children {
+			child.dir = filepath.Join(targetDir, strings.TrimPrefix(child.dir, orphan.dir))
+			orphans[child.dir] = child
+		}
+	}
+	return nil
+}
+
+// findOrphans collects all mailbox directories of the account, whose meta names a mailbox unknown to the server.
+func (a *App) findOrphans() (map[string]*orphanDir, error) {
+	orphans := make(map[string]*orphanDir)
+	err := a.storage.Walk(a.cfg.Dir, func(path string) error {
+		if filepath.Base(path) != metaFile || isHiddenPath(a.cfg.Dir, path) {
+			return nil
+		}
+		dir := filepath.Dir(path)
+		meta, err := readStoredMeta(a.storage, dir)
+		if err != nil {
+			logger.Warn("ignoring unreadable mailbox meta", "dir", dir, "err", err)
+			return nil
+		}
+		if _, ok := a.delimiters[meta.Name]; ok || len(meta.Name) == 0 {
+			return nil
+		}
+		// imported mailboxes have neither, they were never on the server
+		if len(meta.Server) == 0 && len(meta.Login) == 0 {
+			return nil
+		}
+		if (len(meta.Server) > 0 && meta.Server != a.cfg.Server) || (len(meta.Login) > 0 && meta.Login != a.cfg.Login) {
+			return nil
+		}
+		orphan := &orphanDir{dir: dir, meta: meta, hashes: make(map[string]bool)}
+		for hash := range meta.Messages {
+			orphan.hashes[hash] = true
+		}
+		files, err := a.storage.List(dir)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if strings.HasSuffix(f, ".eml") {
+				orphan.hashes[strings.TrimSuffix(f, ".eml")] = true
+			}
+		}
+		logger.Debug("found orphaned mailbox directory", "account", a.cfg.Name, "mailbox", meta.Name, "dir", dir,
+			"mails", len(orphan.hashes))
+		orphans[dir] = orphan
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to find orphaned directories: %w", err)
+	}
+	return orphans, nil
+}
+
+// bestOrphan returns the orphan sharing the most mails with the given mailbox, if it is similar enough.
+func bestOrphan(orphans map[string]*orphanDir, mailbox *imap2.MailboxStatus, mails []*remoteMail) *orphanDir {
+	var best *orphanDir
+	bestShared := 0
+	for _, orphan := range orphans {
+		shared := 0
+		for _, mail := range mails {
+			if orphan.hashes[mail.hash] {
+				shared++
+			}
+		}
+		if shared == 0 || (shared*2 < len(orphan.hashes) && !orphan.sameValidity(mailbox)) {
+			continue
+		}
+		if shared > bestShared {
+			best = orphan
+			bestShared = shared
+		}
+	}
+	return best
+}
+
+// anyMayMatch returns true, if the mailbox could share enough mails with any orphan. At most all of its mails are
+// shared, so a mailbox with less than half of the mails of an orphan needs the same UIDVALIDITY.
+func anyMayMatch(orphans map[string]*orphanDir, mailbox *imap2.MailboxStatus) bool {
+	if mailbox.Messages == 0 {
+		return false
+	}
+	for _, orphan := range orphans {
+		if len(orphan.hashes) > 0 && (orphan.sameValidity(mailbox) || int(mailbox.Messages)*2 >= len(orphan.hashes)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *orphanDir) sameValidity(mailbox *imap2.MailboxStatus) bool {
+	return o.meta.UIDValidity != 0 && o.meta.UIDValidity == mailbox.UidValidity
+}
+
+// isHiddenPath returns true, if a directory between dir and path starts with a dot, like the state directory.
+func isHiddenPath(dir, path string) bool {
+	rel, err := filepath.Rel(dir, filepath.Dir(path))
+	if err != nil {
+		return false
+	}
+	for _, level := range strings.Split(rel, string(filepath.Separator)) {
+		if level != "." && strings.HasPrefix(level, ".") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	imap2 "github.com/emersion/go-imap"
+)
+
+func TestFollowRenames(t *testing.T) {
+	dir := t.TempDir()
+	storage := localStorage{}
+	date := time.Date(2021, 3, 1, 0, 0, 0, 0, time.Local)
+	src := &headerSource{dates: []time.Time{date, date}}
+
+	// the orphan contains both mails of the server and two deleted ones
+	old := &MailboxMeta{Name: "Old", Server: "imap.example.com", Login: "alice", UIDValidity: 1,
+		Messages: map[string]*MessageMeta{"deleted1": {}, "deleted2": {}}}
+	for i := 1; i <= 2; i++ {
+		hash := sha256.Sum224([]byte(fmt.Sprintf("Subject: mail %d\r\n\r\n", i)))
+		old.Messages[hex.EncodeToString(hash[:])] = &MessageMeta{InternalDate: date}
+	}
+	if err := writeStoredMeta(storage, filepath.Join(dir, "Old"), old); err != nil {
+		t.Fatal(err)
+	}
+	imported := &MailboxMeta{Name: "Imported", Delimiter: importDelimiter, Messages: old.Messages}
+	if err := writeStoredMeta(storage, filepath.Join(dir, "Imported"), imported); err != nil {
+		t.Fatal(err)
+	}
+
+	a := &App{cfg: &Config{Account: Account{Name: "alice", Server: "imap.example.com", Login: "alice"}, Dir: dir},
+		storage: storage, mailboxes: []*imap2.MailboxStatus{{Name: "New", Messages: 2, UidValidity: 2},
+			{Name: "Tiny", Messages: 1, UidValidity: 3}},
+		delimiters: map[string]string{"New": "/", "Tiny": "/"}}
+	orphans, err := a.findOrphans()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 1 || orphans[filepath.Join(dir, "Old")] == nil {
+		t.Fatalf("expected only the archived mailbox as orphan, got %v", orphans)
+	}
+
+	if err := a.followRenames(src); err != nil {
+		t.Fatal(err)
+	}
+	// a mailbox with a single mail cannot contain half of the four mails of the orphan
+	if strings.Join(src.fetched, ",") != "New" {
+		t.Fatalf("unexpected header fetches %v", src.fetched)
+	}
+	meta, err := readStoredMeta(storage, a.mailboxDir("New"))
+	if err != nil || meta.Name != "Old" {
+		t.Fatalf("expected the orphan to be moved: %v %v", meta, err)
+	}
+	if ok, _ := storage.Exists(filepath.Join(dir, "Imported", metaFile)); !ok {
+		t.Fatal("the imported mailbox must be kept")
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// RunReport is the machine readable summary of a single invocation, which may have archived multiple accounts.
+type RunReport struct {
+	Started         time.Time        `json:"started"`
+	Finished        time.Time        `json:"finished"`
+	DurationSeconds float64          `json:"durationSeconds"`
+	DryRun          bool             `json:"dryRun"`
+	Accounts        []*AccountReport `json:"accounts"`
+	file            string
+}
+
+// AccountReport summarizes the archive run of a single account.
+type AccountReport struct {
+	Name            string           `json:"name"`
+	Server          string           `json:"server"`
+	Login           string           `json:"login"`
+	Started         time.Time        `json:"started"`
+	Finished        time.Time        `json:"finished"`
+	DurationSeconds float64          `json:"durationSeconds"`
+	Success         bool             `json:"success"`
+	Interrupted     bool             `json:"interrupted,omitempty"`
+	New             int              `json:"new"`
+	Skipped         int              `json:"skipped"`
+	Failed          int              `json:"failed"`
+	Bytes           int64            `json:"bytes"`
+	Mailboxes       []*MailboxReport `json:"mailboxes"`
+	// Compression is set, if the connections to the server have been compressed.
+	Compression *CompressionReport `json:"compression,omitempty"`
+	Errors      []string           `json:"errors,omitempty"`
+}
+
+// MailboxReport contains the counters for a single mailbox. New counts downloaded mails, Skipped counts mails
+// which were already archived, Filtered counts mails outside of the date range and Failed counts mails which could
+// not be downloaded.
+type MailboxReport struct {
+	Name     string `json:"name"`
+	Total    int    `json:"total"`
+	New      int    `json:"new"`
+	Skipped  int    `json:"skipped"`
+	Filtered int    `json:"filtered"`
+	Failed   int    `json:"failed"`
+	Bytes    int64  `json:"bytes"`
+}
+
+// NewRunReport creates a report which is written to the given file by Save. If file is empty, Save does nothing.
+func NewRunReport(file string) *RunReport {
+	return &RunReport{Started: time.Now(), file: file}
+}
+
+func newAccountReport(cfg *Config) *AccountReport {
+	return &AccountReport{
+		Name:    cfg.Name,
+		Server:  cfg.Server,
+		Login:   cfg.Login,
+		Started: time.Now(),
+	}
+}
+
+// finish sums up the mailbox counters and records the final state.
+func (r *AccountReport) finish(err error) {
+	r.Finished = time.Now()
+	r.DurationSeconds = r.Finished.Sub(r.Started).Seconds()
+	r.New, r.Skipped, r.Failed, r.Bytes = 0, 0, 0, 0
+	for _, mb := range r.Mailboxes {
+		r.New += mb.New
+		r.Skipped += mb.Skipped
+		r.Failed += mb.Failed
+		r.Bytes += mb.Bytes
+	}
+	if err != nil {
+		r.Errors = append(r.Errors, err.Error())
+	}
+	r.Success = err == nil
+	r.Interrupted = err == errInterrupted
+}
+
+// Failed returns the number of accounts which have not been archived successfully.
+func (r *RunReport) Failed() int {
+	failed := 0
+	for _, acc := range r.Accounts {
+		if !acc.Success {
+			failed++
+		}
+	}
+	return failed
+}
+
+// PrintSummary writes a table with one row per account. If the logger uses json, the rows are logged instead.
+func (r *RunReport) PrintSummary(w io.Writer) {
+	if logger.JSON() {
+		for _, acc := range r.Accounts {
+			logger.Info("summary", "account", acc.Name, "success", acc.Success, "new", acc.New, "skipped", acc.Skipped,
+				"failed", acc.Failed, "bytes", acc.Bytes, "duration", acc.DurationSeconds, "error", acc.lastError())
+			if c := acc.Compression; c != nil {
+				logger.Info("summary compression", "account", acc.Name, "received", c.Received,
+					"receivedWire", c.ReceivedWire, "sent", c.Sent, "sentWire", c.SentWire, "ratio", c.Ratio())
+			}
+		}
+		logger.Info("summary total", "accounts", len(r.Accounts), "failedAccounts", r.Failed())
+		return
+	}
+	r.writeSummary(w)
+}
+
+// writeSummary writes a table with one row per account.
+func (r *RunReport) writeSummary(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACCOUNT\tSTATUS\tNEW\tSKIPPED\tFAILED\tSIZE\tDURATION\tERROR")
+	for _, acc := range r.Accounts {
+		status := "ok"
+		switch {
+		case acc.Interrupted:
+			status = "interrupted"
+		case !acc.Success:
+			status = "FAILED"
+		}
+		duration := time.Duration(acc.DurationSeconds * float64(time.Second)).Round(time.Second)
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%s\t%s\t%s\n", acc.Name, status, acc.New, acc.Skipped, acc.Failed,
+			formatSize(acc.Bytes), duration, acc.lastError())
+	}
+	tw.Flush()
+	for _, acc := range r.Accounts {
+		if c := acc.Compression; c != nil {
+			fmt.Fprintf(w, "%s: received %s compressed to %s (ratio %.1f)\n", acc.Name, formatSize(c.Received),
+				formatSize(c.ReceivedWire), c.Ratio())
+		}
+	}
+	fmt.Fprintf(w, "%d of %d accounts failed\n", r.Failed(), len(r.Accounts))
+}
+
+// lastError returns the error which stopped the run, if any.
+func (r *AccountReport) lastError() string {
+	if r.Success || len(r.Errors) == 0 {
+		return ""
+	}
+	return r.Errors[len(r.Errors)-1]
+}
+
+// Save writes the report as json into its file.
+func (r *RunReport) Save() error {
+	if len(r.file) == 0 {
+		return nil
+	}
+	r.Finished = time.Now()
+	r.DurationSeconds = r.Finished.Sub(r.Started).Seconds()
+	b, err := json.MarshalIndent(r, "", " ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal report: %w", err)
+	}
+	err = ioutil.WriteFile(r.file, b, os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("failed to write report %s: %w", r.file, err)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunReportSave(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "report.json")
+	run := NewRunReport(file)
+	acc := newAccountReport(&Config{Account: Account{Name: "alice", Server: "imap.example.com", Login: "alice"}})
+	acc.Mailboxes = []*MailboxReport{{Name: "INBOX", Total: 5, New: 2, Skipped: 3, Bytes: 300},
+		{Name: "Sent", Total: 2, New: 1, Failed: 1, Bytes: 100}}
+	acc.finish(errors.New("failed to login"))
+	run.Accounts = append(run.Accounts, acc)
+	if err := run.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved RunReport
+	if err := json.Unmarshal(b, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.Accounts) != 1 || saved.Finished.IsZero() {
+		t.Fatalf("unexpected report %s", b)
+	}
+	a := saved.Accounts[0]
+	if a.Name != "alice" || a.Server != "imap.example.com" || a.Success || a.New != 3 || a.Skipped != 3 ||
+		a.Failed != 1 || a.Bytes != 400 || len(a.Mailboxes) != 2 || len(a.Errors) != 1 || a.Errors[0] != "failed to login" {
+		t.Errorf("unexpected account %s", b)
+	}
+	if err := NewRunReport("").Save(); err != nil {
+		t.Errorf("expected no report without a file, got %v", err)
+	}
+}
+
+func TestWriteSummary(t *testing.T) {
+	run := &RunReport{Accounts: []*AccountReport{
+		{Name: "alice", Success: true, New: 12, Skipped: 30, Bytes: 5 << 20, DurationSeconds: 61.4,
+			Compression: &CompressionReport{Received: 4096, ReceivedWire: 2048}},
+		{Name: "bob", Failed: 1, Errors: []string{"failed to login: invalid credentials"}},
+		{Name: "carol", Interrupted: true, New: 2, Bytes: 2048, Errors: []string{"interrupted"}},
+	}}
+	var sb strings.Builder
+	run.writeSummary(&sb)
+	expected := `ACCOUNT  STATUS       NEW  SKIPPED  FAILED  SIZE    DURATION  ERROR
+alice    ok           12   30       0       5 MiB   1m1s      
+bob      FAILED       0    0        1       0 Byte  0s        failed to login: invalid credentials
+carol    interrupted  2    0        0       2 KiB   0s        interrupted
+alice: received 4 KiB compressed to 2 KiB (ratio 2.0)
+2 of 3 accounts failed
+`
+	if sb.String() != expected {
+		t.Errorf("expected summary\n%s\ngot\n%s", expected, sb.String())
+	}
+}
+
+// TestBatchMode archives two accounts, of which the first cannot connect. The second is archived nevertheless.
+func TestBatchMode(t *testing.T) {
+	mails := []string{"Subject: mail 1\r\n\r\nbody\r\n"}
+	srv := newIMAPTestServer(t, false, mails...)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	dir := t.TempDir()
+	cfgFile := filepath.Join(dir, "config.yaml")
+	yaml := fmt.Sprintf(`dir: %s
+defaults: {server: 127.0.0.1, login: user, password: secret, tls: true, insecureSkipVerify: true}
+accounts:
+  - {name: down, port: %d}
+  - {name: alice, port: %d}
+`, dir, closed, srv.port)
+	if err := ioutil.WriteFile(cfgFile, []byte(yaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	run := NewRunReport("")
+	if failed := batchMode(cfgFile, run, 0); failed != 1 {
+		t.Errorf("expected 1 failed account, got %d", failed)
+	}
+	if len(run.Accounts) != 2 || run.Failed() != 1 {
+		t.Fatalf("expected both accounts in the report, got %+v", run.Accounts)
+	}
+	down, alice := run.Accounts[0], run.Accounts[1]
+	if down.Name != "down" || down.Success || !strings.Contains(down.lastError(), "failed to login") {
+		t.Errorf("unexpected failed account %+v", down)
+	}
+	if alice.Name != "alice" || !alice.Success || alice.New != 1 {
+		t.Errorf("unexpected archived account %+v", alice)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// RetryEntry is a mail, which could neither be downloaded normally nor by the raw fallback.
+type RetryEntry struct {
+	Mailbox      string    `json:"mailbox"`
+	Hash         string    `json:"hash"`
+	UID          uint32    `json:"uid"`
+	Title        string    `json:"title"`
+	Reason       string    `json:"reason"`
+	Attempts     int       `json:"attempts"`
+	FirstFailure time.Time `json:"firstFailure"`
+	LastFailure  time.Time `json:"lastFailure"`
+}
+
+// RetryQueue persists failed mails of an account, so that later runs revisit them and the failures stay visible
+// until they are resolved.
+type RetryQueue struct {
+	Entries []*RetryEntry `json:"entries"`
+	mutex   sync.Mutex
+}
+
+func retryFile(dir string) string {
+	return filepath.Join(dir, stateDir, "retry.json")
+}
+
+// loadRetryQueue reads the queue of the account in dir. A missing file results in an empty queue.
+func loadRetryQueue(dir string) (*RetryQueue, error) {
+	q := &RetryQueue{}
+	b, err := ioutil.ReadFile(retryFile(dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return q, nil
+		}
+		return q, fmt.Errorf("failed to read retry queue: %w", err)
+	}
+	if err := json.Unmarshal(b, q); err != nil {
+		return q, fmt.Errorf("failed to decode retry queue: %w", err)
+	}
+	return q, nil
+}
+
+func (q *RetryQueue) save(dir string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	fname := retryFile(dir)
+	if len(q.Entries) == 0 {
+		if err := os.Remove(fname); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %w", fname, err)
+		}
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(fname), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to mkdir %s: %w", filepath.Dir(fname), err)
+	}
+	b, err := json.MarshalIndent(q, " ", " ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal: %w", err)
+	}
+	if err := ioutil.WriteFile(fname, b, os.ModePerm); err != nil {
+		return fmt.Errorf("failed to write %s: %w", fname, err)
+	}
+	return nil
+}
+
+// failed records another failed attempt of the given mail and returns the number of attempts so far.
+func (q *RetryQueue) failed(mailbox string, mail *remoteMail, reason error) int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	now := time.Now()
+	for _, e := range q.Entries {
+		if e.Mailbox == mailbox && e.Hash == mail.hash {
+			e.UID = mail.msg.Uid
+			e.Reason = reason.Error()
+			e.Attempts++
+			e.LastFailure = now
+			return e.Attempts
+		}
+	}
+	q.Entries = append(q.Entries, &RetryEntry{
+		Mailbox:      mailbox,
+		Hash:         mail.hash,
+		UID:          mail.msg.Uid,
+		Title:        debugTitle(mail.msg),
+		Reason:       reason.Error(),
+		Attempts:     1,
+		FirstFailure: now,
+		LastFailure:  now,
+	})
+	return 1
+}
+
+// revisit removes all entries of the mailbox, which are either archived now or have been removed from the
+// server. mails contains the result of the header scan of the mailbox.
+func (q *RetryQueue) revisit(mailbox string, mails []*remoteMail) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	byHash := make(map[string]*remoteMail)
+	for _, mail := range mails {
+		byHash[mail.hash] = mail
+	}
+	var remaining []*RetryEntry
+	for _, e := range q.Entries {
+		if e.Mailbox != mailbox {
+			remaining = append(remaining, e)
+			continue
+		}
+		mail, ok := byHash[e.Hash]
+		switch {
+		case !ok:
+			logger.Info("failed mail is gone from server", "mailbox", mailbox, "mail", e.Title)
+		case mail.archived:
+			logger.Info("failed mail has been archived", "mailbox", mailbox, "mail", e.Title, "attempts", e.Attempts)
+		default:
+			remaining = append(remaining, e)
+		}
+	}
+	q.Entries = remaining
+}
+
+// rename moves all entries of a mailbox, which has been renamed on the server.
+func (q *RetryQueue) rename(from, to string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for _, e := range q.Entries {
+		if e.Mailbox == from {
+			e.Mailbox = to
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	imap2 "github.com/emersion/go-imap"
+)
+
+// brokenMailSource cannot parse any mail and answers the raw fetch with rawErr.
+type brokenMailSource struct {
+	Source
+	rawErr error
+}
+
+func (s *brokenMailSource) Mail(mailbox string, num int) (*imap2.Message, error) {
+	return nil, &MailParseError{Err: errors.New("Missing type-specific fields for text/*")}
+}
+
+func (s *brokenMailSource) RawMail(mailbox string, uid uint32) ([]byte, error) {
+	if s.rawErr != nil {
+		return nil, s.rawErr
+	}
+	return []byte("Subject: raw\r\n\r\nbody\r\n"), nil
+}
+
+func TestDownloadClassifiesRawFetch(t *testing.T) {
+	a := &App{cfg: &Config{Account: Account{Name: "alice"}}}
+	mail := &remoteMail{msg: &imap2.Message{SeqNum: 1, Uid: 7, Envelope: &imap2.Envelope{Subject: "broken"}}}
+
+	eml, err := a.download(&brokenMailSource{}, "INBOX", mail)
+	if err != nil || string(eml) != "Subject: raw\r\n\r\nbody\r\n" {
+		t.Fatalf("expected the raw mail, got %q %v", eml, err)
+	}
+
+	// a lost connection stops the mailbox instead of marking the mail as broken
+	_, err = a.download(&brokenMailSource{rawErr: fmt.Errorf("fetch: %w", io.ErrUnexpectedEOF)}, "INBOX", mail)
+	if err == nil || isParseError(err) || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected a connection error, got %v", err)
+	}
+
+	_, err = a.download(&brokenMailSource{rawErr: &MailParseError{Err: errors.New("invalid literal")}}, "INBOX", mail)
+	if !isParseError(err) {
+		t.Fatalf("expected a broken mail, got %v", err)
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3Storage keeps the files as objects of a bucket of an s3 compatible service like AWS S3 or MinIO. The bucket
+// is addressed path style and requests are signed with signature version 4. The modification time of a mail is
+// kept as the metadata internal-date, because objects cannot have another modification time.
+type s3Storage struct {
+	cfg    StorageConfig
+	root   string
+	client *http.Client
+}
+
+func newS3Storage(cfg *StorageConfig, root string) *s3Storage {
+	s := &s3Storage{cfg: *cfg, root: root, client: &http.Client{Timeout: 5 * time.Minute}}
+	if len(s.cfg.Region) == 0 {
+		s.cfg.Region = "us-east-1"
+	}
+	if len(s.cfg.Endpoint) == 0 {
+		s.cfg.Endpoint = "https://s3." + s.cfg.Region + ".amazonaws.com"
+	}
+	s.cfg.Endpoint = strings.TrimSuffix(s.cfg.Endpoint, "/")
+	s.cfg.Prefix = strings.Trim(s.cfg.Prefix, "/")
+	return s
+}
+
+// key returns the object key of a local path below the root.
+func (s *s3Storage) key(name string) (string, error) {
+	rel, err := filepath.Rel(s.root, name)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside of the storage directory %s", name, s.root)
+	}
+	if rel == "." {
+		rel = ""
+	}
+	return strings.TrimPrefix(path.Join(s.cfg.Prefix, filepath.ToSlash(rel)), "/"), nil
+}
+
+// name returns the local path of an object key.
+func (s *s3Storage) name(key string) string {
+	if len(s.cfg.Prefix) > 0 {
+		key = strings.TrimPrefix(key, s.cfg.Prefix+"/")
+	}
+	return filepath.Join(s.root, filepath.FromSlash(key))
+}
+
+func (s *s3Storage) Exists(name string) (bool, error) {
+	res, err := s.do(http.MethodHead, name, nil, nil, nil)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	res.Body.Close()
+	return true, nil
+}
+
+func (s *s3Storage) List(dir string) ([]string, error) {
+	var res []string
+	err := s.list(dir, "/", func(key string) error {
+		res = append(res, path.Base(key))
+		return nil
+	})
+	return res, err
+}
+
+func (s *s3Storage) Walk(dir string, fn func(name string) error) error {
+	return s.list(dir, "", func(key string) error {
+		return fn(s.name(key))
+	})
+}
+
+func (s *s3Storage) ReadFile(name string) ([]byte, error) {
+	body, err := s.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return ioutil.ReadAll(body)
+}
+
+func (s *s3Storage) Open(name string) (io.ReadCloser, error) {
+	res, err := s.do(http.MethodGet, name, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+func (s *s3Storage) WriteFile(name string, b []byte, modTime time.Time) error {
+	header := http.Header{}
+	if !modTime.IsZero() {
+		header.Set("x-amz-meta-internal-date", modTime.UTC().Format(time.RFC3339))
+	}
+	res, err := s.do(http.MethodPut, name, nil, header, b)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// Rename copies each object to its new key and deletes the old one, because objects cannot be renamed. The
+// metadata, like the internal date, is copied along.
+func (s *s3Storage) Rename(oldName, newName string) error {
+	oldName, newName = filepath.Clean(oldName), filepath.Clean(newName)
+	var names []string
+	if ok, err := s.Exists(oldName); err != nil {
+		return err
+	} else if ok {
+		names = append(names, oldName)
+	}
+	if err := s.Walk(oldName, func(name string) error {
+		names = append(names, name)
+		return nil
+	}); err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return &os.PathError{Op: "rename", Path: oldName, Err: os.ErrNotExist}
+	}
+	for _, name := range names {
+		target := newName + strings.TrimPrefix(name, oldName)
+		if ok, err := s.Exists(target); err != nil {
+			return err
+		} else if ok {
+			return fmt.Errorf("cannot move %s, %s exists", name, target)
+		}
+		key, err := s.key(name)
+		if err != nil {
+			return err
+		}
+		header := http.Header{}
+		header.Set("x-amz-copy-source", "/"+s3Escape(s.cfg.Bucket, true)+"/"+s3Escape(key, true))
+		res, err := s.do(http.MethodPut, target, nil, header, nil)
+		if err != nil {
+			return fmt.Errorf("cannot copy %s: %w", name, err)
+		}
+		res.Body.Close()
+		if err := s.Remove(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *s3Storage) Remove(name string) error {
+	res, err := s.do(http.MethodDelete, name, nil, nil, nil)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// listResult is the response of ListObjectsV2.
+type listResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// list calls fn for each object key below dir. With the delimiter /, nested directories are not listed.
+func (s *s3Storage) list(dir, delimiter string, fn func(key string) error) error {
+	prefix, err := s.key(dir)
+	if err != nil {
+		return err
+	}
+	if len(prefix) > 0 {
+		prefix += "/"
+	}
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	if len(delimiter) > 0 {
+		query.Set("delimiter", delimiter)
+	}
+	for {
+		res, err := s.request(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return fmt.Errorf("cannot list %s: %w", dir, err)
+		}
+		result := &listResult{}
+		err = xml.NewDecoder(res.Body).Decode(result)
+		res.Body.Close()
+		if err != nil {
+			return fmt.Errorf("cannot list %s: %w", dir, err)
+		}
+		for _, obj := range result.Contents {
+			if err := fn(obj.Key); err != nil {
+				return err
+			}
+		}
+		if !result.IsTruncated || len(result.NextContinuationToken) == 0 {
+			return nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// do sends a request for the object of the local path name. A missing object is returned as os.ErrNotExist.
+func (s *s3Storage) do(method, name string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	key, err := s.key(name)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.request(method, key, query, header, body)
+	if err != nil {
+		if res != nil && res.StatusCode == http.StatusNotFound {
+			return nil, &os.PathError{Op: strings.ToLower(method), Path: name, Err: os.ErrNotExist}
+		}
+		return nil, fmt.Errorf("%s %s: %w", method, key, err)
+	}
+	return res, nil
+}
+
+// request sends a signed request to the bucket. The response is returned along with an error, if the status is not
+// successful.
+func (s *s3Storage) request(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u, err := url.Parse(s.cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint: %w", err)
+	}
+	base, rawBase := strings.TrimSuffix(u.Path, "/"), strings.TrimSuffix(u.EscapedPath(), "/")
+	u.Path = base + "/" + s.cfg.Bucket + "/" + key
+	u.RawPath = rawBase + "/" + s3Escape(s.cfg.Bucket, true) + "/" + s3Escape(key, true)
+	u.RawQuery = s3Query(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if method == http.MethodPut {
+		req.ContentLength = int64(len(body))
+	}
+	signV4(req, body, s.cfg.AccessKey, s.cfg.SecretKey, s.cfg.Region, time.Now())
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		res.Body.Close()
+		return res, fmt.Errorf("unexpected status %s: %s", res.Status, strings.TrimSpace(string(msg)))
+	}
+	return res, nil
+}
+
+// signV4 adds the headers of the AWS signature version 4 to req. All headers of req are signed.
+func signV4(req *http.Request, body []byte, accessKey, secretKey, region string, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	payload := sha256.Sum256(body)
+	req.Header.Set("x-amz-date", now.Format("20060102T150405Z"))
+	req.Header.Set("x-amz-content-sha256", hex.EncodeToString(payload[:]))
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := &strings.Builder{}
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payload[:]),
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	hashedRequest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" +
+		hex.EncodeToString(hashedRequest[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+", SignedHeaders="+
+		signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape encodes all bytes except the unreserved characters of RFC 3986, as required for the signature.
+func s3Escape(s string, keepSlash bool) string {
+	sb := &strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~", c) >= 0 ||
+			(keepSlash && c == '/') {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+// s3Query encodes the query sorted by name, which is the canonical form of the signature.
+func s3Query(query url.Values) string {
+	var names []string
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var parts []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			parts = append(parts, s3Escape(name, false)+"="+s3Escape(value, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule calculates the next point in time to run a job.
+type Schedule interface {
+	// Next returns the next activation time after the given time. For intervals, last is the time of the last run,
+	// which may be zero.
+	Next(now, last time.Time) time.Time
+}
+
+// ParseSchedule parses either a cron expression with the five fields minute, hour, day of month, month and day of
+// week, one of the shortcuts @hourly, @daily, @weekly and @monthly or an interval like "@every 6h".
+func ParseSchedule(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	switch spec {
+	case "@hourly":
+		spec = "0 * * * *"
+	case "@daily", "@midnight":
+		spec = "0 0 * * *"
+	case "@weekly":
+		spec = "0 0 * * 0"
+	case "@monthly":
+		spec = "0 0 1 * *"
+	}
+
+	if strings.HasPrefix(spec, "@every ") {
+		d, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(spec, "@every ")))
+		if err != nil {
+			return nil, fmt.Errorf("invalid interval '%s': %w", spec, err)
+		}
+		if d < time.Minute {
+			return nil, fmt.Errorf("interval '%s' is shorter than a minute", spec)
+		}
+		return intervalSchedule(d), nil
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid schedule '%s': expected 5 cron fields or @every <duration>", spec)
+	}
+	c := &cronSchedule{}
+	var err error
+	bounds := []struct {
+		dst      *uint64
+		min, max int
+		name     string
+	}{
+		{&c.minute, 0, 59, "minute"},
+		{&c.hour, 0, 23, "hour"},
+		{&c.dom, 1, 31, "day of month"},
+		{&c.month, 1, 12, "month"},
+		{&c.dow, 0, 7, "day of week"},
+	}
+	for i, b := range bounds {
+		*b.dst, err = parseCronField(fields[i], b.min, b.max)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s in schedule '%s': %w", b.name, spec, err)
+		}
+	}
+	// sunday may be written as 0 or 7
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domAny = fields[2] == "*"
+	c.dowAny = fields[4] == "*"
+	if !c.matchesAnyDay() {
+		return nil, fmt.Errorf("schedule '%s' never matches, the days do not exist in the months", spec)
+	}
+	return c, nil
+}
+
+// intervalSchedule runs a job immediately and then each interval after the last run.
+type intervalSchedule time.Duration
+
+func (s intervalSchedule) Next(now, last time.Time) time.Time {
+	if last.IsZero() {
+		return now
+	}
+	next := last.Add(time.Duration(s))
+	if next.Before(now) {
+		return now
+	}
+	return next
+}
+
+// cronSchedule contains one bit per allowed value of each field.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool
+}
+
+func (c *cronSchedule) Next(now, last time.Time) time.Time {
+	t := now.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// dayMatches applies the cron rule, that a day matches either field if both are restricted.
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	domMatch := c.dom&(1<<uint(t.Day())) != 0
+	dowMatch := c.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dowMatch
+	case c.dowAny:
+		return domMatch
+	default:
+		return domMatch || dowMatch
+	}
+}
+
+// daysInMonth is the largest day of each month, including the 29th of february.
+var daysInMonth = [13]int{0, 31, 29, 31, 30, 31, 30, 31, 31, 30, 31, 30, 31}
+
+// matchesAnyDay returns false, if only days of month are allowed, which do not exist in any of the allowed months,
+// like the 30th of february. Next would never find a time for such a schedule.
+func (c *cronSchedule) matchesAnyDay() bool {
+	if c.domAny || !c.dowAny {
+		return true
+	}
+	for month := 1; month <= 12; month++ {
+		if c.month&(1<<uint(month)) == 0 {
+			continue
+		}
+		for day := 1; day <= daysInMonth[month]; day++ {
+			if c.dom&(1<<uint(day)) != 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseCronField parses comma separated values, ranges and steps like "*/15", "1-5" or "0,30".
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in '%s'", part)
+			}
+			part = part[:i]
+		}
+
+		from, to := min, max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			var err1, err2 error
+			from, err1 = strconv.Atoi(bounds[0])
+			to, err2 = strconv.Atoi(bounds[1])
+			if err1 != nil || err2 != nil {
+				return 0, fmt.Errorf("invalid range '%s'", part)
+			}
+		default:
+			v, err := strconv.Atoi(part)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value '%s'", part)
+			}
+			from = v
+			if step == 1 {
+				to = v
+			}
+		}
+		if from < min || to > max || from > to {
+			return 0, fmt.Errorf("'%s' is out of range %d-%d", part, min, max)
+		}
+		for v := from; v <= to; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	now := time.Date(2026, 10, 18, 21, 30, 10, 0, time.UTC)
+	for spec, want := range map[string]time.Time{
+		"*/15 * * * *": time.Date(2026, 10, 18, 21, 45, 0, 0, time.UTC),
+		"0 3 * * *":    time.Date(2026, 10, 19, 3, 0, 0, 0, time.UTC),
+		"30 2 * * 1-5": time.Date(2026, 10, 19, 2, 30, 0, 0, time.UTC),
+		"0 0 13 * 5":   time.Date(2026, 10, 23, 0, 0, 0, 0, time.UTC),
+		"0 0 29 2 *":   time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC),
+		"0 0 30 1-2 *": time.Date(2027, 1, 30, 0, 0, 0, 0, time.UTC),
+		"0 0 30 2 1":   time.Date(2027, 2, 1, 0, 0, 0, 0, time.UTC),
+		"@every 6h":    now,
+	} {
+		s, err := ParseSchedule(spec)
+		if err != nil {
+			t.Fatalf("%s: %v", spec, err)
+		}
+		if next := s.Next(now, time.Time{}); !next.Equal(want) {
+			t.Fatalf("%s: expected %s, got %s", spec, want, next)
+		}
+	}
+
+	for _, spec := range []string{"* * *", "60 * * * *", "@every 1s", "*/0 * * * *", "5-1 * * * *", "0 0 30 2 *",
+		"0 0 31 4,6,9,11 *", "0 0 30-31 2 *"} {
+		if _, err := ParseSchedule(spec); err == nil {
+			t.Fatalf("%s: expected an error", spec)
+		}
+	}
+}
@@ -5,42 +5,68 @@ import (
 	"fmt"
 	"github.com/blevesearch/bleve"
 	"github.com/jhillyerd/enmime"
-	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type SearchConfig struct {
-	Dir  string
-	Host string
-	Port int
+	Dir  string `json:"dir"`
+	Host string `json:"host"`
+	Port int    `json:"port"`
+	// Storage contains the mails to index. The index itself is always kept in the local Dir.
+	Storage Storage `json:"-"`
 }
 
 // Search contains search and indexing logic. The index can be used while the index is updated, however because
 // the mime parser is very slow and indexing one document after another is also slow, we do that in parallel.
 type Search struct {
-	cfg               *SearchConfig
-	queue             chan string
-	index             bleve.Index
-	indexStatus       float64
-	pendingBatch      *bleve.Batch
-	pendingBatchMutex sync.Mutex
-	idToFilenames     map[string]string
+	indexProgress      uint64 // bits of the float64 progress, read by the metrics concurrently, first to be aligned
+	cfg                *SearchConfig
+	queue              chan string
+	index              bleve.Index
+	pendingBatch       *bleve.Batch
+	pendingBatchMutex  sync.Mutex
+	pending            sync.WaitGroup // queued but not yet inserted files
+	refreshMutex       sync.Mutex
+	idToFilenames      map[string]string
+	idToFilenamesMutex sync.RWMutex
+	storage            Storage
+	closing            chan struct{} // closed by Close to stop queueing files
+	closeOnce          sync.Once
+	closeErr           error
+	indexed            chan struct{} // closed when the indexers have applied their last batch
+	lock               *DirLock
 }
 
 func NewSearch(cfg *SearchConfig) (*Search, error) {
 	s := &Search{
 		cfg:           cfg,
+		storage:       storageOf(cfg.Storage),
 		idToFilenames: make(map[string]string),
 		queue:         make(chan string, runtime.NumCPU()),
+		closing:       make(chan struct{}),
+		indexed:       make(chan struct{}),
 	}
-	err := s.initIndex()
+	// another search server on the same index would block forever. Archive runs do not need to be excluded: mails
+	// are renamed into place once written, and a mail moved away while indexing is found again by the next refresh.
+	lock, err := acquireLock(indexLockFile(cfg.Dir), "search", 0)
 	if err != nil {
+		return nil, fmt.Errorf("index is in use: %w", err)
+	}
+	s.lock = lock
+	err = s.initIndex()
+	if err != nil {
+		lock.Unlock()
 		return nil, err
 	}
+	s.pendingBatch = s.index.NewBatch()
+	s.registerMetrics()
 
 	s.spawnFindNewCandidates()
 	go s.spawnIndexUpdate()
@@ -62,33 +88,50 @@ func (s *Search) initIndex() error {
 	return nil
 }
 
+func (s *Search) registerMetrics() {
+	metrics.GaugeFunc("imaparc_search_index_documents", "Number of documents in the search index.", func() float64 {
+		count, err := s.index.DocCount()
+		if err != nil {
+			return 0
+		}
+		return float64(count)
+	})
+	metrics.GaugeFunc("imaparc_search_index_size_bytes", "Size of the search index on disk.", func() float64 {
+		var size int64
+		filepath.Walk(filepath.Join(s.cfg.Dir, "index.bleve"), func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() {
+				size += info.Size()
+			}
+			return nil
+		})
+		return float64(size)
+	})
+	metrics.GaugeFunc("imaparc_search_index_progress", "Progress of the initial index update between 0 and 1.", func() float64 {
+		return s.progress()
+	})
+}
+
 func (s *Search) spawnIndexUpdate() {
 	var wg sync.WaitGroup
 	for i := 0; i < runtime.NumCPU(); i++ {
 		wg.Add(1)
 		go func() {
-			fmt.Println("spawned indexer")
+			logger.Debug("spawned indexer")
 			for file := range s.queue {
 				err := s.insert(file)
 				if err != nil {
-					fmt.Printf("failed to index %s: %v\n", file, err)
+					logger.Warn("failed to index", "file", file, "err", err)
 				}
+				s.pending.Done()
 			}
 			wg.Done()
 		}()
 	}
 
 	wg.Wait()
-	fmt.Println("index update completed, applying batch")
-
-	err := s.index.Batch(s.pendingBatch) // sadly not possible concurrently, but fast enough
-
-	if err != nil {
-		fmt.Printf("failed to apply batch: %v\n", err)
-	} else {
-		fmt.Printf("batch applyied")
-	}
-
+	logger.Info("index update completed, applying batch")
+	s.applyBatch() // sadly not possible concurrently, but fast enough
+	close(s.indexed)
 }
 
 func (s *Search) applyBatch() {
@@ -97,7 +140,7 @@ func (s *Search) applyBatch() {
 	defer s.pendingBatchMutex.Unlock()
 	err := s.index.Batch(s.pendingBatch)
 	if err != nil {
-		fmt.Printf("failed to apply batch: %v\n", err)
+		logger.Error("failed to apply batch", "err", err)
 	}
 	s.pendingBatch = s.index.NewBatch()
 
@@ -105,7 +148,7 @@ func (s *Search) applyBatch() {
 }
 
 func (s *Search) insert(file string) error {
-	b, err := ioutil.ReadFile(file)
+	b, err := s.storage.ReadFile(file)
 	if err != nil {
 		return fmt.Errorf("cannot read file: %w", err)
 	}
@@ -140,70 +183,140 @@ func (s *Search) insert(file string) error {
 }
 
 func (s *Search) spawnFindNewCandidates() {
-	go func() {
-		var candidates []string
-		err := filepath.Walk(s.cfg.Dir, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			if strings.HasSuffix(info.Name(), ".eml") && info.Mode().IsRegular() {
-				candidates = append(candidates, path)
-			}
-			return nil
-		})
+	go s.findNewCandidates()
+}
+
+// Refresh looks for emails, which have been added after the search has been created, e.g. by a scheduled archive
+// run in the same process.
+func (s *Search) Refresh() {
+	go s.findNewCandidates()
+}
+
+func (s *Search) findNewCandidates() {
+	s.refreshMutex.Lock()
+	defer s.refreshMutex.Unlock()
+	if s.isClosing() {
+		return
+	}
+
+	var candidates []string
+	err := s.storage.Walk(s.cfg.Dir, func(path string) error {
+		if strings.HasSuffix(path, ".eml") {
+			candidates = append(candidates, path)
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Error("failed to find emails", "dir", s.cfg.Dir, "err", err)
+	}
+	logger.Info("found emails", "count", len(candidates))
+	var missing []string
+	for _, file := range candidates {
+		id := filepath.Base(file)
+		s.idToFilenamesMutex.Lock()
+		s.idToFilenames[id] = file
+		s.idToFilenamesMutex.Unlock()
+		doc, err := s.index.Document(id)
 		if err != nil {
-			fmt.Printf("failed to find emails in %s: %v\n", s.cfg.Dir, err)
+			logger.Error("cannot look up email in index, skipping", "file", file, "err", err)
+			continue
 		}
-		fmt.Printf("found %d emails\n", len(candidates))
-		var missing []string
-		for _, file := range candidates {
-			id := filepath.Base(file)
-			s.idToFilenames[id] = file
-			doc, err := s.index.Document(id)
-			if err != nil {
-				panic(err)
-			}
-			if doc == nil {
-				missing = append(missing, file)
-			}
+		if doc == nil {
+			missing = append(missing, file)
 		}
-		fmt.Printf("found %d email to index\n", len(missing))
-		s.pendingBatch = s.index.NewBatch()
-		lastMsg := 0
-		for i, file := range missing {
-			s.queue <- file
-			s.indexStatus = float64(i) / float64(len(missing))
-			currentPercent := int(s.indexStatus * 100)
-			if lastMsg != currentPercent {
-				lastMsg = currentPercent
-				fmt.Printf("index update at %d %%\n", lastMsg)
-				s.applyBatch()
-			}
+	}
+	logger.Info("found emails to index", "count", len(missing))
+	lastMsg := 0
+	for i, file := range missing {
+		if s.isClosing() {
+			logger.Info("index update stopped", "remaining", len(missing)-i)
+			break
+		}
+		s.pending.Add(1)
+		s.queue <- file
+		s.setProgress(float64(i) / float64(len(missing)))
+		currentPercent := int(s.progress() * 100)
+		if lastMsg != currentPercent {
+			lastMsg = currentPercent
+			logger.Info("index update", "percent", lastMsg)
+			s.applyBatch()
 		}
-		fmt.Printf("all files added to index")
-	}()
+	}
+	s.pending.Wait()
+	s.applyBatch()
+	if s.isClosing() {
+		return
+	}
+	s.setProgress(1)
+	logger.Info("all files added to index")
+}
+
+// progress returns the progress of the index update between 0 and 1.
+func (s *Search) progress() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&s.indexProgress))
+}
+
+func (s *Search) setProgress(v float64) {
+	atomic.StoreUint64(&s.indexProgress, math.Float64bits(v))
 }
 
 func (s *Search) FilenameForID(id string) string {
+	s.idToFilenamesMutex.RLock()
+	defer s.idToFilenamesMutex.RUnlock()
 	return s.idToFilenames[id]
 }
 
+// Fields returns the stored text fields of the indexed mail with the given id or nil, if it is not indexed.
+func (s *Search) Fields(id string) map[string]string {
+	doc, err := s.index.Document(id)
+	if err != nil || doc == nil {
+		return nil
+	}
+	res := make(map[string]string)
+	for _, field := range doc.Fields {
+		res[field.Name()] = string(field.Value())
+	}
+	return res
+}
+
 func (s *Search) Query(str string) *bleve.SearchResult {
 	query := bleve.NewQueryStringQuery(str)
 	req := bleve.NewSearchRequest(query)
 	req.Fields = []string{"Id", "File", "Subject", "From", "To", "CC", "Body", "Attachments", "AttachmentCount", "Size"}
 	req.Size = 1000
+	start := time.Now()
 	res, err := s.index.Search(req)
+	metricQueryDuration.Observe(time.Since(start).Seconds())
 	if err != nil {
-		fmt.Printf("failed to search %s: %v\n", str, err)
+		logger.Warn("failed to search", "query", str, "err", err)
 		return nil
 	}
 	return res
 }
 
+// Close stops the index update after the files currently being indexed, applies the pending batch and closes
+// the index. Further calls return the result of the first one.
 func (s *Search) Close() error {
-	close(s.queue)
-	return s.index.Close()
+	s.closeOnce.Do(func() {
+		close(s.closing)
+		// wait for a running update to stop queueing
+		s.refreshMutex.Lock()
+		close(s.queue)
+		s.refreshMutex.Unlock()
+		<-s.indexed
+		defer s.lock.Unlock()
+		s.closeErr = s.index.Close()
+	})
+	return s.closeErr
+}
+
+func (s *Search) isClosing() bool {
+	select {
+	case <-s.closing:
+		return true
+	default:
+		return false
+	}
 }
 
 type IndexModel struct {
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSearchMetrics(t *testing.T) {
+	dir := t.TempDir()
+	for i := 0; i < 20; i++ {
+		eml := fmt.Sprintf("From: a@example.com\r\nSubject: mail %d\r\n\r\nbody %d\r\n", i, i)
+		if err := (localStorage{}).WriteFile(filepath.Join(dir, "INBOX", fmt.Sprintf("%d.eml", i)), []byte(eml), time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for run := 0; run < 2; run++ {
+		s, err := NewSearch(&SearchConfig{Dir: dir})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the gauges are evaluated while the index is updated
+		sb := &strings.Builder{}
+		for s.progress() < 1 {
+			sb.Reset()
+			if _, err := metrics.WriteTo(sb); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		s.Close()
+
+		sb.Reset()
+		metrics.WriteTo(sb)
+		if n := strings.Count(sb.String(), "# TYPE imaparc_search_index_progress gauge"); n != 1 {
+			t.Fatalf("run %d: expected the progress once, got %d:\n%s", run, n, sb)
+		}
+		if !strings.Contains(sb.String(), "\nimaparc_search_index_progress 1\n") {
+			t.Fatalf("run %d: expected a complete update:\n%s", run, sb)
+		}
+	}
+}
+
+func TestSearchCloseTwice(t *testing.T) {
+	dir := t.TempDir()
+	eml := "From: a@example.com\r\nSubject: mail\r\n\r\nbody\r\n"
+	if err := (localStorage{}).WriteFile(filepath.Join(dir, "INBOX", "1.eml"), []byte(eml), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSearch(&SearchConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("expected the second close to succeed, got %v", err)
+	}
+	// the lock has been released once, so the index can be opened again
+	s, err = NewSearch(&SearchConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/blevesearch/bleve/search"
 	"html/template"
 	"io"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -24,6 +26,8 @@ func (s *Server) Start(host string, port int) {
 	router := http.NewServeMux() // here you could also go with third party packages to create a router
 	// Register your routes
 	router.HandleFunc("/download/", s.download)
+	router.HandleFunc("/snapshots", s.snapshots)
+	router.Handle("/metrics", metrics)
 	router.HandleFunc("/", s.search)
 
 	listenAddr := host + ":" + strconv.Itoa(port)
@@ -35,12 +39,22 @@ func (s *Server) Start(host string, port int) {
 		IdleTimeout:  15 * time.Second,
 	}
 
-	fmt.Printf("starting search server at %s\n", listenAddr)
+	// stop accepting requests on shutdown, the index is closed by the caller afterwards
+	go func() {
+		<-interrupted
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			logger.Warn("failed to stop server", "err", err)
+		}
+	}()
+
+	logger.Info("starting search server", "addr", listenAddr)
 	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		fmt.Printf("Could not listen on %s: %v\n", listenAddr, err)
+		logger.Error("could not listen", "addr", listenAddr, "err", err)
 		os.Exit(10)
 	}
-	fmt.Println("Server stopped")
+	logger.Info("server stopped")
 }
 
 func (s *Server) download(w http.ResponseWriter, r *http.Request) {
@@ -51,7 +65,7 @@ func (s *Server) download(w http.ResponseWriter, r *http.Request) {
 	}
 	name := segments[2]
 	fname := s.index.FilenameForID(name)
-	file, err := os.Open(fname)
+	file, err := s.index.storage.Open(fname)
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
 		return
@@ -60,6 +74,118 @@ func (s *Server) download(w http.ResponseWriter, r *http.Request) {
 	io.Copy(w, file)
 }
 
+// snapshots lists the mailboxes with a history. For a mailbox, it shows the runs, the mails as of a point in time
+// or the changes between two points in time.
+func (s *Server) snapshots(w http.ResponseWriter, r *http.Request) {
+	storage := s.index.storage
+	baseDir := s.index.cfg.Dir
+	query := r.URL.Query()
+	viewModel := &SnapshotModel{Mailbox: query.Get("mailbox"), At: query.Get("at"), From: query.Get("from"),
+		To: query.Get("to")}
+
+	if len(viewModel.Mailbox) == 0 {
+		dirs, err := snapshotDirs(storage, baseDir)
+		if err != nil {
+			logger.Warn("failed to list snapshots", "dir", baseDir, "err", err)
+		}
+		for _, dir := range dirs {
+			if rel, err := filepath.Rel(baseDir, dir); err == nil {
+				viewModel.Mailboxes = append(viewModel.Mailboxes, filepath.ToSlash(rel))
+			}
+		}
+	} else if err := s.snapshotModel(viewModel, storage, baseDir); err != nil {
+		viewModel.Error = err.Error()
+	}
+
+	if err := snapshotTpl.Execute(w, viewModel); err != nil {
+		logger.Warn("failed to apply tpl", "err", err)
+	}
+}
+
+// snapshotModel fills the runs and mails of the selected mailbox.
+func (s *Server) snapshotModel(viewModel *SnapshotModel, storage Storage, baseDir string) error {
+	dir := filepath.Join(baseDir, filepath.FromSlash(viewModel.Mailbox))
+	if rel, err := filepath.Rel(baseDir, dir); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("invalid mailbox %s", viewModel.Mailbox)
+	}
+	snapshots, err := readSnapshots(storage, dir)
+	if err != nil {
+		return err
+	}
+	meta, err := readStoredMeta(storage, dir)
+	if err != nil {
+		return err
+	}
+	viewModel.Name = meta.Name
+	count := 0
+	for _, run := range snapshots.Runs {
+		count += len(run.Added) - len(run.Removed)
+		viewModel.Runs = append(viewModel.Runs, &SnapshotRunEntry{Time: run.Time.Local().Format(time.RFC3339),
+			Count: count, Added: len(run.Added), Removed: len(run.Removed)})
+	}
+
+	resolve := func(str string) (int, error) {
+		if len(str) == 0 {
+			return len(snapshots.Runs) - 1, nil
+		}
+		t, err := parseSnapshotTime(str)
+		if err != nil {
+			return 0, err
+		}
+		return snapshots.at(t), nil
+	}
+	switch {
+	case len(viewModel.At) > 0:
+		i, err := resolve(viewModel.At)
+		if err != nil {
+			return err
+		}
+		if i < 0 {
+			return fmt.Errorf("%s has not been archived before %s", meta.Name, viewModel.At)
+		}
+		var hashes []string
+		for hash := range snapshots.members(i) {
+			hashes = append(hashes, hash)
+		}
+		viewModel.Title = fmt.Sprintf("%s as of %s: %d mails", meta.Name, viewModel.At, len(hashes))
+		for _, hash := range sortByDate(meta, hashes) {
+			viewModel.Entries = append(viewModel.Entries, s.snapshotEntry(meta, hash, ""))
+		}
+	case len(viewModel.From) > 0:
+		i, err := resolve(viewModel.From)
+		if err != nil {
+			return err
+		}
+		j, err := resolve(viewModel.To)
+		if err != nil {
+			return err
+		}
+		added, removed := snapshots.diff(i, j)
+		viewModel.Title = fmt.Sprintf("%s: %d added, %d removed", meta.Name, len(added), len(removed))
+		for _, hash := range sortByDate(meta, added) {
+			viewModel.Entries = append(viewModel.Entries, s.snapshotEntry(meta, hash, "+"))
+		}
+		for _, hash := range sortByDate(meta, removed) {
+			viewModel.Entries = append(viewModel.Entries, s.snapshotEntry(meta, hash, "-"))
+		}
+	}
+	return nil
+}
+
+// snapshotEntry describes a mail of a snapshot by the fields of the search index.
+func (s *Server) snapshotEntry(meta *MailboxMeta, hash, change string) *SnapshotEntry {
+	entry := &SnapshotEntry{Change: change, Subject: "(not indexed)"}
+	if msg := meta.Messages[hash]; msg != nil && !msg.InternalDate.IsZero() {
+		entry.Date = msg.InternalDate.Local().Format("2006-01-02 15:04")
+	}
+	if fields := s.index.Fields(hash + ".eml"); fields != nil {
+		entry.Subject = fields["Subject"]
+		entry.From = fields["From"]
+		entry.DownloadLink = "/download/" + hash + ".eml"
+	}
+	return entry
+}
+
 func (s *Server) search(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path != "/" {
 		w.WriteHeader(http.StatusNotFound)
@@ -82,7 +208,7 @@ func (s *Server) search(w http.ResponseWriter, r *http.Request) {
 
 	err := tpl.Execute(w, viewModel)
 	if err != nil {
-		fmt.Printf("failed to apply tpl: %v\n", err)
+		logger.Warn("failed to apply tpl", "err", err)
 	}
 
 }
@@ -95,15 +221,7 @@ func asEntry(doc *search.DocumentMatch) *Entry {
 	body = strings.ReplaceAll(body, "\n", "")
 	sizeBytes := fmt.Sprintf("%v", doc.Fields["Size"])
 	sizeNum, _ := strconv.ParseInt(sizeBytes, 10, 32)
-	size := strconv.Itoa(int(sizeNum)) + " Byte"
-	if sizeNum > 1024 {
-		size = strconv.Itoa(int(sizeNum/1024)) + " KiB"
-		sizeNum /= 1024
-	}
-	if sizeNum > 1024 {
-		size = strconv.Itoa(int(sizeNum/1024)) + " MiB"
-		sizeNum /= 1024
-	}
+	size := formatSize(sizeNum)
 
 	attachmentsStr := fmt.Sprintf("%v", doc.Fields["AttachmentCount"])
 	AttachmentCountNum, _ := strconv.ParseInt(attachmentsStr, 10, 32)
@@ -131,6 +249,34 @@ type Entry struct {
 	Attachments  int
 }
 
+type SnapshotModel struct {
+	Mailboxes []string
+	Mailbox   string
+	Name      string
+	At        string
+	From      string
+	To        string
+	Error     string
+	Title     string
+	Runs      []*SnapshotRunEntry
+	Entries   []*SnapshotEntry
+}
+
+type SnapshotRunEntry struct {
+	Time    string
+	Count   int
+	Added   int
+	Removed int
+}
+
+type SnapshotEntry struct {
+	Change       string
+	Date         string
+	Subject      string
+	From         string
+	DownloadLink string
+}
+
 const page = `
 <!DOCTYPE html>
 <html lang="en">
@@ -201,6 +347,7 @@ const page = `
     <div class="header">
         <form action="/" method="get">
             <h1>imaparchive search</h1>
+            <a href="/snapshots">snapshots</a>
             <input name="q" class="searchfield" type="text" value="{{ .Query }}"/>
             <button class="searchbutton" type="submit">Search</button>
         </form>
@@ -226,3 +373,97 @@ const page = `
 `
 
 var tpl = template.Must(template.New("page").Parse(page))
+
+const snapshotPage = `
+<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <title>imaparc snapshots</title>
+    <style>
+        body {
+            font-family: "Roboto Thin", sans-serif;
+        }
+
+        .content {
+            margin-left: auto;
+            margin-right: auto;
+            max-width: 900px;
+        }
+
+        table {
+            border-collapse: collapse;
+            width: 100%;
+        }
+
+        td, th {
+            font-size: small;
+            text-align: left;
+            padding: 2px 8px 2px 0;
+        }
+
+        .error {
+            color: #b00020;
+        }
+    </style>
+</head>
+<body>
+<div class="content">
+    <h1><a href="/snapshots">snapshots</a>{{ if .Name }} of {{ .Name }}{{ end }}</h1>
+	{{ if .Mailboxes }}
+    <ul>
+		{{ range .Mailboxes }}
+        <li><a href="/snapshots?mailbox={{ . }}">{{ . }}</a></li>
+		{{ end }}
+    </ul>
+	{{ end }}
+	{{ if .Mailbox }}
+    <form action="/snapshots" method="get">
+        <input name="mailbox" type="hidden" value="{{ .Mailbox }}"/>
+        as of <input name="at" type="text" placeholder="yyyy-mm-dd" value="{{ .At }}"/>
+        <button type="submit">Show</button>
+    </form>
+    <form action="/snapshots" method="get">
+        <input name="mailbox" type="hidden" value="{{ .Mailbox }}"/>
+        changes from <input name="from" type="text" placeholder="yyyy-mm-dd" value="{{ .From }}"/>
+        to <input name="to" type="text" placeholder="last run" value="{{ .To }}"/>
+        <button type="submit">Compare</button>
+    </form>
+	{{ end }}
+	{{ if .Error }}
+    <p class="error">{{ .Error }}</p>
+	{{ end }}
+	{{ if .Title }}
+    <h2>{{ .Title }}</h2>
+    <table>
+		{{ range .Entries }}
+        <tr>
+            <td>{{ .Change }}</td>
+            <td>{{ .Date }}</td>
+            <td>{{ .From }}</td>
+            <td>{{ if .DownloadLink }}<a href="{{ .DownloadLink }}" download>{{ .Subject }}</a>{{ else }}{{ .Subject }}{{ end }}</td>
+        </tr>
+		{{ end }}
+    </table>
+	{{ end }}
+	{{ if .Runs }}
+    <h2>runs</h2>
+    <table>
+        <tr><th>time</th><th>mails</th><th>added</th><th>removed</th></tr>
+		{{ $mailbox := .Mailbox }}
+		{{ range .Runs }}
+        <tr>
+            <td><a href="/snapshots?mailbox={{ $mailbox }}&at={{ .Time }}">{{ .Time }}</a></td>
+            <td>{{ .Count }}</td>
+            <td>{{ .Added }}</td>
+            <td>{{ .Removed }}</td>
+        </tr>
+		{{ end }}
+    </table>
+	{{ end }}
+</div>
+</body>
+</html>
+`
+
+var snapshotTpl = template.Must(template.New("snapshots").Parse(snapshotPage))
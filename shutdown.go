@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// exitInterrupted is the exit code of a run stopped by SIGINT or SIGTERM, as used by shells.
+const exitInterrupted = 130
+
+// errInterrupted stops an archive run after SIGINT or SIGTERM.
+var errInterrupted = errors.New("interrupted")
+
+// interrupted is closed on the first SIGINT or SIGTERM, see handleSignals.
+var interrupted = make(chan struct{})
+
+// handleSignals closes interrupted on the first SIGINT or SIGTERM, so that running archives finish their current
+// mail, write a checkpoint and the search index is closed. A second signal exits immediately.
+func handleSignals() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logger.Warn("shutting down, finishing current mails, press Ctrl-C again to exit immediately", "signal", sig)
+		close(interrupted)
+		sig = <-signals
+		logger.Error("exiting immediately", "signal", sig)
+		os.Exit(exitInterrupted)
+	}()
+}
+
+// isInterrupted returns true, after the process has been asked to shut down.
+func isInterrupted() bool {
+	select {
+	case <-interrupted:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"mime"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// snapshotFile records the mails of a mailbox at each archive run, next to the mailbox meta.
+const snapshotFile = "snapshots.json"
+
+// Snapshots is the history of a mailbox. Each run only records the changes since the previous run, so the hash of
+// a mail is written once, when it appears, and once, when it disappears from the server.
+type Snapshots struct {
+	Runs []*SnapshotRun `json:"runs"`
+}
+
+// SnapshotRun contains the changes of the mailbox found by a single archive run.
+type SnapshotRun struct {
+	Time    time.Time `json:"time"`
+	Added   []string  `json:"added,omitempty"`
+	Removed []string  `json:"removed,omitempty"`
+}
+
+// readSnapshots reads the snapshots.json of dir. A missing file results in an empty history.
+func readSnapshots(storage Storage, dir string) (*Snapshots, error) {
+	s := &Snapshots{}
+	b, err := storage.ReadFile(filepath.Join(dir, snapshotFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return s, fmt.Errorf("failed to read snapshots: %w", err)
+	}
+	if err := json.Unmarshal(b, s); err != nil {
+		return s, fmt.Errorf("failed to decode snapshots: %w", err)
+	}
+	return s, nil
+}
+
+func (s *Snapshots) write(storage Storage, dir string) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("failed to marshal: %w", err)
+	}
+	fname := filepath.Join(dir, snapshotFile)
+	if err := storage.WriteFile(fname, b, time.Time{}); err != nil {
+		return fmt.Errorf("failed to write %s: %w", fname, err)
+	}
+	return nil
+}
+
+// record appends a run, which found the given mails in the mailbox.
+func (s *Snapshots) record(t time.Time, hashes []string) {
+	before := s.members(len(s.Runs) - 1)
+	run := &SnapshotRun{Time: t.UTC().Truncate(time.Second)}
+	now := make(map[string]bool)
+	for _, hash := range hashes {
+		if !now[hash] && !before[hash] {
+			run.Added = append(run.Added, hash)
+		}
+		now[hash] = true
+	}
+	for hash := range before {
+		if !now[hash] {
+			run.Removed = append(run.Removed, hash)
+		}
+	}
+	sort.Strings(run.Added)
+	sort.Strings(run.Removed)
+	s.Runs = append(s.Runs, run)
+}
+
+// members returns the mails found by the run with index i. Before the first run, the mailbox is empty.
+func (s *Snapshots) members(i int) map[string]bool {
+	res := make(map[string]bool)
+	for _, run := range s.Runs[:i+1] {
+		for _, hash := range run.Added {
+			res[hash] = true
+		}
+		for _, hash := range run.Removed {
+			delete(res, hash)
+		}
+	}
+	return res
+}
+
+// at returns the index of the last run at or before t or -1, if the mailbox has not been archived by then.
+func (s *Snapshots) at(t time.Time) int {
+	return sort.Search(len(s.Runs), func(i int) bool { return s.Runs[i].Time.After(t) }) - 1
+}
+
+// diff returns the mails added and removed between the runs with the index from and to.
+func (s *Snapshots) diff(from, to int) (added, removed []string) {
+	before, after := s.members(from), s.members(to)
+	for hash := range after {
+		if !before[hash] {
+			added = append(added, hash)
+		}
+	}
+	for hash := range before {
+		if !after[hash] {
+			removed = append(removed, hash)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+// parseSnapshotTime accepts a date (yyyy-mm-dd), which denotes the end of that day, or a RFC 3339 timestamp.
+func parseSnapshotTime(str string) (time.Time, error) {
+	if t, err := time.ParseInLocation(dateLayout, str, time.Local); err == nil {
+		return t.AddDate(0, 0, 1).Add(-time.Nanosecond), nil
+	}
+	t, err := time.Parse(time.RFC3339, str)
+	if err != nil {
+		return t, fmt.Errorf("invalid time '%s', expected yyyy-mm-dd or RFC 3339", str)
+	}
+	return t, nil
+}
+
+// snapshotDirs returns the mailbox directories below dir, which have a snapshot history.
+func snapshotDirs(storage Storage, dir string) ([]string, error) {
+	var res []string
+	err := storage.Walk(dir, func(name string) error {
+		if filepath.Base(name) == snapshotFile {
+			res = append(res, filepath.Dir(name))
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// findSnapshotDir returns the directory of the named mailbox below dir.
+func findSnapshotDir(storage Storage, dir, mailbox string) (string, error) {
+	dirs, err := snapshotDirs(storage, dir)
+	if err != nil {
+		return "", err
+	}
+	for _, d := range dirs {
+		meta, err := readStoredMeta(storage, d)
+		if err != nil {
+			logger.Warn("ignoring unreadable mailbox meta", "dir", d, "err", err)
+			continue
+		}
+		if meta.Name == mailbox {
+			return d, nil
+		}
+	}
+	return "", fmt.Errorf("no snapshots of mailbox '%s' in %s", mailbox, dir)
+}
+
+// snapshotCommand shows the history of a mailbox:
+// imaparc snapshot -dir <account> [-configFile file] -mailbox name [-at time | -from time -to time]
+func snapshotCommand(args []string) int {
+	flags := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	dir := flags.String("dir", "", "the archive directory of the account")
+	configFile := flags.String("configFile", "", "filename to a configuration, which selects the storage")
+	mailbox := flags.String("mailbox", "", "the name of the mailbox, e.g. INBOX")
+	at := flags.String("at", "", "list the mails of the mailbox as of this date (yyyy-mm-dd) or time (RFC 3339)")
+	from := flags.String("from", "", "show the changes since this date or time")
+	to := flags.String("to", "", "show the changes until this date or time, defaults to the last run")
+	flags.Parse(args)
+
+	if len(*dir) == 0 || len(*mailbox) == 0 {
+		fmt.Println("usage: imaparc snapshot -dir <account> [-configFile file] -mailbox name [-at time | -from time [-to time]]")
+		return 2
+	}
+	var storage Storage = localStorage{}
+	if len(*configFile) > 0 {
+		storage = loadConfigOrExit(*configFile).storage
+	}
+	mbDir, err := findSnapshotDir(storage, *dir, *mailbox)
+	if err != nil {
+		logger.Error("cannot find mailbox", "err", err)
+		return 1
+	}
+	snapshots, err := readSnapshots(storage, mbDir)
+	if err != nil {
+		logger.Error("cannot read snapshots", "dir", mbDir, "err", err)
+		return 1
+	}
+	meta, err := readStoredMeta(storage, mbDir)
+	if err != nil {
+		logger.Warn("cannot read mailbox meta", "dir", mbDir, "err", err)
+	}
+
+	// resolve returns the index of the run as of the given time, an empty time is the last run
+	resolve := func(str string) (int, error) {
+		if len(str) == 0 {
+			return len(snapshots.Runs) - 1, nil
+		}
+		t, err := parseSnapshotTime(str)
+		if err != nil {
+			return 0, err
+		}
+		return snapshots.at(t), nil
+	}
+
+	switch {
+	case len(*at) > 0:
+		i, err := resolve(*at)
+		if err != nil {
+			fmt.Println(err)
+			return 2
+		}
+		if i < 0 {
+			fmt.Printf("%s has not been archived before %s\n", *mailbox, *at)
+			return 0
+		}
+		members := snapshots.members(i)
+		fmt.Printf("%s as of %s, run at %s: %d mails\n", *mailbox, *at, snapshots.Runs[i].Time.Local().Format(time.RFC3339),
+			len(members))
+		var hashes []string
+		for hash := range members {
+			hashes = append(hashes, hash)
+		}
+		for _, hash := range sortByDate(meta, hashes) {
+			fmt.Println(" " + describeSnapshotMail(storage, mbDir, meta, hash))
+		}
+	case len(*from) > 0:
+		i, err := resolve(*from)
+		if err != nil {
+			fmt.Println(err)
+			return 2
+		}
+		j, err := resolve(*to)
+		if err != nil {
+			fmt.Println(err)
+			return 2
+		}
+		added, removed := snapshots.diff(i, j)
+		fmt.Printf("%s: %d added, %d removed\n", *mailbox, len(added), len(removed))
+		for _, hash := range sortByDate(meta, added) {
+			fmt.Println(" + " + describeSnapshotMail(storage, mbDir, meta, hash))
+		}
+		for _, hash := range sortByDate(meta, removed) {
+			fmt.Println(" - " + describeSnapshotMail(storage, mbDir, meta, hash))
+		}
+	default:
+		count := 0
+		for _, run := range snapshots.Runs {
+			count += len(run.Added) - len(run.Removed)
+			fmt.Printf("%s  %6d mails  +%d  -%d\n", run.Time.Local().Format(time.RFC3339), count, len(run.Added),
+				len(run.Removed))
+		}
+	}
+	return 0
+}
+
+// sortByDate sorts the hashes by the date, when the server received the mails. Unknown dates come first.
+func sortByDate(meta *MailboxMeta, hashes []string) []string {
+	date := func(hash string) time.Time {
+		if msg := meta.Messages[hash]; msg != nil {
+			return msg.InternalDate
+		}
+		return time.Time{}
+	}
+	sort.Strings(hashes)
+	sort.SliceStable(hashes, func(i, j int) bool { return date(hashes[i]).Before(date(hashes[j])) })
+	return hashes
+}
+
+// describeSnapshotMail returns the hash, the received date and the subject of an archived mail.
+func describeSnapshotMail(storage Storage, dir string, meta *MailboxMeta, hash string) string {
+	date := "                   "
+	if msg := meta.Messages[hash]; msg != nil && !msg.InternalDate.IsZero() {
+		date = msg.InternalDate.Local().Format("2006-01-02 15:04:05")
+	}
+	subject := "(not archived)"
+	if file, err := storage.Open(filepath.Join(dir, hash+".eml")); err == nil {
+		if msg, err := mail.ReadMessage(file); err == nil {
+			subject = strings.TrimSpace(msg.Header.Get("Subject"))
+			if dec, err := new(mime.WordDecoder).DecodeHeader(subject); err == nil {
+				subject = dec
+			}
+		}
+		file.Close()
+	}
+	return hash + "  " + date + "  " + subject
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	imap2 "github.com/emersion/go-imap"
+)
+
+// headerSource returns the headers of mails received at the given dates for each mailbox.
+type headerSource struct {
+	Source
+	dates   []time.Time
+	fetched []string // mailboxes in the order of their fetches
+}
+
+func (s *headerSource) Mails(mailbox string, fetchItem []imap2.FetchItem, from, to int) ([]*imap2.Message, error) {
+	s.fetched = append(s.fetched, mailbox)
+	var res []*imap2.Message
+	for i := from; i <= to; i++ {
+		msg := &imap2.Message{SeqNum: uint32(i), Uid: uint32(i), InternalDate: s.dates[i-1],
+			Envelope: &imap2.Envelope{Subject: fmt.Sprint("mail ", i)}}
+		if err := setBody(msg, imap2.FetchRFC822Header, []byte(fmt.Sprintf("Subject: mail %d\r\n\r\n", i))); err != nil {
+			return nil, err
+		}
+		res = append(res, msg)
+	}
+	return res, nil
+}
+
+func TestSnapshotKeepsFilteredMails(t *testing.T) {
+	dir := t.TempDir()
+	src := &headerSource{dates: []time.Time{time.Date(2019, 3, 1, 0, 0, 0, 0, time.Local),
+		time.Date(2021, 3, 1, 0, 0, 0, 0, time.Local)}}
+	a := &App{cfg: &Config{Account: Account{Name: "alice", Since: "2020-01-01"}, Dir: dir}, storage: localStorage{},
+		report: &AccountReport{Started: time.Now()}}
+	mb := &imap2.MailboxStatus{Name: "INBOX", Messages: 2}
+	targetDir := filepath.Join(dir, "INBOX")
+
+	all, filtered, err := a.scanMailbox(src, mb, targetDir, a.cfg.IncludesDate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || filtered != 1 || !all[0].filtered || len(pending(all)) != 1 {
+		t.Fatalf("expected the old mail as filtered, got %d mails, %d filtered", len(all), filtered)
+	}
+	if err := a.recordSnapshot(targetDir, all); err != nil {
+		t.Fatal(err)
+	}
+
+	// the mail outside of the date range is still in the mailbox
+	a.report.Started = a.report.Started.Add(time.Hour)
+	if err := a.recordSnapshot(targetDir, all); err != nil {
+		t.Fatal(err)
+	}
+	snapshots, err := readSnapshots(localStorage{}, targetDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots.Runs) < 1 || len(snapshots.Runs[0].Added) != 2 || len(snapshots.members(len(snapshots.Runs)-1)) != 2 {
+		t.Fatalf("expected both mails as members, got %+v", snapshots.Runs)
+	}
+	for _, run := range snapshots.Runs {
+		if len(run.Removed) > 0 {
+			t.Fatalf("unexpected removed mails %v", run.Removed)
+		}
+	}
+}
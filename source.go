@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+
+	"github.com/emersion/go-imap"
+)
+
+// Source is a mail server to archive from. Mails are described by imap messages, regardless of the protocol.
+type Source interface {
+	Login(cfg *Config) error
+	Logout() error
+	// Mailboxes lists all mailboxes of the account.
+	Mailboxes() ([]*imap.MailboxInfo, error)
+	// Status returns the number of mails of the mailbox.
+	Status(mailbox string) (*imap.MailboxStatus, error)
+	// Mails fetches the given items of the mails with the sequence numbers from to to (inclusive).
+	Mails(mailbox string, fetchItem []imap.FetchItem, from, to int) ([]*imap.Message, error)
+	// Mail fetches the complete mail with the given sequence number.
+	Mail(mailbox string, num int) (*imap.Message, error)
+	// RawMail fetches the content of the mail with the given uid without parsing it.
+	RawMail(mailbox string, uid uint32) ([]byte, error)
+}
+
+// MailParseError is returned by a source, if it cannot parse the response describing a mail, e.g. because of a
+// broken body structure. The mail itself may still be fetched by RawMail.
+type MailParseError struct {
+	Err error
+}
+
+func (e *MailParseError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *MailParseError) Unwrap() error {
+	return e.Err
+}
+
+// isParseError returns true, if the source rejected the response describing a mail.
+func isParseError(err error) bool {
+	var parseErr *MailParseError
+	return errors.As(err, &parseErr)
+}
+
+// uidlSource is implemented by sources without stable numeric uids, which identify mails by unique strings
+// instead. Mails returned by Mails without header items only carry the sequence number, uid and size, so that
+// mails known by their unique id are not fetched again.
+type uidlSource interface {
+	Source
+	// UIDL returns the unique id of a mail returned by Mails.
+	UIDL(mail *imap.Message) string
+}
+
+// compressedSource is implemented by sources, which may compress their connection.
+type compressedSource interface {
+	// Compression returns the statistics of the connection or nil, if it is not compressed.
+	Compression() *CompressionReport
+}
+
+// newSource returns an unconnected source for the protocol of the account.
+func newSource(cfg *Config) Source {
+	if cfg.Protocol == protocolPOP3 {
+		return &Pop3{}
+	}
+	return &Imap{}
+}
+
+func tlsConfigFor(cfg *Config) *tls.Config {
+	tlsConfig := &tls.Config{
+		ServerName:         cfg.Server,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if len(cfg.TLSServerName) > 0 {
+		tlsConfig.ServerName = cfg.TLSServerName
+	}
+	return tlsConfig
+}
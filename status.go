@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// stateDir is the name of the directory inside an account directory, which contains the bookkeeping of imaparc
+// itself. It is never a mailbox.
+const stateDir = ".imaparc"
+
+// AccountStatus is the persistent outcome of the last runs of an account.
+type AccountStatus struct {
+	LastRun             time.Time `json:"lastRun"`
+	LastSuccess         time.Time `json:"lastSuccess"`
+	LastError           string    `json:"lastError,omitempty"`
+	LastDurationSeconds float64   `json:"lastDurationSeconds"`
+}
+
+func statusFile(dir string) string {
+	return filepath.Join(dir, stateDir, "status.json")
+}
+
+// loadStatus reads the status of the account in dir. A missing file results in an empty status.
+func loadStatus(dir string) (*AccountStatus, error) {
+	status := &AccountStatus{}
+	b, err := ioutil.ReadFile(statusFile(dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return status, nil
+		}
+		return status, fmt.Errorf("failed to read status: %w", err)
+	}
+	if err := json.Unmarshal(b, status); err != nil {
+		return status, fmt.Errorf("failed to decode status: %w", err)
+	}
+	return status, nil
+}
+
+// update applies the outcome of a finished run.
+func (s *AccountStatus) update(report *AccountReport) {
+	s.LastRun = report.Started
+	s.LastDurationSeconds = report.DurationSeconds
+	s.LastError = report.lastError()
+	if report.Success {
+		s.LastSuccess = report.Finished
+	}
+}
+
+func (s *AccountStatus) save(dir string) error {
+	fname := statusFile(dir)
+	if err := os.MkdirAll(filepath.Dir(fname), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to mkdir %s: %w", filepath.Dir(fname), err)
+	}
+	b, err := json.MarshalIndent(s, " ", " ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal: %w", err)
+	}
+	if err := ioutil.WriteFile(fname, b, os.ModePerm); err != nil {
+		return fmt.Errorf("failed to write %s: %w", fname, err)
+	}
+	return nil
+}
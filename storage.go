@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The types of storage.
+const (
+	storageDir = "dir"
+	storageS3  = "s3"
+)
+
+// Storage holds the archived mails and the metas of the mailboxes. Files are addressed by the local path derived
+// from the account directory, so the layout is the same for all backends. Missing files are reported as errors
+// satisfying os.IsNotExist.
+type Storage interface {
+	// Exists returns true, if the file exists.
+	Exists(name string) (bool, error)
+	// List returns the names of the files directly within dir. A missing dir is empty.
+	List(dir string) ([]string, error)
+	// Walk calls fn with the path of each file below dir, including nested directories.
+	Walk(dir string, fn func(name string) error) error
+	ReadFile(name string) ([]byte, error)
+	Open(name string) (io.ReadCloser, error)
+	// WriteFile creates or replaces the file. If modTime is not zero, it is kept as the modification time.
+	WriteFile(name string, b []byte, modTime time.Time) error
+	// Rename moves a file or a directory with all files below it. A directory is merged into an existing
+	// directory newName, but existing files are never replaced.
+	Rename(oldName, newName string) error
+	// Remove deletes the file. A missing file is no error.
+	Remove(name string) error
+}
+
+// StorageConfig selects where mails are archived. Without a configuration, the local directories are used. An s3
+// storage maps the configured directory to the prefix within the bucket.
+type StorageConfig struct {
+	// Type is either dir (the default) or s3.
+	Type string `json:"type"`
+	// Endpoint is the url of the s3 service, e.g. https://s3.eu-central-1.amazonaws.com or http://localhost:9000.
+	Endpoint  string `json:"endpoint"`
+	Region    string `json:"region"`
+	Bucket    string `json:"bucket"`
+	Prefix    string `json:"prefix"`
+	AccessKey string `json:"accessKey"`
+	SecretKey string `json:"secretKey"`
+}
+
+// Validate checks the storage for obviously invalid settings.
+func (c *StorageConfig) Validate() error {
+	switch c.Type {
+	case "", storageDir:
+	case storageS3:
+		if len(c.Bucket) == 0 {
+			return fmt.Errorf("bucket is required")
+		}
+	default:
+		return fmt.Errorf("unknown storage type '%s', expected dir or s3", c.Type)
+	}
+	return nil
+}
+
+// open creates the configured storage for the files below root.
+func (c *StorageConfig) open(root string) Storage {
+	if c == nil || c.Type != storageS3 {
+		return localStorage{}
+	}
+	return newS3Storage(c, root)
+}
+
+// storageOf returns s or, if it is not configured, the local directories.
+func storageOf(s Storage) Storage {
+	if s == nil {
+		return localStorage{}
+	}
+	return s
+}
+
+// localStorage keeps all files in the local file system.
+type localStorage struct{}
+
+func (localStorage) Exists(name string) (bool, error) {
+	_, err := os.Stat(name)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (localStorage) List(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var res []string
+	for _, f := range files {
+		if f.Mode().IsRegular() {
+			res = append(res, f.Name())
+		}
+	}
+	return res, nil
+}
+
+func (localStorage) Walk(dir string, fn func(name string) error) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		return fn(path)
+	})
+}
+
+func (localStorage) ReadFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(name)
+}
+
+func (localStorage) Open(name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
+
+// WriteFile writes a temporary file and renames it, so that an interrupted write never leaves a partial file.
+func (localStorage) WriteFile(name string, b []byte, modTime time.Time) error {
+	if err := os.MkdirAll(filepath.Dir(name), os.ModePerm); err != nil {
+		return err
+	}
+	tmp := name + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, os.ModePerm); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if !modTime.IsZero() {
+		if err := os.Chtimes(tmp, modTime, modTime); err != nil {
+			logger.Warn("cannot set modification time", "file", name, "err", err)
+		}
+	}
+	return os.Rename(tmp, name)
+}
+
+// Rename moves the directory at once, if newName does not exist. Otherwise the entries are moved one by one.
+func (localStorage) Rename(oldName, newName string) error {
+	if err := os.MkdirAll(filepath.Dir(newName), os.ModePerm); err != nil {
+		return err
+	}
+	info, err := os.Stat(oldName)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(newName); os.IsNotExist(err) {
+		return os.Rename(oldName, newName)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("cannot move %s, %s exists", oldName, newName)
+	}
+	files, err := ioutil.ReadDir(oldName)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := (localStorage{}).Rename(filepath.Join(oldName, f.Name()), filepath.Join(newName, f.Name())); err != nil {
+			return err
+		}
+	}
+	return os.Remove(oldName)
+}
+
+func (localStorage) Remove(name string) error {
+	if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
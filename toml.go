@@ -0,0 +1,544 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// tomlError is a syntax error at a position of a TOML document.
+type tomlError struct {
+	line, column int
+	msg          string
+}
+
+func (e *tomlError) Error() string {
+	return fmt.Sprintf("%d:%d: %s", e.line, e.column, e.msg)
+}
+
+var (
+	tomlBareKey  = regexp.MustCompile(`^[A-Za-z0-9_-]+`)
+	tomlDecimal  = regexp.MustCompile(`^[+-]?(0|[1-9](_?[0-9])*)$`)
+	tomlPrefixed = regexp.MustCompile(`^(0x[0-9A-Fa-f](_?[0-9A-Fa-f])*|0o[0-7](_?[0-7])*|0b[01](_?[01])*)$`)
+	tomlFloat    = regexp.MustCompile(`^[+-]?(0|[1-9](_?[0-9])*)((\.[0-9](_?[0-9])*)([eE][+-]?[0-9](_?[0-9])*)?|[eE][+-]?[0-9](_?[0-9])*)$`)
+	tomlSpecial  = regexp.MustCompile(`^[+-]?(inf|nan)$`)
+	tomlDateTime = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2}([Tt ]\d{2}:\d{2}(:\d{2}(\.\d+)?)?([Zz]|[+-]\d{2}:\d{2})?)?|\d{2}:\d{2}(:\d{2}(\.\d+)?)?)$`)
+)
+
+// tomlParser reads a TOML document into a yaml node tree, so that a TOML configuration is interpolated, checked
+// and decoded exactly like a yaml one, including the positions of reported problems. Dates and times are kept as
+// strings.
+type tomlParser struct {
+	src       string
+	pos       int
+	line      int
+	lineStart int
+	// explicit tables have been declared by a header, closed ones are inline tables, which cannot be extended
+	explicit    map[*yaml.Node]bool
+	closed      map[*yaml.Node]bool
+	tableArrays map[*yaml.Node]bool
+}
+
+// parseTOML parses the document. A document without any key is returned as an empty node.
+func parseTOML(b []byte) (*yaml.Node, error) {
+	p := &tomlParser{src: string(b), line: 1, explicit: map[*yaml.Node]bool{}, closed: map[*yaml.Node]bool{},
+		tableArrays: map[*yaml.Node]bool{}}
+	root := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Line: 1, Column: 1}
+	if err := p.parse(root); err != nil {
+		return nil, err
+	}
+	if len(root.Content) == 0 {
+		return &yaml.Node{}, nil
+	}
+	return &yaml.Node{Kind: yaml.DocumentNode, Line: 1, Column: 1, Content: []*yaml.Node{root}}, nil
+}
+
+func (p *tomlParser) parse(root *yaml.Node) error {
+	table := root
+	for {
+		p.skipSpace()
+		if p.eof() {
+			return nil
+		}
+		switch c := p.peek(); {
+		case c == '#' || c == '\r' || c == '\n':
+		case c == '[':
+			var err error
+			if table, err = p.parseHeader(root); err != nil {
+				return err
+			}
+		default:
+			if err := p.parseKeyValue(table); err != nil {
+				return err
+			}
+		}
+		if err := p.endOfLine(); err != nil {
+			return err
+		}
+	}
+}
+
+// parseHeader parses [table] or [[array of tables]] and returns the table, which the following keys belong to.
+func (p *tomlParser) parseHeader(root *yaml.Node) (*yaml.Node, error) {
+	line, column := p.line, p.column()
+	p.pos++
+	array := p.consume("[")
+	p.skipSpace()
+	keys, err := p.parseKey()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if !p.consume("]") || (array && !p.consume("]")) {
+		return nil, p.errorf("expected ] after the table name")
+	}
+
+	node, err := p.descend(root, keys[:len(keys)-1], false)
+	if err != nil {
+		return nil, err
+	}
+	last := keys[len(keys)-1]
+	value := valueOf(node, last.Value)
+	if array {
+		if value == nil {
+			value = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Line: line, Column: column}
+			node.Content = append(node.Content, last, value)
+			p.tableArrays[value] = true
+		} else if !p.tableArrays[value] {
+			return nil, p.errorAt(last, "%s is not an array of tables", last.Value)
+		}
+		table := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Line: line, Column: column}
+		value.Content = append(value.Content, table)
+		return table, nil
+	}
+	switch {
+	case value == nil:
+		value = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Line: line, Column: column}
+		node.Content = append(node.Content, last, value)
+	case value.Kind != yaml.MappingNode || p.closed[value]:
+		return nil, p.errorAt(last, "%s is not a table", last.Value)
+	case p.explicit[value]:
+		return nil, p.errorAt(last, "table %s is defined twice", last.Value)
+	}
+	p.explicit[value] = true
+	return value, nil
+}
+
+// parseKeyValue parses key = value into the given table.
+func (p *tomlParser) parseKeyValue(table *yaml.Node) error {
+	keys, err := p.parseKey()
+	if err != nil {
+		return err
+	}
+	p.skipSpace()
+	if !p.consume("=") {
+		return p.errorf("expected = after the key")
+	}
+	p.skipSpace()
+	node, err := p.descend(table, keys[:len(keys)-1], true)
+	if err != nil {
+		return err
+	}
+	last := keys[len(keys)-1]
+	if valueOf(node, last.Value) != nil {
+		return p.errorAt(last, "key %s is defined twice", last.Value)
+	}
+	value, err := p.parseValue()
+	if err != nil {
+		return err
+	}
+	node.Content = append(node.Content, last, value)
+	return nil
+}
+
+// descend returns the table named by the dotted keys below node, creating missing tables. Keys of an array of
+// tables refer to its last table. Values may not extend tables declared by a header.
+func (p *tomlParser) descend(node *yaml.Node, keys []*yaml.Node, dotted bool) (*yaml.Node, error) {
+	for _, key := range keys {
+		value := valueOf(node, key.Value)
+		switch {
+		case value == nil:
+			value = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Line: key.Line, Column: key.Column}
+			node.Content = append(node.Content, key, value)
+		case p.tableArrays[value] && !dotted:
+			value = value.Content[len(value.Content)-1]
+		case value.Kind != yaml.MappingNode || p.closed[value] || (dotted && p.explicit[value]):
+			return nil, p.errorAt(key, "%s is not a table", key.Value)
+		}
+		node = value
+	}
+	return node, nil
+}
+
+// parseKey parses a bare, quoted or dotted key.
+func (p *tomlParser) parseKey() ([]*yaml.Node, error) {
+	var keys []*yaml.Node
+	for {
+		p.skipSpace()
+		if p.eof() {
+			return nil, p.errorf("expected a key")
+		}
+		key := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Line: p.line, Column: p.column()}
+		switch p.peek() {
+		case '"', '\'':
+			str, err := p.parseString(false)
+			if err != nil {
+				return nil, err
+			}
+			key.Value = str
+		default:
+			bare := tomlBareKey.FindString(p.src[p.pos:])
+			if len(bare) == 0 {
+				return nil, p.errorf("expected a key")
+			}
+			key.Value = bare
+			p.pos += len(bare)
+		}
+		keys = append(keys, key)
+		p.skipSpace()
+		if !p.consume(".") {
+			return keys, nil
+		}
+	}
+}
+
+// parseValue parses a string, number, boolean, date, array or inline table.
+func (p *tomlParser) parseValue() (*yaml.Node, error) {
+	if p.eof() {
+		return nil, p.errorf("expected a value")
+	}
+	node := &yaml.Node{Kind: yaml.ScalarNode, Line: p.line, Column: p.column()}
+	switch p.peek() {
+	case '"', '\'':
+		str, err := p.parseString(true)
+		if err != nil {
+			return nil, err
+		}
+		node.Tag, node.Value = "!!str", str
+		// a reference to the environment is resolved like a plain yaml value, so that port = "${PORT}" works
+		if !strings.Contains(str, "${") {
+			node.Style = yaml.DoubleQuotedStyle
+		}
+		return node, nil
+	case '[':
+		return p.parseArray()
+	case '{':
+		return p.parseInlineTable()
+	}
+
+	end := p.pos
+	for end < len(p.src) && !strings.ContainsRune(" \t\r\n,]}#", rune(p.src[end])) {
+		end++
+	}
+	token := p.src[p.pos:end]
+	if len(token) == 0 {
+		return nil, p.errorf("expected a value")
+	}
+	// a date and a time may be separated by a space
+	if tomlDateTime.MatchString(token) && len(token) == 10 && end+1 < len(p.src) && p.src[end] == ' ' &&
+		p.src[end+1] >= '0' && p.src[end+1] <= '9' {
+		end++
+		for end < len(p.src) && !strings.ContainsRune(" \t\r\n,]}#", rune(p.src[end])) {
+			end++
+		}
+		token = p.src[p.pos:end]
+	}
+	switch {
+	case token == "true" || token == "false":
+		node.Tag, node.Value = "!!bool", token
+	case tomlDecimal.MatchString(token):
+		v, err := strconv.ParseInt(strings.ReplaceAll(token, "_", ""), 10, 64)
+		if err != nil {
+			return nil, p.errorf("invalid integer %s", token)
+		}
+		node.Tag, node.Value = "!!int", strconv.FormatInt(v, 10)
+	case tomlPrefixed.MatchString(token):
+		v, err := strconv.ParseInt(token, 0, 64)
+		if err != nil {
+			return nil, p.errorf("invalid integer %s", token)
+		}
+		node.Tag, node.Value = "!!int", strconv.FormatInt(v, 10)
+	case tomlFloat.MatchString(token):
+		node.Tag, node.Value = "!!float", strings.ReplaceAll(token, "_", "")
+	case tomlSpecial.MatchString(token):
+		node.Tag, node.Value = "!!float", strings.TrimPrefix(strings.Replace(token, "inf", ".inf", 1), "+")
+		if strings.HasSuffix(token, "nan") {
+			node.Value = ".nan"
+		}
+	case tomlDateTime.MatchString(token):
+		node.Tag, node.Value, node.Style = "!!str", token, yaml.DoubleQuotedStyle
+	default:
+		return nil, p.errorf("invalid value '%s'", token)
+	}
+	p.pos = end
+	return node, nil
+}
+
+func (p *tomlParser) parseArray() (*yaml.Node, error) {
+	node := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Line: p.line, Column: p.column()}
+	p.pos++
+	for {
+		p.skipBlank()
+		if p.consume("]") {
+			return node, nil
+		}
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		node.Content = append(node.Content, value)
+		p.skipBlank()
+		if p.consume("]") {
+			return node, nil
+		}
+		if !p.consume(",") {
+			return nil, p.errorf("expected , or ] in array")
+		}
+	}
+}
+
+func (p *tomlParser) parseInlineTable() (*yaml.Node, error) {
+	node := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Line: p.line, Column: p.column()}
+	p.pos++
+	p.skipSpace()
+	if p.consume("}") {
+		p.closed[node] = true
+		return node, nil
+	}
+	for {
+		if err := p.parseKeyValue(node); err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if p.consume("}") {
+			p.closeTable(node)
+			return node, nil
+		}
+		if !p.consume(",") {
+			return nil, p.errorf("expected , or } in inline table")
+		}
+		p.skipSpace()
+	}
+}
+
+// closeTable marks an inline table and the tables of its dotted keys as complete.
+func (p *tomlParser) closeTable(node *yaml.Node) {
+	p.closed[node] = true
+	for i := 1; i < len(node.Content); i += 2 {
+		if node.Content[i].Kind == yaml.MappingNode {
+			p.closeTable(node.Content[i])
+		}
+	}
+}
+
+// parseString parses a basic or literal string. Multi-line strings are only allowed as values.
+func (p *tomlParser) parseString(multiline bool) (string, error) {
+	quote := p.src[p.pos : p.pos+1]
+	literal := quote == "'"
+	if multiline && strings.HasPrefix(p.src[p.pos:], quote+quote+quote) {
+		return p.parseMultilineString(quote, literal)
+	}
+	p.pos++
+	sb := &strings.Builder{}
+	for {
+		if p.eof() || p.peek() == '\n' || p.peek() == '\r' {
+			return "", p.errorf("unterminated string")
+		}
+		c := p.peek()
+		switch {
+		case string(c) == quote:
+			p.pos++
+			return sb.String(), nil
+		case c == '\\' && !literal:
+			if err := p.parseEscape(sb); err != nil {
+				return "", err
+			}
+		default:
+			sb.WriteByte(c)
+			p.pos++
+		}
+	}
+}
+
+func (p *tomlParser) parseMultilineString(quote string, literal bool) (string, error) {
+	delim := quote + quote + quote
+	p.pos += 3
+	// a newline immediately following the opening delimiter is trimmed
+	if !p.consume("\r\n") {
+		p.consume("\n")
+	}
+	sb := &strings.Builder{}
+	for {
+		if p.eof() {
+			return "", p.errorf("unterminated string")
+		}
+		if strings.HasPrefix(p.src[p.pos:], delim) {
+			p.pos += 3
+			// up to two quotes may precede the closing delimiter
+			for i := 0; i < 2 && p.consume(quote); i++ {
+				sb.WriteString(quote)
+			}
+			return sb.String(), nil
+		}
+		c := p.peek()
+		switch {
+		case c == '\\' && !literal:
+			// a line ending backslash trims the following whitespace and newlines
+			rest := strings.TrimLeft(p.src[p.pos+1:], " \t")
+			if strings.HasPrefix(rest, "\n") || strings.HasPrefix(rest, "\r\n") {
+				p.pos++
+				p.skipBlankOnly()
+				continue
+			}
+			if err := p.parseEscape(sb); err != nil {
+				return "", err
+			}
+		case c == '\n':
+			sb.WriteByte(c)
+			p.newline()
+		default:
+			sb.WriteByte(c)
+			p.pos++
+		}
+	}
+}
+
+func (p *tomlParser) parseEscape(sb *strings.Builder) error {
+	if p.pos+1 >= len(p.src) {
+		return p.errorf("unterminated string")
+	}
+	// errors are reported at the backslash
+	start, c := p.pos, p.src[p.pos+1]
+	p.pos += 2
+	switch c {
+	case 'b':
+		sb.WriteByte('\b')
+	case 't':
+		sb.WriteByte('\t')
+	case 'n':
+		sb.WriteByte('\n')
+	case 'f':
+		sb.WriteByte('\f')
+	case 'r':
+		sb.WriteByte('\r')
+	case 'e':
+		sb.WriteByte(0x1b)
+	case '"', '\\':
+		sb.WriteByte(c)
+	case 'u', 'U':
+		size := 4
+		if c == 'U' {
+			size = 8
+		}
+		var v uint64
+		var err error
+		if p.pos+size <= len(p.src) {
+			v, err = strconv.ParseUint(p.src[p.pos:p.pos+size], 16, 32)
+		}
+		if p.pos+size > len(p.src) || err != nil || !utf8.ValidRune(rune(v)) {
+			p.pos = start
+			return p.errorf("invalid unicode escape")
+		}
+		sb.WriteRune(rune(v))
+		p.pos += size
+	default:
+		p.pos = start
+		return p.errorf("invalid escape \\%c", c)
+	}
+	return nil
+}
+
+// endOfLine expects only a comment until the end of the line.
+func (p *tomlParser) endOfLine() error {
+	p.skipSpace()
+	if p.consume("#") {
+		for !p.eof() && p.peek() != '\n' {
+			p.pos++
+		}
+	}
+	if p.eof() {
+		return nil
+	}
+	if !p.consume("\r\n") && !p.consume("\n") {
+		return p.errorf("expected the end of the line")
+	}
+	p.line++
+	p.lineStart = p.pos
+	return nil
+}
+
+// skipBlank skips whitespace, newlines and comments within arrays.
+func (p *tomlParser) skipBlank() {
+	for !p.eof() {
+		switch p.peek() {
+		case ' ', '\t', '\r':
+			p.pos++
+		case '\n':
+			p.newline()
+		case '#':
+			for !p.eof() && p.peek() != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// skipBlankOnly skips whitespace and newlines.
+func (p *tomlParser) skipBlankOnly() {
+	for !p.eof() {
+		switch p.peek() {
+		case ' ', '\t', '\r':
+			p.pos++
+		case '\n':
+			p.newline()
+		default:
+			return
+		}
+	}
+}
+
+func (p *tomlParser) skipSpace() {
+	for !p.eof() && (p.peek() == ' ' || p.peek() == '\t') {
+		p.pos++
+	}
+}
+
+func (p *tomlParser) newline() {
+	p.pos++
+	p.line++
+	p.lineStart = p.pos
+}
+
+func (p *tomlParser) consume(s string) bool {
+	if strings.HasPrefix(p.src[p.pos:], s) {
+		p.pos += len(s)
+		return true
+	}
+	return false
+}
+
+func (p *tomlParser) eof() bool {
+	return p.pos >= len(p.src)
+}
+
+func (p *tomlParser) peek() byte {
+	return p.src[p.pos]
+}
+
+func (p *tomlParser) column() int {
+	return utf8.RuneCountInString(p.src[p.lineStart:p.pos]) + 1
+}
+
+func (p *tomlParser) errorf(format string, args ...interface{}) error {
+	return &tomlError{line: p.line, column: p.column(), msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *tomlParser) errorAt(node *yaml.Node, format string, args ...interface{}) error {
+	return &tomlError{line: node.Line, column: node.Column, msg: fmt.Sprintf(format, args...)}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const tomlTestConfig = `# archive of the company
+dir = "/srv/mails"
+
+[defaults]
+server = "mail.company.xy"
+port = "${IMAPARC_TEST_PORT}"
+tls = true
+since = 2020-01-01
+exclude = [
+  "Trash", # never archived
+  'Junk\*',
+]
+
+[templates.exchange]
+protocol = "imap"
+namespaces = ["other", "shared"]
+
+[[accounts]]
+name = "alice"
+login = "alice"
+password = "${IMAPARC_TEST_PASSWORD:-secret}"
+concurrency = 0x4
+
+[[accounts]]
+name = "bob"
+template = "exchange"
+login = """
+bob\
+"""
+schedule = '@every 4h'
+
+[search]
+dir = "/srv/mails"
+host = "0.0.0.0"
+port = 8_080
+
+[notify.smtp]
+host = "smtp.company.xy"
+from = "imaparc@company.xy"
+to = ["admin@company.xy"]
+body = '''
+{{ .Summary }}
+'''
+
+[notify]
+webhook = { url = "https://chat.company.xy/hook", headers.X-Token = "t\u00f6ken" }
+
+[[hooks]]
+event = "runFinished"
+command = ["/usr/local/bin/backup", "--quiet"]
+`
+
+const yamlTestConfig = `dir: /srv/mails
+defaults:
+  server: mail.company.xy
+  port: ${IMAPARC_TEST_PORT}
+  tls: true
+  since: "2020-01-01"
+  exclude: [Trash, 'Junk\*']
+templates:
+  exchange:
+    protocol: imap
+    namespaces: [other, shared]
+accounts:
+  - name: alice
+    login: alice
+    password: ${IMAPARC_TEST_PASSWORD:-secret}
+    concurrency: 4
+  - name: bob
+    template: exchange
+    login: bob
+    schedule: "@every 4h"
+search:
+  dir: /srv/mails
+  host: 0.0.0.0
+  port: 8080
+notify:
+  smtp:
+    host: smtp.company.xy
+    from: imaparc@company.xy
+    to: [admin@company.xy]
+    body: |
+      {{ .Summary }}
+  webhook:
+    url: https://chat.company.xy/hook
+    headers:
+      X-Token: "töken"
+hooks:
+  - event: runFinished
+    command: [/usr/local/bin/backup, --quiet]
+`
+
+func TestLoadConfigTOML(t *testing.T) {
+	os.Setenv("IMAPARC_TEST_PORT", "993")
+	defer os.Unsetenv("IMAPARC_TEST_PORT")
+	dir := t.TempDir()
+	var loaded []string
+	for name, content := range map[string]string{"config.toml": tomlTestConfig, "config.yaml": yamlTestConfig} {
+		fname := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(fname, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := LoadConfig(fname)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		b, err := json.Marshal(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded = append(loaded, string(b))
+	}
+	if loaded[0] != loaded[1] {
+		t.Fatalf("toml and yaml differ:\n%s\n%s", loaded[0], loaded[1])
+	}
+	for _, want := range []string{`"port":993`, `"password":"secret"`, `"concurrency":4`, `"login":"bob"`,
+		`"namespaces":["other","shared"]`, `"since":"2020-01-01"`, `"X-Token":"töken"`} {
+		if !strings.Contains(loaded[0], want) {
+			t.Fatalf("expected %s in %s", want, loaded[0])
+		}
+	}
+}
+
+func TestLoadConfigTOMLErrors(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "config.toml")
+	for content, want := range map[string]string{
+		"dir = \"/srv\"\n[[accounts]]\nname = \"a\"\n  unknown = 1\n":        "config.toml:4:3: accounts[0]: unknown field 'unknown'",
+		"[defaults]\nport = \"imap\"\n":                                      "config.toml:2:8: defaults.port: expected an integer but got 'imap'",
+		"dir = \"/srv\"\ndir = \"/tmp\"\n":                                   "config.toml:2:1: key dir is defined twice",
+		"[search]\nport = 1\n[search]\n":                                     "config.toml:3:2: table search is defined twice",
+		"dir = \"/srv\n":                                                     "config.toml:1:12: unterminated string",
+		"dir = /srv\n":                                                       "config.toml:1:7: invalid value '/srv'",
+		"accounts = [{name = \"a\"}]\n[[accounts]]\n":                        "config.toml:2:3: accounts is not an array of tables",
+		"search = {port = 1}\n[search.x]\n":                                  "config.toml:2:2: search is not a table",
+		"dir = \"a\" \"b\"\n":                                                "config.toml:1:11: expected the end of the line",
+		"[defaults]\nport = 012\n":                                           "config.toml:2:8: invalid value '012'",
+		"[defaults]\nlogin = \"\\q\"\n":                                      "config.toml:2:10: invalid escape \\q",
+		"[[accounts]]\nname = \"a\"\nexclude = [\"x\"\n\"y\"]\n":             "config.toml:4:1: expected , or ] in array",
+		"[[accounts]]\nname = \"a\"\nserver = \"${IMAPARC_TEST_MISSING}\"\n": "config.toml:3:10: environment variable IMAPARC_TEST_MISSING is not set",
+	} {
+		if err := ioutil.WriteFile(fname, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := LoadConfig(fname)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("%q: expected %s, got %v", content, want, err)
+		}
+	}
+}
+
+func TestParseTOMLTruncated(t *testing.T) {
+	for i := range tomlTestConfig {
+		// must not panic
+		parseTOML([]byte(tomlTestConfig[:i]))
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Verification compares all mailboxes of an account on the server with the archive. An account is complete, if
+// every mail within the date range of each included mailbox has been archived and no mail is queued for retry.
+// Excluded mailboxes are listed, because they are not archived although they are on the server.
+type Verification struct {
+	Account   string                 `json:"account"`
+	Server    string                 `json:"server"`
+	Login     string                 `json:"login"`
+	Dir       string                 `json:"dir"`
+	Verified  time.Time              `json:"verified"`
+	Complete  bool                   `json:"complete"`
+	Mailboxes []*MailboxVerification `json:"mailboxes"`
+	// Excluded contains the mailboxes on the server, which are not archived due to the configuration.
+	Excluded []string `json:"excluded,omitempty"`
+	// Orphaned contains archived mailbox directories, whose mailbox does not exist on the server anymore.
+	Orphaned []string `json:"orphaned,omitempty"`
+	// Retries contains the mails, which failed to download and are revisited by the next archive runs.
+	Retries []*RetryEntry `json:"retries,omitempty"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// MailboxVerification is the result for a single mailbox. Server counts the mails on the server, Filtered those
+// outside of the date range and Duplicates the mails sharing a header hash with another mail, which are archived
+// as a single file. MetaCount is the number of mails on the server recorded by the last archive run.
+type MailboxVerification struct {
+	Name       string         `json:"name"`
+	Dir        string         `json:"dir"`
+	Server     int            `json:"server"`
+	Filtered   int            `json:"filtered"`
+	Duplicates int            `json:"duplicates"`
+	Archived   int            `json:"archived"`
+	MetaCount  int            `json:"metaCount"`
+	Missing    []*MissingMail `json:"missing,omitempty"`
+	// Extra contains the header hashes of archived mails, which have been deleted on the server.
+	Extra []string `json:"extra,omitempty"`
+}
+
+// MissingMail is a mail on the server without an archived file.
+type MissingMail struct {
+	Hash  string `json:"hash"`
+	UID   uint32 `json:"uid"`
+	Title string `json:"title"`
+}
+
+// CountMismatch returns true, if the server holds a different number of mails than at the last archive run.
+func (m *MailboxVerification) CountMismatch() bool {
+	return m.MetaCount != m.Server
+}
+
+// Verify compares the server with the archive of the given account. Nothing is downloaded or written.
+func (a *App) Verify(cfg *Config) *Verification {
+	a.cfg = cfg
+	a.storage = storageOf(cfg.Storage)
+	v := &Verification{Account: cfg.Name, Server: cfg.Server, Login: cfg.Login, Dir: cfg.Dir, Verified: time.Now()}
+	if err := a.verify(v); err != nil {
+		v.Error = err.Error()
+		return v
+	}
+	v.Complete = v.complete()
+	return v
+}
+
+// complete returns true, if no mail is missing or queued for retry.
+func (v *Verification) complete() bool {
+	for _, mb := range v.Mailboxes {
+		if len(mb.Missing) > 0 {
+			return false
+		}
+	}
+	return len(v.Retries) == 0
+}
+
+func (a *App) verify(v *Verification) error {
+	imap, err := a.connect()
+	if err != nil {
+		return err
+	}
+	defer imap.Logout()
+
+	for name := range a.delimiters {
+		if !a.cfg.IncludesMailbox(name) {
+			v.Excluded = append(v.Excluded, name)
+		}
+	}
+	sort.Strings(v.Excluded)
+	orphans, err := a.findOrphans()
+	if err != nil {
+		return err
+	}
+	for dir := range orphans {
+		v.Orphaned = append(v.Orphaned, dir)
+	}
+	sort.Strings(v.Orphaned)
+
+	retries, err := loadRetryQueue(a.cfg.Dir)
+	if err != nil {
+		logger.Warn("cannot load retry queue", "account", a.cfg.Name, "err", err)
+	}
+	v.Retries = retries.Entries
+
+	for _, mb := range a.mailboxes {
+		targetDir := a.mailboxDir(mb.Name)
+		if ok, err := a.storage.Exists(filepath.Join(targetDir, metaFile)); err == nil && !ok {
+			// nothing is written, so a directory of an older version is verified where the next run migrates it from
+			if legacyDir := a.legacyDir(mb.Name); len(legacyDir) > 0 {
+				logger.Info("mailbox directory not migrated yet", "account", a.cfg.Name, "mailbox", mb.Name,
+					"dir", legacyDir, "target", targetDir)
+				targetDir = legacyDir
+			}
+		}
+		// filtered mails are scanned as well, so that archived mails outside of the date range are not extra
+		all, _, err := a.scanMailbox(imap, mb, targetDir, a.cfg.IncludesDate)
+		if err != nil {
+			return err
+		}
+		meta, err := readStoredMeta(a.storage, targetDir)
+		if err != nil {
+			logger.Warn("cannot read mailbox meta", "account", a.cfg.Name, "mailbox", mb.Name, "err", err)
+		}
+		archived, err := archivedHashes(a.storage, targetDir)
+		if err != nil {
+			return err
+		}
+		res := &MailboxVerification{
+			Name:      mb.Name,
+			Dir:       targetDir,
+			Server:    int(mb.Messages),
+			Archived:  len(archived),
+			MetaCount: meta.Count,
+		}
+		onServer := make(map[string]bool)
+		for _, mail := range all {
+			if onServer[mail.hash] {
+				res.Duplicates++
+				continue
+			}
+			onServer[mail.hash] = true
+			if mail.filtered {
+				res.Filtered++
+				continue
+			}
+			if !mail.archived {
+				res.Missing = append(res.Missing, &MissingMail{Hash: mail.hash, UID: mail.msg.Uid, Title: debugTitle(mail.msg)})
+			}
+		}
+		for _, hash := range archived {
+			if !onServer[hash] {
+				res.Extra = append(res.Extra, hash)
+			}
+		}
+		logger.Debug("verified mailbox", "account", a.cfg.Name, "mailbox", mb.Name, "server", res.Server,
+			"archived", res.Archived, "missing", len(res.Missing), "extra", len(res.Extra))
+		v.Mailboxes = append(v.Mailboxes, res)
+	}
+	return nil
+}
+
+// archivedHashes returns the header hashes of all mails archived in dir.
+func archivedHashes(storage Storage, dir string) ([]string, error) {
+	files, err := storage.List(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", dir, err)
+	}
+	var res []string
+	for _, f := range files {
+		if strings.HasSuffix(f, ".eml") {
+			res = append(res, strings.TrimSuffix(f, ".eml"))
+		}
+	}
+	return res, nil
+}
+
+// PrintVerification writes a table with one row per mailbox and lists all missing mails. If the logger uses
+// json, the rows are logged instead.
+func PrintVerification(w io.Writer, v *Verification) {
+	if logger.JSON() {
+		for _, mb := range v.Mailboxes {
+			logger.Info("verified", "account", v.Account, "mailbox", mb.Name, "server", mb.Server, "archived", mb.Archived,
+				"filtered", mb.Filtered, "missing", len(mb.Missing), "extra", len(mb.Extra), "countMismatch", mb.CountMismatch())
+			for _, mail := range mb.Missing {
+				logger.Warn("missing mail", "account", v.Account, "mailbox", mb.Name, "uid", mail.UID, "hash", mail.Hash,
+					"mail", mail.Title)
+			}
+		}
+		for _, name := range v.Excluded {
+			logger.Info("excluded mailbox", "account", v.Account, "mailbox", name)
+		}
+		for _, e := range v.Retries {
+			logger.Warn("mail queued for retry", "account", v.Account, "mailbox", e.Mailbox, "uid", e.UID, "hash", e.Hash,
+				"mail", e.Title, "attempts", e.Attempts, "reason", e.Reason)
+		}
+		logger.Info("verification", "account", v.Account, "complete", v.Complete, "excluded", len(v.Excluded),
+			"orphaned", len(v.Orphaned), "retries", len(v.Retries), "error", v.Error)
+		return
+	}
+
+	fmt.Fprintf(w, "account %s (%s@%s) in %s\n", v.Account, v.Login, v.Server, v.Dir)
+	if len(v.Error) > 0 {
+		fmt.Fprintf(w, "verification failed: %s\n", v.Error)
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "MAILBOX\tSERVER\tARCHIVED\tFILTERED\tMISSING\tEXTRA\tLAST RUN")
+	for _, mb := range v.Mailboxes {
+		lastRun := fmt.Sprintf("%d", mb.MetaCount)
+		if mb.CountMismatch() {
+			lastRun += " (changed)"
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t%s\n", mb.Name, mb.Server, mb.Archived, mb.Filtered, len(mb.Missing),
+			len(mb.Extra), lastRun)
+	}
+	tw.Flush()
+	for _, mb := range v.Mailboxes {
+		for _, mail := range mb.Missing {
+			fmt.Fprintf(w, "missing: %s uid %d %s\n", mb.Name, mail.UID, mail.Title)
+		}
+	}
+	for _, name := range v.Excluded {
+		fmt.Fprintf(w, "excluded: %s\n", name)
+	}
+	for _, dir := range v.Orphaned {
+		fmt.Fprintf(w, "orphaned: %s\n", dir)
+	}
+	for _, e := range v.Retries {
+		fmt.Fprintf(w, "retry: %s uid %d %s (%d attempts: %s)\n", e.Mailbox, e.UID, e.Title, e.Attempts, e.Reason)
+	}
+	verdict := "archive is INCOMPLETE"
+	if v.Complete {
+		verdict = "archive is complete"
+	}
+	if len(v.Excluded) > 0 {
+		verdict += fmt.Sprintf(", mailboxes excluded by the configuration: %d", len(v.Excluded))
+	}
+	fmt.Fprintln(w, verdict)
+}
+
+// verifyCommand reconciles the archive with the server: imaparc verify [account flags|-configFile] [-report file]
+func verifyCommand(args []string) int {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	cfg := &Config{}
+	addAccountFlags(flags, cfg)
+	configFile := flags.String("configFile", "", "filename to a configuration in yaml, json or toml format")
+	report := flags.String("report", "", "filename to write the verification as json")
+	flags.Parse(args)
+
+	var results []*Verification
+	code := 0
+	for _, accCfg := range accountConfigs(cfg, *configFile) {
+		v := (&App{}).Verify(accCfg)
+		PrintVerification(os.Stdout, v)
+		results = append(results, v)
+		switch {
+		case len(v.Error) > 0:
+			code = 1
+		case !v.Complete && code == 0:
+			code = 6
+		}
+	}
+
+	if len(*report) > 0 {
+		b, err := json.MarshalIndent(results, "", " ")
+		if err == nil {
+			err = ioutil.WriteFile(*report, b, os.ModePerm)
+		}
+		if err != nil {
+			logger.Error("cannot write verification", "file", *report, "err", err)
+			return 2
+		}
+	}
+	return code
+}
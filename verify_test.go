@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestVerificationVerdict(t *testing.T) {
+	tests := []struct {
+		name     string
+		v        *Verification
+		complete bool
+		verdict  string
+	}{
+		{"complete", &Verification{Mailboxes: []*MailboxVerification{{Name: "INBOX"}}}, true,
+			"archive is complete"},
+		{"missing", &Verification{Mailboxes: []*MailboxVerification{{Name: "INBOX", Missing: []*MissingMail{{UID: 1}}}}},
+			false, "archive is INCOMPLETE"},
+		{"retries", &Verification{Retries: []*RetryEntry{{Mailbox: "INBOX", UID: 2}}}, false,
+			"archive is INCOMPLETE"},
+		{"excluded", &Verification{Excluded: []string{"Junk", "Trash"}}, true,
+			"archive is complete, mailboxes excluded by the configuration: 2"},
+	}
+	for _, test := range tests {
+		test.v.Complete = test.v.complete()
+		if test.v.Complete != test.complete {
+			t.Errorf("%s: expected complete %t", test.name, test.complete)
+		}
+		var buf bytes.Buffer
+		PrintVerification(&buf, test.v)
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		if verdict := lines[len(lines)-1]; verdict != test.verdict {
+			t.Errorf("%s: expected verdict %q, got %q", test.name, test.verdict, verdict)
+		}
+	}
+}